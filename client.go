@@ -0,0 +1,322 @@
+// This file declares what the storage controller passes to and gets back
+// from its client library: the API client and its options, informer
+// events, the event recorder, work queues and leader election.  The calls
+// themselves (GetPV, UpdatePV, NewSharedInformer, RunLeaderElection, ...)
+// are the library's and are only named in this package.  The ones that read
+// and write API objects are only named in libraryAPI: the controller makes
+// them through api, which tests replace with a fake store.
+
+package persistentvolume
+
+import "time"
+
+// Client is a connection to the API server, made by NewClient.
+type Client interface {
+	Config() ClientConfig
+}
+
+// ClientConfig configures a Client, see newAPIClient.
+type ClientConfig struct {
+	// Content types to accept, in order of preference.
+	AcceptContentTypes []string
+	// Content type of request bodies.
+	ContentType string
+	// Client-side rate limit: QPS requests per second on average, bursts
+	// of up to Burst.
+	QPS   float32
+	Burst int
+	// If set, every write is sent with dryRun=All: validated by the API
+	// server, not persisted.  OnDryRunWrite is called for each.
+	DryRun        bool
+	OnDryRunWrite func(verb, kind, namespace, name string)
+	// Called with the Date header of each response that has one.
+	OnServerTime func(serverNow time.Time)
+}
+
+// APIServer reads and writes API objects on the API server, beyond the
+// informer caches (PVLister, PVCLister).  The errors are the library's, for
+// IsNotFound, IsConflict and friends.
+type APIServer interface {
+	GetPV(name string) (*PV, error)
+	// GetPVFromServer and GetPVCFromServer return nil if the object does
+	// not exist or cannot be read.
+	GetPVFromServer(name string) *PV
+	GetPVCFromServer(namespace, name string) *PVClaim
+	CreatePV(pv *PV) error
+	DeletePV(pv *PV) error
+	// The writes update the resourceVersion of the object they are given.
+	UpdatePV(pv *PV) error
+	UpdatePVC(pvc *PVClaim) error
+	UpdatePVStatus(pv *PV, opts UpdateOptions) error
+	UpdatePVCStatus(pvc *PVClaim, opts UpdateOptions) error
+	PatchPV(name string, patchType PatchType, patch []byte) error
+	PatchPVC(namespace, name string, patchType PatchType, patch []byte) error
+	ApplyPV(config *PVApplyConfiguration, opts ApplyOptions) error
+	ApplyPVC(config *PVCApplyConfiguration, opts ApplyOptions) error
+	// ListPVCs returns the claims in namespace for which filter returns
+	// true.
+	ListPVCs(namespace string, filter func(pvc *PVClaim) bool) []*PVClaim
+	// FindPVBoundTo returns the PV whose ClaimPtr points to pvc, or nil.
+	FindPVBoundTo(pvc *PVClaim) *PV
+	GetClass(name string) *StorageClass
+	// GetDefaultClass returns nil unless exactly one class is the default.
+	GetDefaultClass() *StorageClass
+	GetProvisioningQuota(namespace string) *ProvisioningQuota
+	GetSecret(namespace, name string) *Secret
+	ListSecrets(namespace, selector string) []*Secret
+	FindLatestSnapshot(pv *PV) *Snapshot
+}
+
+// api is the API server of the controller.
+var api APIServer = libraryAPI{}
+
+// libraryAPI is the client library's APIServer.
+type libraryAPI struct{}
+
+func (libraryAPI) GetPV(name string) (*PV, error)      { return GetPV(name) }
+func (libraryAPI) GetPVFromServer(name string) *PV     { return GetPVFromServer(name) }
+func (libraryAPI) CreatePV(pv *PV) error               { return CreatePV(pv) }
+func (libraryAPI) DeletePV(pv *PV) error               { return DeletePV(pv) }
+func (libraryAPI) UpdatePV(pv *PV) error               { return UpdatePV(pv) }
+func (libraryAPI) UpdatePVC(pvc *PVClaim) error        { return UpdatePVC(pvc) }
+func (libraryAPI) GetClass(name string) *StorageClass  { return GetClass(name) }
+func (libraryAPI) GetDefaultClass() *StorageClass      { return GetDefaultClass() }
+func (libraryAPI) FindPVBoundTo(pvc *PVClaim) *PV      { return FindPVBoundTo(pvc) }
+func (libraryAPI) FindLatestSnapshot(pv *PV) *Snapshot { return FindLatestSnapshot(pv) }
+
+func (libraryAPI) GetPVCFromServer(namespace, name string) *PVClaim {
+	return GetPVCFromServer(namespace, name)
+}
+
+func (libraryAPI) UpdatePVStatus(pv *PV, opts UpdateOptions) error {
+	return UpdatePVStatus(pv, opts)
+}
+
+func (libraryAPI) UpdatePVCStatus(pvc *PVClaim, opts UpdateOptions) error {
+	return UpdatePVCStatus(pvc, opts)
+}
+
+func (libraryAPI) PatchPV(name string, patchType PatchType, patch []byte) error {
+	return PatchPV(name, patchType, patch)
+}
+
+func (libraryAPI) PatchPVC(namespace, name string, patchType PatchType, patch []byte) error {
+	return PatchPVC(namespace, name, patchType, patch)
+}
+
+func (libraryAPI) ApplyPV(config *PVApplyConfiguration, opts ApplyOptions) error {
+	return ApplyPV(config, opts)
+}
+
+func (libraryAPI) ApplyPVC(config *PVCApplyConfiguration, opts ApplyOptions) error {
+	return ApplyPVC(config, opts)
+}
+
+func (libraryAPI) ListPVCs(namespace string, filter func(pvc *PVClaim) bool) []*PVClaim {
+	return ListPVCs(namespace, filter)
+}
+
+func (libraryAPI) GetProvisioningQuota(namespace string) *ProvisioningQuota {
+	return GetProvisioningQuota(namespace)
+}
+
+func (libraryAPI) GetSecret(namespace, name string) *Secret {
+	return GetSecret(namespace, name)
+}
+
+func (libraryAPI) ListSecrets(namespace, selector string) []*Secret {
+	return ListSecrets(namespace, selector)
+}
+
+// PVLister and PVCLister read PVs and claims from the informer caches.  They
+// hand out copies; Get and GetByKey return nil if there is no such object.
+// The keys are the queue keys: "pv/<name>" and "pvc/<namespace>/<name>".
+type PVLister interface {
+	Get(name string) *PV
+	GetByKey(key string) *PV
+	List() []*PV
+}
+
+type PVCLister interface {
+	Get(namespace, name string) *PVClaim
+	GetByKey(key string) *PVClaim
+	List() []*PVClaim
+}
+
+// UpdateOptions and ApplyOptions are sent with writes.  FieldManager names
+// the writer for server-side field ownership.
+type UpdateOptions struct {
+	FieldManager string
+}
+
+type ApplyOptions struct {
+	FieldManager string
+	// Take over fields owned by other managers instead of failing with a
+	// conflict.
+	Force bool
+}
+
+// PatchType is the content type of a patch.
+type PatchType string
+
+const MergePatchType PatchType = "application/merge-patch+json"
+
+// PVApplyConfiguration is the part of a PV sent with a server-side apply;
+// fields not set are not owned by the applier.  See pvApplyConfiguration.
+type PVApplyConfiguration struct {
+	Name            string
+	ResourceVersion *string
+	Annotations     map[string]string
+	Finalizers      []string
+	ClaimPtr        *ObjectReference
+}
+
+func (c *PVApplyConfiguration) WithResourceVersion(resourceVersion string) *PVApplyConfiguration {
+	c.ResourceVersion = &resourceVersion
+	return c
+}
+
+func (c *PVApplyConfiguration) WithClaimPtr(ref *ObjectReference) *PVApplyConfiguration {
+	c.ClaimPtr = ref
+	return c
+}
+
+func (c *PVApplyConfiguration) WithAnnotation(key, value string) *PVApplyConfiguration {
+	if c.Annotations == nil {
+		c.Annotations = map[string]string{}
+	}
+	c.Annotations[key] = value
+	return c
+}
+
+func (c *PVApplyConfiguration) WithFinalizer(finalizer string) *PVApplyConfiguration {
+	c.Finalizers = append(c.Finalizers, finalizer)
+	return c
+}
+
+// PVCApplyConfiguration is PVApplyConfiguration for claims.
+type PVCApplyConfiguration struct {
+	Namespace        string
+	Name             string
+	ResourceVersion  *string
+	Annotations      map[string]string
+	Finalizers       []string
+	VolumePtr        *ObjectReference
+	StorageClassName *string
+}
+
+func (c *PVCApplyConfiguration) WithResourceVersion(resourceVersion string) *PVCApplyConfiguration {
+	c.ResourceVersion = &resourceVersion
+	return c
+}
+
+func (c *PVCApplyConfiguration) WithVolumePtr(ref *ObjectReference) *PVCApplyConfiguration {
+	c.VolumePtr = ref
+	return c
+}
+
+func (c *PVCApplyConfiguration) WithStorageClassName(name string) *PVCApplyConfiguration {
+	c.StorageClassName = &name
+	return c
+}
+
+func (c *PVCApplyConfiguration) WithAnnotation(key, value string) *PVCApplyConfiguration {
+	if c.Annotations == nil {
+		c.Annotations = map[string]string{}
+	}
+	c.Annotations[key] = value
+	return c
+}
+
+func (c *PVCApplyConfiguration) WithFinalizer(finalizer string) *PVCApplyConfiguration {
+	c.Finalizers = append(c.Finalizers, finalizer)
+	return c
+}
+
+// DeletionPropagation says what happens to the objects a deleted object
+// owns, e.g. the pods of a job.
+type DeletionPropagation string
+
+// The owned objects are deleted after the owner, by the garbage collector.
+const PropagationBackground DeletionPropagation = "Background"
+
+// Resource names a kind of API object to watch.
+type Resource string
+
+const (
+	PVs      Resource = "persistentvolumes"
+	PVClaims Resource = "persistentvolumeclaims"
+	Pods     Resource = "pods"
+)
+
+// Event is what happened to the object passed to a watch handler.  On
+// DELETE, the object is the last state the watch saw.
+type Event string
+
+const (
+	CREATE Event = "CREATE"
+	MODIFY Event = "MODIFY"
+	DELETE Event = "DELETE"
+)
+
+// EventRecorder records events about API objects, for users; see
+// recordEvent.  The event is shown with obj, e.g. by "kubectl describe".
+type EventRecorder interface {
+	Event(obj Object, eventType, reason, message string)
+}
+
+// The types of an event.
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+// DelayingQueue is a work queue of object keys.  A key is handed to one
+// worker at a time: it is not given out again until the worker calls Done,
+// and adding it meanwhile queues it once more after that.
+type DelayingQueue interface {
+	// AddAfter queues key after delay, and then calls added.
+	AddAfter(key string, delay time.Duration, added func())
+	// TryGet returns the next key and when it was queued, or false if
+	// there is none; it does not wait.
+	TryGet() (key string, queuedAt time.Time, ok bool)
+	Done(key string)
+}
+
+// LeaderElectionConfig configures RunLeaderElection.
+type LeaderElectionConfig struct {
+	Lock LeaseLock
+	// How long a lease is valid after its last renewal, how long the
+	// leader tries to renew it before giving up, and how often the others
+	// try to take it.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+	// Release the lease when the context of RunLeaderElection is cancelled.
+	ReleaseOnCancel  bool
+	OnStartedLeading func()
+	OnStoppedLeading func()
+}
+
+// LeaseLock is the object the instances compete for, made by NewLeaseLock.
+type LeaseLock interface {
+	Identity() string
+}
+
+// HandoffRecord is what a leader that shuts down leaves for the next one,
+// see publishHandoff.
+type HandoffRecord struct {
+	// Keys of the objects whose operations were interrupted.
+	InFlightKeys []string
+}
+
+// Request and ResponseWriter are the request to a debug endpoint and its
+// response, see RegisterDebugHandler.
+type Request struct {
+	Path  string
+	Query map[string]string
+}
+
+type ResponseWriter interface {
+	Write(p []byte) (int, error)
+}
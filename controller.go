@@ -6,7 +6,8 @@
 // The fundamental key to this design is the bi-directional "pointer" between
 // PersistentVolumes (PVs) and PersistentVolumeClaims (PVCs), which is
 // represented here as pvc.Spec.VolumePtr and pv.Spec.ClaimPtr (which are a
-// little different in name than the actual Go structs).  The bi-directionality
+// little different in name than the actual Go structs).  Both are
+// references by name and UID; see types.go.  The bi-directionality
 // is complicated to manage in a transactionless system, but without it we
 // can't ensure sane behavior in the face of different forms of trouble.  For
 // example, a rogue HA controller instance could end up racing and making
@@ -20,6 +21,28 @@
 // document where things could break down in an active/active situation, but
 // active/active is out of scope for now.
 
+package persistentvolume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/bits"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
 // This annotation applies to PVCs.  It indicates that the lifecycle of the PVC
 // has passed through the initial setup.  This information changes how we
 // interpret some observations of the state of the objects.
@@ -31,7 +54,9 @@ const annWasEverBound = "pv.kubernetes.io/bound-completed"
 const annBoundByController = "pv.kubernetes.io/bound-by-controller"
 
 // This annotation represents a new field which instructs dynamic provisioning
-// to choose a particular storage class (aka profile).
+// to choose a particular storage class (aka profile).  The field is
+// pvc.Spec.StorageClassName; the annotation is kept for compatibility.  Use
+// getClaimClass() instead of reading either directly.
 const annClass = "volume.alpha.kubernetes.io/storage-class"
 
 // This annotation is added to a PV that has been dynamically provisioned by
@@ -40,9 +65,463 @@ const annClass = "volume.alpha.kubernetes.io/storage-class"
 // recognize dynamically provisioned PVs in its decissions).
 const annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
 
+// This annotation is added to a PVC whose class is provisioned by an
+// out-of-tree (external) provisioner.  Its value is the name of the
+// provisioner that is expected to create a PV for the claim; the controller
+// does nothing else until that PV appears.
+const annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
+
+// This annotation is added to a Released PV that an external provisioner
+// must delete.  Its value is the name of that provisioner (the value of
+// annDynamicallyProvisioned).  The external component deletes the asset and
+// the PV API object; the controller does nothing else with the PV.
+const annDeletionRequested = "pv.kubernetes.io/deletion-requested"
+
+// This finalizer is added to PVs bound by the controller.  A user deleting
+// a bound PV only sets its deletionTimestamp; the PV object stays until the
+// claim is gone and the volume has been reclaimed, and then syncPV removes
+// the finalizer.
+const finalizerPVProtection = "kubernetes.io/pv-protection"
+
+// This finalizer is added to all PVCs.  A user deleting a claim that a pod
+// still mounts only sets its deletionTimestamp; the claim, and so its PV,
+// is not released until the pods are gone.
+const finalizerPVCProtection = "kubernetes.io/pvc-protection"
+
+// These annotations apply to PVs, for recyclers that run out of process
+// (see recycleVolumeExternally).  The controller sets annRecycleRequested
+// (to the name of the external recycler) on a PV that needs scrubbing.  The
+// external recycler scrubs it and sets annRecycleCompleted to the UID of the
+// PV; a marker with another UID is left over from an earlier life of a PV
+// with the same name and is ignored.  The controller then makes the PV
+// Available and removes both.
+const annRecycleRequested = "pv.kubernetes.io/recycle-requested"
+const annRecycleCompleted = "pv.kubernetes.io/recycle-completed"
+
+// syncResult tells the caller of a sync function when the object needs to
+// be synced again.  Every path that cannot finish its work now must say how
+// soon it wants to be retried, rather than waiting for the periodic resync.
+type syncResult struct {
+	// Zero means the object does not need to be synced again until
+	// something changes.
+	requeueAfter time.Duration
+	// The sync failed on an API error; requeue backs off if it keeps
+	// failing.
+	failed bool
+}
+
+// The object is in its desired state, or nothing can be done about it.
+var done = syncResult{}
+
+func requeueAfter(d time.Duration) syncResult {
+	return syncResult{requeueAfter: d}
+}
+
+// apiFailed returns the result of a sync that failed on an API error other
+// than a conflict.
+func apiFailed() syncResult {
+	return syncResult{requeueAfter: retryAfterAPIError, failed: true}
+}
+
+// Retry latencies for the different kinds of "not now".
+const (
+	// A Commit*, Create* or Delete* call failed; it is likely a transient
+	// error.
+	retryAfterAPIError = time.Second
+	// A Commit* call failed on its resourceVersion precondition: somebody
+	// else changed the object since we read it.  Sync again as soon as the
+	// cache has the new version, and decide again based on it; never
+	// retry the same write.
+	retryAfterConflict = 100 * time.Millisecond
+	// Waiting for a provisioner to create a volume.
+	retryWhileProvisioning = 5 * time.Second
+	// Waiting for the user or the admin to fix something.  We get a watch
+	// event when they do, so this is only a safety net.
+	retryAfterUserError = time.Minute
+)
+
+// commitFailed returns the result of a sync whose Commit* call failed.
+//
+// CommitPV, CommitPVC, CommitPVStatus and CommitPVCStatus always send the
+// resourceVersion of the object as we read it, so that the API server
+// rejects the write with a Conflict if the object changed in the meantime
+// (e.g. a second controller instance bound it).  A blind overwrite here is
+// how two claims end up bound to one volume.
+func commitFailed(err error) syncResult {
+	if IsConflict(err) {
+		metrics.Counter("pv_controller_commit_conflicts_total").Inc()
+		return requeueAfter(retryAfterConflict)
+	}
+	return apiFailed()
+}
+
+// Retries of updatePVWithRetry and updatePVCWithRetry after the first
+// attempt.
+const maxCommitRetries = 3
+
+// updatePVWithRetry applies mutate to pv and commits it.  On a Conflict, it
+// reads the PV from the server (the cache may not have the new version
+// yet), applies mutate to that and commits again, up to maxCommitRetries
+// times, all within the same sync.  On return, pv holds what was last
+// committed (or read).
+//
+// This is only for changes that do not depend on the rest of the object,
+// like removing our finalizer or stamping an annotation; mutate must
+// check again whatever it relies on and return an error to give up.  A
+// sync that decided something based on the old version (bind to this PV?
+// release it?) must not use this: it returns commitFailed(err) and decides
+// again, see retryAfterConflict.
+func updatePVWithRetry(pv *PV, mutate func(pv *PV) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := mutate(pv); err != nil {
+			return err
+		}
+		err := CommitPV(pv)
+		if err == nil || !IsConflict(err) || attempt == maxCommitRetries {
+			return err
+		}
+		metrics.Counter("pv_controller_commit_retries_total", "kind", "pv").Inc()
+		fresh := api.GetPVFromServer(pv.Name)
+		if fresh == nil || fresh.UID != pv.UID {
+			// Deleted (and maybe re-created); not ours to change.
+			return err
+		}
+		*pv = *fresh
+	}
+}
+
+// updatePVCWithRetry is updatePVWithRetry for claims.
+func updatePVCWithRetry(pvc *PVClaim, mutate func(pvc *PVClaim) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := mutate(pvc); err != nil {
+			return err
+		}
+		err := CommitPVC(pvc)
+		if err == nil || !IsConflict(err) || attempt == maxCommitRetries {
+			return err
+		}
+		metrics.Counter("pv_controller_commit_retries_total", "kind", "pvc").Inc()
+		fresh := api.GetPVCFromServer(pvc.Namespace, pvc.Name)
+		if fresh == nil || fresh.UID != pvc.UID {
+			return err
+		}
+		*pvc = *fresh
+	}
+}
+
+// commitMode selects how CommitPV and CommitPVC write:
+//
+//   - "update" (default): the whole object.
+//   - "patch": a JSON merge patch of only the fields the controller changed
+//     (ClaimPtr, VolumePtr, annotations, finalizers, ...).  Another actor
+//     that changed an unrelated field (a label, a resize) then does not
+//     make our write fail.
+//   - "apply": server-side apply of the fields the controller owns, as
+//     field manager pvControllerFieldManager.  The API server tracks the
+//     ownership; another manager writing one of these fields is reported
+//     as a Conflict instead of being overwritten, and is visible in
+//     managedFields.
+//
+// Status writes (CommitPVStatus, CommitPVCStatus) go to the status
+// subresource, which only the controller writes; they stay full updates in
+// all modes.  The client sends pvControllerFieldManager with them too, so
+// the API server records the phase as ours.  Set from a command line flag.
+var commitMode = "update"
+
+const pvControllerFieldManager = "pv-controller"
+
+// CommitPV writes the spec and metadata of pv.
+func CommitPV(pv *PV) error {
+	err := commitPV(pv)
+	apiBreaker.Record(err)
+	return err
+}
+
+func commitPV(pv *PV) error {
+	switch commitMode {
+	case "apply":
+		return api.ApplyPV(pvApplyConfiguration(pv), ApplyOptions{FieldManager: pvControllerFieldManager})
+	case "patch":
+	default:
+		return api.UpdatePV(pv)
+	}
+	old := pvLister.Get(pv.Name)
+	if old == nil {
+		return api.UpdatePV(pv)
+	}
+	patch, err := commitPatch(old, pv, pv.ResourceVersion)
+	if err != nil || patch == nil {
+		return err
+	}
+	return api.PatchPV(pv.Name, MergePatchType, patch)
+}
+
+// CommitPVC writes the spec and metadata of pvc.
+func CommitPVC(pvc *PVClaim) error {
+	err := commitPVC(pvc)
+	apiBreaker.Record(err)
+	return err
+}
+
+func commitPVC(pvc *PVClaim) error {
+	switch commitMode {
+	case "apply":
+		return api.ApplyPVC(pvcApplyConfiguration(pvc), ApplyOptions{FieldManager: pvControllerFieldManager})
+	case "patch":
+	default:
+		return api.UpdatePVC(pvc)
+	}
+	old := pvcLister.Get(pvc.Namespace, pvc.Name)
+	if old == nil {
+		return api.UpdatePVC(pvc)
+	}
+	patch, err := commitPatch(old, pvc, pvc.ResourceVersion)
+	if err != nil || patch == nil {
+		return err
+	}
+	return api.PatchPVC(pvc.Namespace, pvc.Name, MergePatchType, patch)
+}
+
+// apiBreaker stops all syncs when the API server is degraded.  Each sync
+// retries its own failed commit with backoff (see requeue), but with
+// thousands of objects, thousands of syncs in backoff still hit the API
+// server every second or so, which is the last thing it needs.  After
+// breakerThreshold server errors in a row from CommitPV and CommitPVC, the
+// breaker opens: syncKey requeues keys without syncing them for
+// breakerOpenPeriod, doubled with each trip in a row up to maxBackoff, and
+// the readiness check fails.  Then syncs run again; the first commit
+// decides whether the breaker closes (any reply from the server but an
+// error) or opens again at once.
+//
+// Operations in their own goroutines are not stopped; they are limited
+// anyway (maxProvisioners, maxDeleters, maxRecyclers).
+var apiBreaker = &circuitBreaker{}
+
+const (
+	breakerThreshold  = 10
+	breakerOpenPeriod = 30 * time.Second
+)
+
+type circuitBreaker struct {
+	lock sync.Mutex
+	// Server errors in a row.
+	failures int
+	// Times opened in a row.
+	trips     int
+	openUntil time.Time
+}
+
+// isServerError tells whether err means the API server is in trouble, as
+// opposed to a problem with our request (Conflict, Invalid, Forbidden, ...).
+func isServerError(err error) bool {
+	return IsInternalError(err) || IsServiceUnavailable(err) || IsServerTimeout(err) || IsTimeout(err) || IsTooManyRequests(err)
+}
+
+// Record is called with the result of every commit.
+func (b *circuitBreaker) Record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil || !isServerError(err) {
+		if b.trips > 0 {
+			log.Info("API server recovered, resuming syncs")
+		}
+		b.failures = 0
+		b.trips = 0
+		metrics.Gauge("pv_controller_api_breaker_open").Set(0)
+		return
+	}
+	b.failures++
+	if b.failures < breakerThreshold || clock.Now().Before(b.openUntil) {
+		return
+	}
+	period := breakerOpenPeriod << b.trips
+	if period > maxBackoff || period <= 0 {
+		period = maxBackoff
+	}
+	b.trips++
+	b.openUntil = clock.Now().Add(period)
+	metrics.Counter("pv_controller_api_breaker_trips_total").Inc()
+	metrics.Gauge("pv_controller_api_breaker_open").Set(1)
+	log.Error(err, "API server keeps failing, pausing syncs", "failures", b.failures, "pause", period)
+}
+
+// Open returns how long syncs are still paused, or 0.
+func (b *circuitBreaker) Open() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return max(0, clock.Until(b.openUntil))
+}
+
+// checkReady is the readiness check of the controller: not ready while the
+// breaker is open, so that the admin (and whatever watches the pod) sees
+// it.  It does not restart anything; liveness is separate.
+func checkReady() error {
+	if pause := apiBreaker.Open(); pause > 0 {
+		return fmt.Errorf("API server failing, syncs paused for %v", pause)
+	}
+	return nil
+}
+
+// CommitPVStatus writes the status of pv.  A phase change that
+// PVPhaseTransitions does not allow is not written: it is a bug in the
+// sync that asked for it, and the error says so.
+//
+// OBSERVATION: the phase is checked against the cache, which may be a step
+// behind.  A valid change can then be refused once; like a Conflict, the
+// next sync, with the cache caught up, gets it through.
+func CommitPVStatus(pv *PV) error {
+	if old := pvLister.Get(pv.Name); old != nil {
+		if err := ValidatePVPhaseTransition(old.Status.Phase, pv.Status.Phase); err != nil {
+			metrics.Counter("pv_controller_invalid_phase_transitions_total", "kind", "pv").Inc()
+			log.Error(err, "refusing to write volume status", "volume", pv.Name, "volumeUID", pv.UID)
+			return err
+		}
+	}
+	return api.UpdatePVStatus(pv, UpdateOptions{FieldManager: pvControllerFieldManager})
+}
+
+// CommitPVCStatus writes the status of pvc; see CommitPVStatus.
+func CommitPVCStatus(pvc *PVClaim) error {
+	if old := pvcLister.Get(pvc.Namespace, pvc.Name); old != nil {
+		if err := ValidateClaimPhaseTransition(old.Status.Phase, pvc.Status.Phase); err != nil {
+			metrics.Counter("pv_controller_invalid_phase_transitions_total", "kind", "pvc").Inc()
+			log.Error(err, "refusing to write claim status", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID)
+			return err
+		}
+	}
+	return api.UpdatePVCStatus(pvc, UpdateOptions{FieldManager: pvControllerFieldManager})
+}
+
+// pvApplyConfiguration returns the fields of pv the controller owns: the
+// claim pointer, our annotations (controllerAnnotations) and our
+// finalizer.  Fields not in here are not touched by the apply, and are not
+// claimed by our field manager.  Not forcing the apply is the point: a
+// conflict means somebody else thinks they own the binding.
+func pvApplyConfiguration(pv *PV) *PVApplyConfiguration {
+	config := NewPVApplyConfiguration(pv.Name).
+		WithResourceVersion(pv.ResourceVersion).
+		WithClaimPtr(pv.Spec.ClaimPtr)
+	for _, ann := range controllerAnnotations {
+		if value, found := pv.Annotations[ann]; found {
+			config = config.WithAnnotation(ann, value)
+		}
+	}
+	if hasFinalizer(pv, finalizerPVProtection) {
+		config = config.WithFinalizer(finalizerPVProtection)
+	}
+	return config
+}
+
+// pvcApplyConfiguration is pvApplyConfiguration for claims.
+func pvcApplyConfiguration(pvc *PVClaim) *PVCApplyConfiguration {
+	config := NewPVCApplyConfiguration(pvc.Namespace, pvc.Name).
+		WithResourceVersion(pvc.ResourceVersion).
+		WithVolumePtr(pvc.Spec.VolumePtr).
+		WithStorageClassName(pvc.Spec.StorageClassName)
+	for _, ann := range controllerAnnotations {
+		if value, found := pvc.Annotations[ann]; found {
+			config = config.WithAnnotation(ann, value)
+		}
+	}
+	if hasFinalizer(pvc, finalizerPVCProtection) {
+		config = config.WithFinalizer(finalizerPVCProtection)
+	}
+	return config
+}
+
+// commitPatch returns a JSON merge patch from old (the cached object) to
+// changed, or nil if nothing changed.  The patch carries resourceVersion,
+// which makes the API server check it like an update would (see
+// commitFailed).  old comes from the lister, which hands out copies, so it
+// is the object as cached, without the changes of the sync.
+func commitPatch(old, changed Object, resourceVersion string) ([]byte, error) {
+	patch, err := CreateMergePatch(old, changed)
+	if err != nil {
+		return nil, err
+	}
+	if isEmptyPatch(patch) {
+		return nil, nil
+	}
+	return addResourceVersionToPatch(patch, resourceVersion)
+}
+
+// isEmptyPatch returns true if the JSON merge patch changes nothing.
+func isEmptyPatch(patch []byte) bool {
+	var fields map[string]any
+	return json.Unmarshal(patch, &fields) == nil && len(fields) == 0
+}
+
+// addResourceVersionToPatch adds metadata.resourceVersion to a JSON merge
+// patch.
+func addResourceVersionToPatch(patch []byte, resourceVersion string) ([]byte, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, err
+	}
+	metadata, _ := fields["metadata"].(map[string]any)
+	if metadata == nil {
+		metadata = map[string]any{}
+		fields["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = resourceVersion
+	return json.Marshal(fields)
+}
+
+// This annotation applies to PVCs.  It is written before the controller calls
+// a provisioner plugin for the claim, and holds the idempotency token of the
+// operation.  If it is present when provisioning starts, an earlier attempt
+// may have created a storage asset already (e.g. the controller crashed
+// before creating the PV), and the plugin is asked for it first.
+const annProvisioningToken = "volume.alpha.kubernetes.io/provisioning-token"
+
+// This annotation applies to PVCs.  Claims in the same namespace with the
+// same value form a group that is provisioned atomically: either volumes
+// for all of them are created, or none is (e.g. data + log volumes of a
+// database that must be on the same backend).  The number of claims in the
+// group is given by annClaimGroupSize.
+const annClaimGroup = "volume.alpha.kubernetes.io/claim-group"
+const annClaimGroupSize = "volume.alpha.kubernetes.io/claim-group-size"
+
+// This annotation applies to PVs.  Where deletion of Released volumes needs
+// approval (see requiresDeleteApproval), the Delete reclaim policy is only
+// executed once this annotation has been added, manually or by an external
+// approver service.
+const annDeleteApproved = "pv.kubernetes.io/delete-approved"
+
 // This must be async-safe, idempotent, and crash/restart safe, since it
 // happens in a loop as well as on-demand.
-func SyncPVC(pvc *PVClaim) {
+func SyncPVC(pvc *PVClaim) syncResult {
+	var pv *PV
+	if pvc.Spec.StorageClassName == "" && hasAnnotation(pvc, annClass) {
+		// Migrate the legacy annotation into the field.  The annotation is
+		// left in place for old clients.
+		pvc.Spec.StorageClassName = pvc.Annotations[annClass]
+		if err := CommitPVC(pvc); err != nil {
+			// Retry later; getClaimClass reads the annotation meanwhile.
+			return commitFailed(err)
+		}
+	}
+	if pvc.DeletionTimestamp != nil {
+		// The user deleted the claim.  It stays (and so does its PV, Bound)
+		// until no pod uses it; the pod watch syncs it again when the last
+		// one goes away.
+		if isClaimInUse(pvc) {
+			return done
+		}
+		err := updatePVCWithRetry(pvc, func(pvc *PVClaim) error {
+			removeFinalizer(pvc, finalizerPVCProtection)
+			return nil
+		})
+		if err != nil {
+			return commitFailed(err)
+		}
+		return done
+	} else if !hasFinalizer(pvc, finalizerPVCProtection) {
+		addFinalizer(pvc, finalizerPVCProtection)
+		if err := CommitPVC(pvc); err != nil {
+			return commitFailed(err)
+		}
+	}
 	if !hasAnnotation(pvc, annWasEverBound) {
 		// This is a new PVC that has not completed binding
 		// OBSERVATION: pvc is "Pending"
@@ -52,136 +531,251 @@ func SyncPVC(pvc *PVClaim) {
 			if pv == nil {
 				// No PV could be found
 				// OBSERVATION: pvc is "Pending", will retry
-				if hasAnnotation(pvc, annClass) {
-					plugin := findProvisionerPluginForPV(pv) // Need to flesh this out
+				if getClaimClass(pvc) != "" {
+					if err := checkClassSizeLimits(pvc); err != nil {
+						// The claim can never be provisioned in this class;
+						// don't bother the plugin.  The event is all the user
+						// gets.
+						recordEvent(pvc, reasonClaimSizeOutOfRange, err)
+						return done
+					}
+					if isProvisioningDisabled(pvc) {
+						// Static binding still works; the claim waits for a
+						// matching PV.
+						recordEvent(pvc, reasonProvisioningDisabled, getClaimClass(pvc))
+						return requeueAfter(retryAfterUserError)
+					}
+					plugin := findProvisionerPluginForPV(pvc)
 					if plugin != nil {
-						//FIXME: left off here
 						// No match was found and provisioning was requested.
-						//
-						// maintain a map with the current provisioner goroutines that are running
-						// if the key is already present in the map, return
-						//
-						// launch the goroutine that:
-						// 1. calls plugin.Provision to make the storage asset
-						// 2. gets back a PV object (partially filled)
-						// 3. create the PV API object, with claimRef -> pvc
-						// 4. deletes itself from the map when it's done
-						// return
-						//
-						// This PV API object must:
-						// - have annDynamicallyProvisioned annotation.
-						// - be fully bound to the claim that created it (incl.
-						//   PV.Spec.ClaimPtr.UID) to delete it when the claim
-						//   is deleted.
+						// If a provisioner for this claim is already running,
+						// this is a NOP.
+						if recordResolvedClass(pvc) {
+							if err := CommitPVCStatus(pvc); err != nil {
+								return commitFailed(err)
+							}
+						}
+						if err := checkProvisioningQuota(pvc); err != nil {
+							// OBSERVATION: pvc is "Pending", will retry when
+							// the quota is raised or other volumes go away
+							oldStatus := pvc.Status.DeepCopy()
+							pvc.Status.SetCondition("ProvisioningQuotaExceeded", "True", message(reasonProvisioningQuotaExceeded, pvc.Namespace, err))
+							if !pvcStatusEqual(oldStatus, pvc.Status) {
+								if err := CommitPVCStatus(pvc); err != nil {
+									return commitFailed(err)
+								}
+							}
+							return requeueAfter(retryAfterUserError)
+						}
+						if condition := pvc.Status.GetCondition("ProvisioningQuotaExceeded"); condition != nil && condition.Status == "True" {
+							// The quota was raised or other volumes went
+							// away; don't leave a stale condition behind.
+							pvc.Status.SetCondition("ProvisioningQuotaExceeded", "False", message(reasonProvisioningQuotaAvailable, pvc.Namespace))
+							if err := CommitPVCStatus(pvc); err != nil {
+								return commitFailed(err)
+							}
+						}
+						log.V(2).Info("provisioning volume", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "plugin", plugin.Name(), "class", getClaimClass(pvc))
+						if hasAnnotation(pvc, annClaimGroup) {
+							// All claims of the group are provisioned
+							// together, or none is.
+							provisionClaimGroup(pvc, plugin)
+						} else if _, ok := plugin.(BatchProvisioner); ok {
+							// Take identical pending claims along.
+							provisionBatch(pvc, plugin)
+						} else {
+							provisionClaim(pvc, plugin)
+						}
+						// OBSERVATION: pvc is "Pending", will retry and bind
+						// to the new PV
+					} else if class := api.GetClass(getClaimClass(pvc)); class != nil && class.Provisioner != "" {
+						// The class is provisioned out-of-tree.  Tell the
+						// external provisioner and stop; it creates the PV
+						// with ClaimPtr (incl. UID) pointing to this claim,
+						// and FindAcceptablePV returns that PV as pre-bound
+						// in a later call to this method.
+						// OBSERVATION: pvc is "Pending", will retry
+						if pvc.Annotations[annStorageProvisioner] != class.Provisioner {
+							setAnnotationValue(pvc, annStorageProvisioner, class.Provisioner)
+							if err := CommitPVC(pvc); err != nil {
+								// Retry later.
+								return commitFailed(err)
+							}
+							recordEvent(pvc, reasonExternalProvisioning, class.Provisioner)
+						}
 					} else {
 						// make an event calling out that no provisioner was configured
 						// return, try later?
 					}
 				}
-				return
+				return requeueAfter(retryWhileProvisioning)
 			} else /* pv != nil */ {
 				// Found a PV for this claim
 				// OBSERVATION: pvc is "Pending", pv is "Available"
+				if err := runBindMutators(pv, pvc); err != nil {
+					// Retry later; the mutator may be fixed.
+					recordEvent(pvc, reasonBindMutatorFailed, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				if err := validateMountOptions(pv); err != nil {
+					// Only a PV pre-bound to the claim gets here, see
+					// findAcceptablePV.  The kubelet would fail to mount
+					// it; don't bind it.  Retry later, the admin may fix
+					// the PV.
+					recordEvent(pvc, reasonInvalidMountOptions, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				// syncKey locked the claim and the PV it points to, not
+				// this one.  Taking a second lock while holding one could
+				// deadlock, so only try.
+				unlockPV, locked := objectLocks.TryLock("pv/" + pv.Name)
+				if !locked {
+					// Being synced (or bound to another claim) right now.
+					return requeueAfter(retryAfterConflict)
+				}
+				defer unlockPV()
 				if pv.Spec.ClaimPtr == nil {
-					pv.Spec.ClaimPtr = pvc
-					pv.Spec.ClaimPtr.UID = pvc.UID
+					pv.Spec.ClaimPtr = claimReference(pvc)
 					setAnnotation(pv, annBoundByController)
 				}
 				if err := CommitPV(pv); err != nil {
 					// Nothing was saved; we will fall back into the same
 					// condition in the next call to this method
-					return
+					return commitFailed(err)
 				}
 				pv.Status.Phase = Bound
-				if err := CommitPVStatus(pv.Status); err != nil {
+				if err := CommitPVStatus(pv); err != nil {
 					// Status was not saved. syncPV will set the status
-					return
+					return commitFailed(err)
 				}
 				// OBSERVATION: pvc is "Pending", pv is "Bound"
-				pvc.Spec.VolumePtr = pv
+				pvc.Spec.VolumePtr = volumeReference(pv)
 				setAnnotation(pvc, annWasEverBound)
 				setAnnotation(pvc, annBoundByController)
 				if err := CommitPVC(pvc); err != nil {
 					// Commit failed; we will handle this partially committed
 					// state in the next call to syncPVC
-					return
+					return commitFailed(err)
 				}
+				recordResolvedClass(pvc)
 				pvc.Status.Phase = Bound
-				if err := CommitPVCStatus(pvc.Status); err != nil {
+				if err := CommitPVCStatus(pvc); err != nil {
 					// PVC status was not saved. syncPVC will set the status
-					return
+					return commitFailed(err)
 				}
 				// OBSERVATION: pvc is "Bound", pv is "Bound"
+				log.V(2).Info("bound claim", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "volume", pv.Name, "branch", "matched available volume")
+				if hasAnnotation(pv, annDynamicallyProvisioned) {
+					// End-to-end provisioning latency, as the user sees it.
+					metrics.Histogram("pv_controller_provisioning_duration_seconds", "class", getClaimClass(pvc)).Observe(clock.Since(pvc.CreationTimestamp).Seconds())
+				}
 			}
 		} else /* pvc.Spec.VolumePtr != nil */ {
 			// User asked for a specific PV.
-			pv = GetPV(pvc.Spec.VolumePtr)
+			if !hasAnnotation(pvc, annBoundByController) && isStrictBinding(pvc) {
+				// The admin wants all binding to go through the controller;
+				// refuse the user's pre-bind.
+				// OBSERVATION: pvc is "Pending"
+				recordEvent(pvc, reasonPreBindRefused)
+				return requeueAfter(retryAfterUserError)
+			}
+			pv = pvLister.Get(pvc.Spec.VolumePtr.Name)
 			if pv == nil {
-				// User asked for a PV that does not exist
+				// User asked for a PV that does not exist (or that is not
+				// in the cache yet)
 				// OBSERVATION: pvc is "Pending"
 				// Retry later.
-				return
+				return requeueAfter(retryAfterUserError)
+			} else if !isClaimNamespaceAllowed(pv, pvc) {
+				// User asked for a PV that is restricted to other namespaces.
+				// OBSERVATION: pvc is "Pending"
+				// Retry later, the admin may change the restriction.
+				recordEvent(pvc, reasonNamespaceNotAllowed, pvc.Namespace)
+				return requeueAfter(retryAfterUserError)
 			} else if pv.Spec.ClaimPtr == nil {
 				// User asked for a PV that is not claimed
 				// OBSERVATION: pvc is "Pending", pv is "Available"
-				pv.Spec.ClaimPtr = pvc
-				pv.Spec.ClaimPtr.UID = pvc.UID
+				if err := runBindMutators(pv, pvc); err != nil {
+					// Retry later; the mutator may be fixed.
+					recordEvent(pvc, reasonBindMutatorFailed, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				if err := validateMountOptions(pv); err != nil {
+					// Retry later, the admin may fix the PV.
+					recordEvent(pvc, reasonInvalidMountOptions, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				pv.Spec.ClaimPtr = claimReference(pvc)
 				setAnnotation(pv, annBoundByController)
 				if err := CommitPV(pv); err != nil {
 					// Retry later.
-					return
+					return commitFailed(err)
 				}
 				pv.Status.Phase = Bound
-				if err := CommitPVStatus(pv.Status); err != nil {
+				if err := CommitPVStatus(pv); err != nil {
 					// Status was not saved. syncPV will set the status
-					return
+					return commitFailed(err)
 				}
 				// OBSERVATION: pvc is "Pending", pv is "Bound"
 				setAnnotation(pvc, annWasEverBound)
 				if err := CommitPVC(pvc); err != nil {
 					// Retry later.
-					return
+					return commitFailed(err)
 				}
+				recordResolvedClass(pvc)
 				pvc.Status.Phase = Bound
-				if err := CommitPVCStatus(pvc.Status); err != nil {
+				if err := CommitPVCStatus(pvc); err != nil {
 					// PVC status was not saved. syncPVC will set the status
-					return
+					return commitFailed(err)
 				}
 				// OBSERVATION: pvc is "Bound", pv is "Bound"
-			} else if pv.Spec.ClaimPtr == pvc {
+				log.V(2).Info("bound claim", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "volume", pv.Name, "branch", "claim pre-bound to available volume")
+			} else if refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) {
 				// User asked for a PV that is claimed by this PVC
 				// OBSERVATION: pvc is "Pending", pv is "Bound"
-				pv.ClaimPtr.UID = pvc.UID
+				if err := runBindMutators(pv, pvc); err != nil {
+					// Retry later; the mutator may be fixed.
+					recordEvent(pvc, reasonBindMutatorFailed, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				if err := validateMountOptions(pv); err != nil {
+					// Retry later, the admin may fix the PV.
+					recordEvent(pvc, reasonInvalidMountOptions, err)
+					return requeueAfter(retryAfterUserError)
+				}
+				pv.Spec.ClaimPtr.UID = pvc.UID
 				if err := CommitPV(pv); err != nil {
 					// Retry later.
-					return
+					return commitFailed(err)
 				}
 				pv.Status.Phase = Bound
-				if err := CommitPVStatus(pv.Status); err != nil {
+				if err := CommitPVStatus(pv); err != nil {
 					// Status was not saved. syncPV will set the status
-					return
+					return commitFailed(err)
 				}
 				setAnnotation(pvc, annWasEverBound)
 				if err := CommitPVC(pvc); err != nil {
 					// Retry later.
-					return
+					return commitFailed(err)
 				}
+				recordResolvedClass(pvc)
 				pvc.Status.Phase = Bound
-				if err := CommitPVCStatus(pvc.Status); err != nil {
+				if err := CommitPVCStatus(pvc); err != nil {
 					// PVC status was not saved. syncPVC will set the status
-					return
+					return commitFailed(err)
 				}
 				// OBSERVATION: pvc is "Bound", pv is "Bound"
+				log.V(2).Info("bound claim", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "volume", pv.Name, "branch", "volume pre-bound to claim")
 			} else {
 				// User asked for a PV that is claimed by someone else
 				// OBSERVATION: pvc is "Pending", pv is "Bound"
 				if !hasAnnotation(pvc, annBoundByController) {
 					// User asked for a specific PV, retry later
-					return
+					return requeueAfter(retryAfterUserError)
 				} else {
 					// This should never happen because we set the PVC->PV
 					// link with the "established" annotation.
-					LogError("IMPOSSIBURU!")
+					log.Error(nil, "IMPOSSIBURU! claim bound by controller to a volume bound elsewhere", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "volume", pv.Name)
 				}
 			}
 		}
@@ -190,105 +784,151 @@ func SyncPVC(pvc *PVClaim) {
 		// OBSERVATION: pvc is not "Pending"
 		if pvc.Spec.VolumePtr == nil {
 			// Claim was bound before but not any more.
+			log.V(2).Info("claim lost", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "branch", "volume pointer cleared")
+			oldStatus := pvc.Status.DeepCopy()
 			pvc.Status.Phase = Lost
-			if err := CommitPVCStatus(pvc.Status); err != nil {
-				// PVC status was not saved, but we will fall into the same
-				// condition in a later iteration.
-				return
+			if !pvcStatusEqual(oldStatus, pvc.Status) {
+				if err := CommitPVCStatus(pvc); err != nil {
+					// PVC status was not saved, but we will fall into the same
+					// condition in a later iteration.
+					return commitFailed(err)
+				}
 			}
+			return done
+		}
+		pv = pvLister.Get(pvc.Spec.VolumePtr.Name)
+		if pv == nil {
+			// The cache may be behind; marking a claim Lost is too drastic
+			// to do on its word.
+			pv = api.GetPVFromServer(pvc.Spec.VolumePtr.Name)
 		}
-		pv = GetPV(pvc.Spec.VolumePtr)
 		if pv == nil {
 			// Claim is bound to a non-existing volume.
+			log.V(2).Info("claim lost", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "branch", "volume does not exist")
+			oldStatus := pvc.Status.DeepCopy()
 			pvc.Status.Phase = Lost
-			if err := CommitPVCStatus(pvc.Status); err != nil {
-				// PVC status was not saved, but we will fall into the same
-				// condition in a later iteration.
-				return
+			if !pvcStatusEqual(oldStatus, pvc.Status) {
+				if err := CommitPVCStatus(pvc); err != nil {
+					// PVC status was not saved, but we will fall into the same
+					// condition in a later iteration.
+					return commitFailed(err)
+				}
 			}
 		} else if pv.Spec.ClaimPtr == nil {
 			// Claim is bound but volume has come unbound.
 			// This is really a race with other PVCs; it may not work.
-			Event("PVClaim is bound to PV, but not vice-versa: attempting to fix it")
-			pv.Spec.ClaimPtr = pvc
-			pv.Spec.ClaimPtr.UID = pvc.UID
+			recordEvent(pvc, reasonFixingBinding)
+			pv.Spec.ClaimPtr = claimReference(pvc)
 			if err := CommitPV(pv); err != nil {
 				// Retry later.
-				return
+				return commitFailed(err)
 			}
 			pv.Status.Phase = Bound
-			if err := CommitPVStatus(pv.Status); err != nil {
+			if err := CommitPVStatus(pv); err != nil {
 				// Status was not saved. syncPV will set the status
-				return
+				return commitFailed(err)
 			}
+		} else if pv.Spec.ClaimPtr.UID == pvc.UID && pv.Status.Phase == Failed && replacesFailedVolumes(pvc) {
+			// Claim is bound to a volume that has failed, and the class
+			// asked us to replace failed volumes instead of leaving the
+			// claim wedged.
+			// OBSERVATION: pvc is "Bound", pv is "Failed"
+			recordEvent(pvc, reasonReplacingFailedVolume)
+			replaceFailedVolume(pvc, pv)
+			return requeueAfter(retryWhileProvisioning)
 		} else if pv.Spec.ClaimPtr.UID == pvc.UID {
 			// All is well
 			// NOTE: syncPV can handle this so it can be left out.
-			if pv.Status.Phase != Bound {
-				pv.Status.Phase = Bound
-				if err := CommitPVStatus(pv.Status); err != nil {
+			oldStatus := pv.Status.DeepCopy()
+			pv.Status.Phase = Bound
+			if !pvStatusEqual(oldStatus, pv.Status) {
+				if err := CommitPVStatus(pv); err != nil {
 					// Status was not saved. syncPV will set the status
-					return
+					return commitFailed(err)
 				}
 			}
-			if pvc.Status.Phase != Bound {
-				pvc.Status.Phase = Bound
-				if err := CommitPVCStatus(pvc.Status); err != nil {
+			oldClaimStatus := pvc.Status.DeepCopy()
+			recordResolvedClass(pvc)
+			pvc.Status.Phase = Bound
+			if !pvcStatusEqual(oldClaimStatus, pvc.Status) {
+				if err := CommitPVCStatus(pvc); err != nil {
 					// PVC status was not saved, but we will fall into the same
 					// condition in a later iteration.
-					return
+					return commitFailed(err)
 				}
 			}
 		} else {
 			// Claim is bound but volume has a different claimant.
 			// Set the claim phase to 'Lost', which is a terminal
 			// phase.
+			log.V(2).Info("claim lost", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "branch", "volume bound to another claim")
+			oldStatus := pvc.Status.DeepCopy()
 			pvc.Status.Phase = Lost
-			if err := CommitPVCStatus(pvc.Status); err != nil {
-				// If this fails, we will fall back into the enclosing block
-				// during the next call to syncPVC; retry later.
-				return
+			if !pvcStatusEqual(oldStatus, pvc.Status) {
+				if err := CommitPVCStatus(pvc); err != nil {
+					// If this fails, we will fall back into the enclosing block
+					// during the next call to syncPVC; retry later.
+					return commitFailed(err)
+				}
 			}
 		}
 	}
+	return done
 }
 
-// FIXME: consider a rogue master
+// FIXME: consider a rogue master (leader election keeps a second instance
+//        out of the loops, but one that just lost its lease may still have
+//        a write in flight)
 // FIXME: extract status setting from spec setting, and convince ourselves we
 //        always set status correctly.
 
 // This must be async-safe, idempotent, and crash/restart safe, since it
 // happens in a loop as well as on-demand.
-func syncPV(pv *PV) {
+func syncPV(pv *PV) syncResult {
+	var pvc *PVClaim
 	deleted, err := upgradePVFrom12(pv)
 	if err != nil {
 		// This is a placeholder PV and we could not delete it - try again next
 		// time.
-		return
+		return apiFailed()
 	}
 	if deleted {
 		// Placeholder PV was deleted, there is nothing else to do.
-		return
+		return done
 	}
 
 	if pv.Spec.ClaimPtr == nil {
-		// Volume is unused
+		// Volume is unused (or was just recycled)
+		if err := removePVProtection(pv); err != nil {
+			return commitFailed(err)
+		}
+		oldStatus := pv.Status.DeepCopy()
 		pv.Status.Phase = Available
-		if err := CommitPVStatus(pv.Status); err != nil {
-			// Nothing was saved; we will fall back into the same
-			// condition in the next call to this method
-			return
+		if !pvStatusEqual(oldStatus, pv.Status) {
+			if err := CommitPVStatus(pv); err != nil {
+				// Nothing was saved; we will fall back into the same
+				// condition in the next call to this method
+				return commitFailed(err)
+			}
 		}
-		return
+		return done
 	} else /* pv.Spec.ClaimPtr != nil */ {
 		// Volume is bound to a claim.
-		if pv.Spec.ClaimPtr.UID == 0 {
+		if pv.Spec.ClaimPtr.UID == "" {
 			// The PV is reserved for a PVC; that PVC has not yet been
 			// bound to this PV; the PVC sync will handle it.
-			return
+			if pv.Status.Phase == Released {
+				// Recycled, but makeRecycledPVAvailable did not get to
+				// the status.
+				pv.Status.Phase = Available
+				if err := CommitPVStatus(pv); err != nil {
+					return commitFailed(err)
+				}
+			}
+			return done
 		}
 		// Get the PVC by _name_
-		pvc = GetPVC(pv.Spec.ClaimPtr)
+		pvc = pvcLister.Get(pv.Spec.ClaimPtr.Namespace, pv.Spec.ClaimPtr.Name)
 		if pvc != nil && pvc.UID != pv.Spec.ClaimPtr.UID {
 			// The claim that the PV was pointing to was deleted, and
 			// another with the same name created.
@@ -300,52 +940,80 @@ func syncPV(pv *PV) {
 			// NOTE: releasePV may either release the PV back into the pool or
 			// recycle it or do nothing (retain)
 
+			if pv.Status.Phase == Failed {
+				// Reclaim gave up (see deletionFailed); only the admin
+				// can move the PV on from here.  Do not stand in the way
+				// if they delete it.
+				if pv.DeletionTimestamp != nil {
+					if err := removePVProtection(pv); err != nil {
+						return commitFailed(err)
+					}
+				}
+				return done
+			}
+
 			// HOWTO RELEASE A PV
-			pv.Status.Phase = Released
-			if err := CommitPVStatus(pv); err != nil {
-				// Status was not saved; we will fall back into the same
-				// condition in the next call to this method
-				return
+			justReleased := pv.Status.Phase != Released
+			if justReleased {
+				log.V(2).Info("releasing volume", "volume", pv.Name, "volumeUID", pv.UID, "claim", pv.Spec.ClaimPtr.Namespace+"/"+pv.Spec.ClaimPtr.Name, "reclaimPolicy", pv.Spec.ReclaimPolicy)
+				pv.Status.Phase = Released
+				if err := CommitPVStatus(pv); err != nil {
+					// Status was not saved; we will fall back into the same
+					// condition in the next call to this method
+					return commitFailed(err)
+				}
 			}
+			// The reclaim policy is read on every pass, not only when the
+			// PV is released: the admin may flip a Released PV from Retain
+			// to Delete (or Recycle) to get rid of it, and the PV MODIFY
+			// event brings us back here.  Every branch is idempotent.
 			if pv.Spec.ReclaimPolicy == "Retain" {
-				return
+				// Nothing to reclaim; the PV may be deleted now.  (If the
+				// policy was Delete before, a failed deletion is not
+				// retried any more.)
+				deletionBackoff.Forget(pv.UID)
+				if justReleased {
+					// Before the finalizer: a retry does not get here
+					// with justReleased.
+					recordEvent(pv, reasonVolumeRetained)
+					observeReclaim(pv, "", "retained", time.Time{})
+				}
+				if err := removePVProtection(pv); err != nil {
+					return commitFailed(err)
+				}
+				return done
 			} else if pv.Spec.ReclaimPolicy == "Delete" {
-				plugin := findDeleterPluginForPV(pv)
-				if plugin != nil {
-					// maintain a map with the current deleter goroutines that are running
-					// if the key is already present in the map, return
-					//
-					// launch the goroutine that:
-					// 1. deletes the storage asset
-					// 2. deletes the PV API object
-					// 3. deletes itself from the map when it's done
-				} else {
-					// make an event calling out that no deleter was configured
-					// mark the PV as failed
-					// NB: external provisioners/deleters are currently not
-					// considered.
+				if requiresDeleteApproval(pv) && !hasAnnotation(pv, annDeleteApproved) {
+					if proceed, result := waitForDeleteApproval(pv); !proceed {
+						return result
+					}
 				}
+				return deleteVolume(pv)
+			} else if pv.Spec.ReclaimPolicy == "Archive" {
+				return archiveVolume(pv)
 			} else if pv.Spec.ReclaimPolicy == "Recycle" {
-				plugin := findRecyclerPluginForPV(pv)
-				if plugin != nil {
-					// maintain a map of running scrubber-pod-monitoring
-					// goroutines, guarded by mutex
-					//
-					// launch a goroutine that:
-					// 0. verify the PV object still needs to be recycled or return
-					// 1. launches a scrubber pod; the pod's name is deterministically created based on PV uid
-					// 2. if the pod is rejected for dup, adopt the existing pod
-					// 2.5. if the pod is rejected for any other reason, retry later
-					// 3. else (the create succeeds), ok
-					// 4. wait for pod completion
-					// 5. marks the PV API object as available
-					// 5.5. clear ClaimRef.UID
-					// 5.6. if boundByController, clear ClaimRef & boundByController annotation
-					// 6. deletes itself from the map when it's done
-				} else {
-					// make an event calling out that no recycler was configured
-					// mark the PV as failed
+				if recycleAsDelete {
+					// Approval and dry run apply as for Delete.
+					if justReleased {
+						recordEvent(pv, reasonRecycleAsDelete)
+					}
+					if requiresDeleteApproval(pv) && !hasAnnotation(pv, annDeleteApproved) {
+						if proceed, result := waitForDeleteApproval(pv); !proceed {
+							return result
+						}
+					}
+					return deleteVolume(pv)
+				}
+				if !recyclerCompiledIn || recyclingDisabled {
+					// Scrubber pods must never be launched here.
+					recordEvent(pv, reasonRecyclingUnsupported)
+					pv.Status.Phase = Failed
+					if err := CommitPVStatus(pv); err != nil {
+						return commitFailed(err)
+					}
+					return done
 				}
+				return recycleVolume(pv)
 			}
 		} else if pvc.Spec.VolumePtr == nil {
 			// This block collapses into a NOP; we're leaving this here for
@@ -355,15 +1023,26 @@ func syncPV(pv *PV) {
 			} else {
 				// Dangling PV; try to re-establish the link in the PVC sync
 			}
-			return
-		} else if pvc.Spec.VolumePtr == pv {
-			// Volume is bound to a claim properly.
-			if pv.Status.Phase != Bound {
-				pv.Status.Phase = Bound
-				if err := CommitPVStatus(pv.Status); err != nil {
+			return done
+		} else if refersTo(pvc.Spec.VolumePtr, &pv.ObjectMeta) {
+			// Volume is bound to a claim properly.  (The claim may be
+			// deleted already but still in use by a pod; the PV is
+			// released only when the claim object is really gone.)
+			if !hasFinalizer(pv, finalizerPVProtection) {
+				// Deleting the PV now would pull it out from under the
+				// claim; make the API server wait for us.
+				addFinalizer(pv, finalizerPVProtection)
+				if err := CommitPV(pv); err != nil {
+					return commitFailed(err)
+				}
+			}
+			oldStatus := pv.Status.DeepCopy()
+			pv.Status.Phase = Bound
+			if !pvStatusEqual(oldStatus, pv.Status) {
+				if err := CommitPVStatus(pv); err != nil {
 					// Nothing was saved; we will fall back into the same
 					// condition in the next call to this method
-					return
+					return commitFailed(err)
 				}
 			} else {
 				// Volume is properly bound and its status is correct.
@@ -373,23 +1052,19 @@ func syncPV(pv *PV) {
 			// Volume is bound to a claim, but the claim is bound elsewhere
 			if hasAnnotation(pv, annDynamicallyProvisioned) {
 				// This volume was dynamically provisioned for this claim. The
-				// claim got bound elsewhere, and thus this volume is not
-				// needed. Delete it (copied from above).
-				plugin := findDeleterPluginForPV(pv)
-				if plugin != nil {
-					// maintain a map with the current deleter goroutines that are running
-					// if the key is already present in the map, return
-					//
-					// launch the goroutine that:
-					// 1. deletes the storage asset
-					// 2. deletes the PV API object
-					// 3. deletes itself from the map when it's done
-				} else {
-					// make an event calling out that no deleter was configured
-					// mark the PV as failed
-					// NB: external provisioners/deleters are currently not
-					// considered.
+				// claim got bound elsewhere (we lost a race with another
+				// provisioner or a new static PV), and thus this volume is
+				// not needed and was never used.  Release it first, so
+				// that it never looks Available to anybody, then delete it.
+				if pv.Status.Phase != Released {
+					pv.Status.Phase = Released
+					if err := CommitPVStatus(pv); err != nil {
+						// Status was not saved; we will fall back into the
+						// same condition in the next call to this method
+						return commitFailed(err)
+					}
 				}
+				return deleteVolume(pv)
 			} else {
 				// This volume is not dynamically provisioned
 				if hasAnnotation(pv, annBoundByController) {
@@ -400,12 +1075,15 @@ func syncPV(pv *PV) {
 					pv.Spec.ClaimPtr = nil
 					if err := CommitPV(pv); err != nil {
 						// Retry later.
-						return
+						return commitFailed(err)
 					}
+					// Lost races tell us how contended the matcher is; count
+					// them by the class of the claim.
+					metrics.Counter("pv_controller_lost_bind_races_total", "class", getClaimClass(pvc)).Inc()
 					pv.Status.Phase = Available
-					if err := CommitPVStatus(pv.Status); err != nil {
+					if err := CommitPVStatus(pv); err != nil {
 						// Status was not saved. syncPV will set the status
-						return
+						return commitFailed(err)
 					}
 				} else {
 					// The PV was created with this pointer, but the claim is
@@ -413,97 +1091,3518 @@ func syncPV(pv *PV) {
 					// be 'Available', in the sense that it is not bound, even
 					// though the set of PVs it can bind to is restricted to a
 					// specific PVC.
+					oldStatus := pv.Status.DeepCopy()
 					pv.Status.Phase = Available
-					if err := CommitPVStatus(pv.Status); err != nil {
-						// Status was not saved. syncPV will set the status
-						return
+					if !pvStatusEqual(oldStatus, pv.Status) {
+						if err := CommitPVStatus(pv); err != nil {
+							// Status was not saved. syncPV will set the status
+							return commitFailed(err)
+						}
 					}
 				}
 			}
 		}
 	}
+	return done
 }
 
-func initController() {
-	// Resync everything because we trust nobody, least of all the people who
-	// work on this code.
-	Periodically("15s", func() {
-		syncAllPVCs()
-		syncAllPVs()
+// Content types the controller asks for when listing and watching PVs and
+// PVCs, in order of preference.  JSON list/relist of 100k PVs is slow and
+// memory-heavy; protobuf is much more compact.  The API server picks the
+// first type it supports, so older servers still get JSON.
+var apiContentTypes = []string{
+	"application/vnd.kubernetes.protobuf",
+	"application/json",
+}
+
+// Client-side rate limit of all requests to the API server: apiQPS on
+// average, bursts of up to apiBurst.  A node drain or a namespace deletion
+// turns into thousands of syncs within seconds, each with a few Commit and
+// Get calls; the limit keeps the controller from flooding the API server
+// then, at the price of those syncs queueing up here.  Watches are not
+// limited.  Set from command line flags.
+var apiQPS float32 = 20
+var apiBurst = 30
+
+// newAPIClient returns the client used by the informers, GetPVFromServer
+// and the Commit* functions.  Only list/watch negotiate the content type;
+// writes are small and stay JSON.
+func newAPIClient() Client {
+	return NewClient(ClientConfig{
+		AcceptContentTypes: apiContentTypes,
+		ContentType:        "application/json",
+		QPS:                apiQPS,
+		Burst:              apiBurst,
+		// Writes are validated by the API server but not persisted.
+		DryRun:        observeOnly,
+		OnDryRunWrite: logWouldBeWrite,
+		OnServerTime:  observeServerTime,
 	})
-	Watch(PVClaims, func(pvc *PVClaim, ev Event) {
-		switch ev {
-		case MODIFY, CREATE:
-			// If a PVC was modified or created, we only need to sync that one.
-			syncPVC(pvc)
-		case DELETE:
-			// If a PVC was deleted, we need to touch the PV it was bound to
-			// (if it was bound at all)
-			syncPVC(pvc)
-			if pvc.Spec.VolumePtr != nil {
-				syncPV(pvc.Spec.VolumePtr)
-			}
+}
+
+// If set, the controller runs every sync and decides as usual, but changes
+// nothing: it is safe to try against a live cluster, next to the real
+// controller.  Writes to the API server (commits, PV creation and
+// deletion) are sent as server-side dry runs, so they are still validated,
+// and logged.  Events are only logged, see recordEvent.  Provisioners,
+// deleters and recyclers are not started at all (see
+// operationRegistry.Run), and orphaned assets are not deleted.  The
+// instance takes no part in leader election and ignores the handoff
+// record.  Set from a command line flag.
+//
+// OBSERVATION: nothing is persisted, so the cache never moves and every
+// sync pass logs the same actions again.  A sync that would take several
+// steps over several passes (bind the PV, then the claim) only ever shows
+// the ones it takes in its first pass.
+var observeOnly = false
+
+// logWouldBeWrite is called by the client for each dry-run write.
+func logWouldBeWrite(verb, kind, namespace, name string) {
+	log.Info("observe-only: would write", "verb", verb, "kind", kind, "namespace", namespace, "name", name)
+}
+
+// ControllerOptions lets embedders replace parts of the controller.  The
+// zero value gives the defaults.
+type ControllerOptions struct {
+	// Defaults to Prometheus.
+	Metrics Metrics
+	// Defaults to events in the API server.
+	Recorder EventRecorder
+	// Defaults to "pvc-<claim UID>".
+	PVNamer PVNamer
+	// Number of sync workers shared by the binder and the reclaimer.
+	Workers int
+	// Minimum share of the workers per subsystem ("binder", "reclaimer"),
+	// see subsystem.weight.
+	Weights map[string]int
+	// Defaults to the system clock.  Tests pass a fake one to step through
+	// resyncs, backoffs and timeouts without sleeping.
+	Clock Clock
+}
+
+// initController runs the controller until ctx is cancelled (by the embedder,
+// on SIGTERM), then drains it (see drainController) and returns.
+func initController(ctx context.Context, opts ControllerOptions) {
+	if opts.Metrics != nil {
+		metrics = opts.Metrics
+	}
+	if opts.Clock != nil {
+		clock = opts.Clock
+	}
+	if opts.Recorder != nil {
+		recorder = opts.Recorder
+	}
+	if opts.PVNamer != nil {
+		pvNamer = opts.PVNamer
+	}
+	if opts.Workers > 0 {
+		syncWorkers = opts.Workers
+	}
+	for _, s := range subsystems {
+		if weight, found := opts.Weights[s.name]; found && weight > 0 {
+			s.weight = weight
 		}
-	})
-	Watch(PVs, func(pv *PV, ev Event) {
-		switch ev {
-		case MODIFY:
-			// If a PV was modified, we only need to sync that one.
-			syncPV(pv)
-		case CREATE, DELETE:
-			// If a PV was created or deleted we need to re-evaluate all PVCs.
-			syncPV(pv)
-			syncAllPVCs()
+	}
+
+	if !leaderElection || observeOnly {
+		startController(ctx)
+		<-ctx.Done()
+		drainController()
+		return
+	}
+	// The lease outlives ctx: it is released only after the drain, so that
+	// the next leader does not start while we are still committing.
+	leaseCtx, releaseLease := context.WithCancel(context.Background())
+	var leading atomic.Bool
+	go func() {
+		<-ctx.Done()
+		if leading.Load() {
+			drainController()
 		}
+		releaseLease()
+	}()
+	// Only the leader runs the loops; the others wait for the lease.  Two
+	// instances binding at the same time is exactly the rogue master the
+	// bi-directional pointer has to survive, so don't do it on purpose.
+	RunLeaderElection(leaseCtx, LeaderElectionConfig{
+		// Each shard elects its own leader.
+		Lock:          NewLeaseLock(leaderElectionNamespace, "pv-controller"+shardLeaseSuffix(), Hostname()),
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		// On a planned shutdown, let the next leader take over at once
+		// instead of after LeaseDuration.
+		ReleaseOnCancel: true,
+		OnStartedLeading: func() {
+			if ctx.Err() != nil {
+				return
+			}
+			leading.Store(true)
+			startController(ctx)
+		},
+		OnStoppedLeading: func() {
+			if leaseCtx.Err() != nil {
+				// We released it, drained.
+				return
+			}
+			// The lease is gone and another instance may be leader
+			// already.  Our goroutines cannot all be stopped in time
+			// (a provisioner may be in a cloud call), so stop the process
+			// now: whatever it did not finish, the next leader finds in its
+			// resync.  No handoff record either; it is not ours to write
+			// any more.
+			log.Fatal("lost leader lease, exiting")
+		},
 	})
 }
 
-func syncAllPVCs() {
-	// wait until we have seen an update of both PV and PVC
-	// for each pvc {}
-}
+// If set, only the instance that holds the leader lease runs the sync loops
+// and operations.  Must be set when more than one instance runs.  Set from
+// command line flags.
+var leaderElection = true
+var leaderElectionNamespace = "kube-system"
 
-func syncAllPVs() {
-	// wait until we have seen an update of both PV and PVC
-	// for each pv {}
-}
+// Sharding by storage class, for clusters too large for one instance.  Each
+// shard is a set of instances (with its own leader lease) that handles only
+// the claims and volumes whose storage class matches shardClassSelector, a
+// label selector on StorageClass objects, and ignores everything else.  The
+// admin must make the selectors of the shards disjoint and let exactly one
+// shard set shardDefault to handle objects with no class or with a class
+// that does not exist (yet).  An empty shardName disables sharding.  Set
+// from command line flags.
+var shardName = ""
+var shardClassSelector = ""
+var shardDefault = false
 
-func hasAnnotation(obj Object, ann string) bool {
-	_, found := obj.Annotations[ann]
-	return found
+func shardLeaseSuffix() string {
+	if shardName == "" {
+		return ""
+	}
+	return "-" + shardName
 }
 
-func setAnnotation(obj Object, ann string) {
-	obj.Annotations[ann] = "yes"
+// inShard tells whether objects of the given storage class belong to this
+// instance.  A claim and the volume it binds to have the same class, so
+// both ends of a binding are always in the same shard.
+//
+// OBSERVATION: relabeling a class moves its objects to another shard.  The
+// old shard may be in the middle of an operation (a provisioner, a
+// deleter); the new one does not know about it, and the operation's
+// annotations (annProvisioningToken and such) are what keeps them from
+// doing it twice.
+func inShard(class string) bool {
+	if shardName == "" {
+		return true
+	}
+	c := api.GetClass(class)
+	if c == nil {
+		return shardDefault
+	}
+	return ParseSelector(shardClassSelector).Matches(c.Labels)
 }
 
-func FindAcceptablePV(pvc *PVC) *PV {
-	// This functions looks for a PV that matches the PVC.
-	// If there is a PV that is pre-bound to the PVC, it must return it as the
-	// top priority!
-	// This function must ignore placeholder PVs from Kubernetes 1.2, see
-	// isPlaceholderPV() below! They are pre-bound to the PVC!
-	// Otherwise, the smallest matching volume should be returned.
+func claimInShard(pvc *PVClaim) bool {
+	return inShard(getClaimClass(pvc))
 }
 
-// FIXME: remove in Kubernetes 1.4 (or do we support upgrade 1.2 -> 1.4?)
-func isPlaceholderPV(pv *PV) bool {
-	const annPlaceholderProvisioningRequired = "volume.experimental.kubernetes.io/provisioning-required"
-	const provisioningCompleted = "volume.experimental.kubernetes.io/provisioning-completed"
-	return hasAnnotation(pv, annPlaceholderProvisioningRequired) && pv.Annotations[annPlaceholderProvisioningRequired] != provisioningCompleted
+func volumeInShard(pv *PV) bool {
+	return inShard(pv.Spec.StorageClassName)
 }
 
-// upgradePVFrom12 upgrades a PV from old Kubernetes version.
-// FIXME: remove in Kubernetes 1.4 (or do we support upgrade 1.2 -> 1.4?)
-func upgradePVFrom12(pv *PV) (deleted bool, err error) {
-	// In the old 1.2 version we created placeholder PVs before provisioning.
-	// We should delete those and let the controller provision a new one.
+// Period of the full resync, and the fraction of it by which each period is
+// randomly stretched (0.1: between 15s and 16.5s), so that many
+// controllers do not all resync at the same wall-clock moment.  Zero
+// disables the full resync; for very large clusters that trust the watch
+// (and the requeues of syncResult) to get everything.  Set from command
+// line flags.
+var resyncPeriod = 15 * time.Second
+var resyncJitter = 0.1
 
-	if isPlaceholderPV(pv) {
-		if err := DeletePV(pv); err != nil {
-			return false, err
+// startController starts the informers, workers and periodic jobs, which all
+// stop when ctx is cancelled.  With leader election, it is called once this
+// instance becomes leader.
+func startController(ctx context.Context) {
+	// If the previous leader left us a list of objects it was working on,
+	// look at those first instead of waiting for the full resync.
+	if handoff := ReadHandoffRecord(); handoff != nil && !observeOnly {
+		for _, key := range handoff.InFlightKeys {
+			enqueue(key, 0)
 		}
-		return true, nil
+		ClearHandoffRecord()
 	}
-	return false, nil
+	for i := 0; i < syncWorkers; i++ {
+		syncWorkersDone.Add(1)
+		go runSyncWorker(ctx)
+	}
+	RegisterDebugHandler("/debug/pending-claims", servePendingClaims)
+	RegisterDebugHandler("/debug/state", serveState)
+	OnSignal(SIGUSR1, logState)
+	RegisterReadinessCheck("api-server", checkReady)
+	Periodically(ctx, clock, orphanScanInterval, func() { scanOrphanedAssets(ctx) })
+
+	// Resync everything because we trust nobody, least of all the people who
+	// work on this code.
+	go pvInformer.Run(ctx)
+	go pvcInformer.Run(ctx)
+	if resyncPeriod > 0 {
+		JitterPeriodically(ctx, clock, resyncPeriod, resyncJitter, func() {
+			syncAllPVCs()
+			syncAllPVs()
+			logResyncSummary()
+		})
+	}
+	Periodically(ctx, clock, alertInterval, evaluateAlerts)
+	// Watch handlers only queue keys; the workers do the syncing.  A slow
+	// API call in a sync must not hold up the watch.  Once ctx is
+	// cancelled, nobody takes keys from the queues any more; events are
+	// dropped, the next leader gets them from its resync.
+	pvcInformer.AddEventHandler(func(pvc *PVClaim, ev Event) {
+		if ctx.Err() != nil {
+			return
+		}
+		if isStaleEvent("pvc/"+pvc.Namespace+"/"+pvc.Name, pvc.ResourceVersion, ev) {
+			return
+		}
+		if !claimInShard(pvc) {
+			// Another shard's; but it may have been ours until its class
+			// was relabeled.
+			unboundClaims.Update(pvc, DELETE)
+			return
+		}
+		unboundClaims.Update(pvc, ev)
+		switch ev {
+		case MODIFY, CREATE:
+			// If a PVC was modified or created, we only need to sync that one.
+			enqueue("pvc/"+pvc.Namespace+"/"+pvc.Name, 0)
+		case DELETE:
+			// If a PVC was deleted, we need to touch the PV it was bound to
+			// (if it was bound at all)
+			// Stop provisioning for it; see provisionClaim for what happens
+			// to a volume that gets created anyway.
+			pendingClaims.Remove(pvc)
+			runningProvisioners.Cancel(string(pvc.UID))
+			runningProvisioners.Cancel("replace/" + string(pvc.UID))
+			if hasAnnotation(pvc, annClaimGroup) {
+				runningProvisioners.Cancel(claimGroupKey(pvc))
+			}
+			provisioningBackoff.Forget(pvc.UID)
+			forgetSyncFailures("pvc/" + pvc.Namespace + "/" + pvc.Name)
+			if pvc.Spec.VolumePtr != nil {
+				enqueue("pv/"+pvc.Spec.VolumePtr.Name, 0)
+			}
+		}
+	})
+	Watch(ctx, Pods, func(pod *Pod, ev Event) {
+		// Only deleted claims care about their pods; see SyncPVC.
+		for _, pvc := range claimPods.Update(pod, ev) {
+			if pvc.DeletionTimestamp != nil {
+				enqueue("pvc/"+pvc.Namespace+"/"+pvc.Name, 0)
+			}
+		}
+	})
+	pvInformer.AddEventHandler(func(pv *PV, ev Event) {
+		if ctx.Err() != nil {
+			return
+		}
+		if isStaleEvent("pv/"+pv.Name, pv.ResourceVersion, ev) {
+			return
+		}
+		if !volumeInShard(pv) {
+			return
+		}
+		switch ev {
+		case MODIFY:
+			// If a PV was modified, we only need to sync that one, and,
+			// if it became Available (e.g. recycled), the claims it may
+			// now satisfy.
+			enqueue("pv/"+pv.Name, 0)
+			if pv.Status.Phase == Available {
+				enqueueClaimsFor(pv)
+			}
+		case CREATE:
+			enqueue("pv/"+pv.Name, 0)
+			// Not all claims: only those the new volume might satisfy.
+			enqueueClaimsFor(pv)
+		case DELETE:
+			deletionBackoff.Forget(pv.UID)
+			recyclingBackoff.Forget(pv.UID)
+			forgetSyncFailures("pv/" + pv.Name)
+			// Only its claim cares; it is Lost now.  Claims that wait for
+			// a PV of this name keep waiting.
+			if pv.Spec.ClaimPtr != nil {
+				enqueue("pvc/"+pv.Spec.ClaimPtr.Namespace+"/"+pv.Spec.ClaimPtr.Name, 0)
+			}
+		}
+	})
+}
+
+// enqueueClaimsFor queues the unbound claims that pv might be bound to: the
+// one it is pre-bound to, those pre-bound to it, and those of its class that
+// fit in it.  FindAcceptablePV makes the real decision.
+func enqueueClaimsFor(pv *PV) {
+	if pv.Spec.ClaimPtr != nil {
+		enqueue("pvc/"+pv.Spec.ClaimPtr.Namespace+"/"+pv.Spec.ClaimPtr.Name, 0)
+	}
+	// Candidates are all in this shard: out-of-shard claims are never
+	// indexed.
+	for _, key := range unboundClaims.Candidates(pv) {
+		enqueue(key, 0)
+	}
+}
+
+// unboundClaims indexes the claims that have not completed binding, so that
+// a new PV costs O(matching claims) instead of a sync of every claim.  Fed
+// by the PVC watch.
+var unboundClaims = newUnboundClaimIndex()
+
+type unboundClaimIndex struct {
+	lock sync.Mutex
+	// class -> size bucket -> claim key -> requested size.  Bucket b holds
+	// sizes in [2^(b-1), 2^b), so the claims a PV of capacity c may fit
+	// are in the buckets up to sizeBucket(c).
+	byClass map[string]map[int]map[string]int64
+	// volume name -> keys of claims pre-bound to it (VolumePtr)
+	byVolume map[string]map[string]bool
+	// claim key -> where it is indexed, to remove it again
+	entries map[string]unboundClaimEntry
+}
+
+type unboundClaimEntry struct {
+	class  string
+	bucket int
+	volume string
+}
+
+func newUnboundClaimIndex() *unboundClaimIndex {
+	return &unboundClaimIndex{
+		byClass:  map[string]map[int]map[string]int64{},
+		byVolume: map[string]map[string]bool{},
+		entries:  map[string]unboundClaimEntry{},
+	}
+}
+
+func sizeBucket(size int64) int {
+	return bits.Len64(uint64(size))
+}
+
+// Update indexes pvc if it is unbound, and removes it otherwise.
+func (i *unboundClaimIndex) Update(pvc *PVClaim, ev Event) {
+	key := "pvc/" + pvc.Namespace + "/" + pvc.Name
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.remove(key)
+	if ev == DELETE || hasAnnotation(pvc, annWasEverBound) {
+		return
+	}
+	size := pvc.Spec.Resources.Requests[Storage]
+	entry := unboundClaimEntry{class: getClaimClass(pvc), bucket: sizeBucket(size)}
+	if pvc.Spec.VolumePtr != nil {
+		entry.volume = pvc.Spec.VolumePtr.Name
+		if i.byVolume[entry.volume] == nil {
+			i.byVolume[entry.volume] = map[string]bool{}
+		}
+		i.byVolume[entry.volume][key] = true
+	}
+	if i.byClass[entry.class] == nil {
+		i.byClass[entry.class] = map[int]map[string]int64{}
+	}
+	if i.byClass[entry.class][entry.bucket] == nil {
+		i.byClass[entry.class][entry.bucket] = map[string]int64{}
+	}
+	i.byClass[entry.class][entry.bucket][key] = size
+	i.entries[key] = entry
+}
+
+func (i *unboundClaimIndex) remove(key string) {
+	entry, found := i.entries[key]
+	if !found {
+		return
+	}
+	delete(i.byClass[entry.class][entry.bucket], key)
+	if entry.volume != "" {
+		delete(i.byVolume[entry.volume], key)
+	}
+	delete(i.entries, key)
+}
+
+// Snapshot returns the indexed claim keys, by class.
+func (i *unboundClaimIndex) Snapshot() map[string][]string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	snapshot := map[string][]string{}
+	for key, entry := range i.entries {
+		snapshot[entry.class] = append(snapshot[entry.class], key)
+	}
+	return snapshot
+}
+
+// Candidates returns the keys of the unbound claims pv might satisfy.
+func (i *unboundClaimIndex) Candidates(pv *PV) []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	keys := []string{}
+	for key := range i.byVolume[pv.Name] {
+		keys = append(keys, key)
+	}
+	buckets := i.byClass[pv.Spec.StorageClassName]
+	for bucket := 0; bucket <= sizeBucket(pv.Spec.Capacity); bucket++ {
+		for key, size := range buckets[bucket] {
+			if size <= pv.Spec.Capacity {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// ProvisionerPlugin is implemented by volume plugins that can create storage
+// assets on demand.
+type ProvisionerPlugin interface {
+	// Name is stored in the annDynamicallyProvisioned annotation of the PVs
+	// this plugin creates.
+	Name() string
+	// CanProvision returns true if this plugin provisions volumes of the
+	// given class.
+	CanProvision(class *StorageClass) bool
+	// Provision creates a storage asset and returns a partially filled PV
+	// for it.  The controller fills in the binding and creates the PV API
+	// object.  ctx is cancelled when the claim is deleted; the plugin
+	// should then stop as soon as it safely can.
+	Provision(ctx context.Context, opts ProvisionOptions) (*PV, error)
+}
+
+// ProvisionOptions is everything a ProvisionerPlugin gets to know about the
+// volume it should create.
+type ProvisionOptions struct {
+	Claim *PVClaim
+	Class *StorageClass
+	// Opaque parameters from the class (fstype, iops, tier, ...).  They may
+	// contain secrets; never log them without redactParameters().
+	Parameters map[string]string
+	// If not nil, the new volume is restored from this snapshot.
+	Source *Snapshot
+	// The name of the PV to create, see PVNamer.  Plugins should use it to
+	// name the storage asset as well, if the storage backend can look
+	// assets up by name.
+	PVName string
+	// Where the volume may be created: the class's AllowedTopologies (e.g.
+	// zones or regions).  Empty means anywhere.  The plugin should set
+	// pv.Spec.NodeAffinity to the topology it actually chose.
+	AllowedTopologies []TopologySelectorTerm
+	// Credentials for the storage backend, from the class's credentials
+	// secret (see resolveProvisionerCredentials).  Never log them.
+	Credentials map[string]string
+	// Idempotency token of this provisioning operation (the value of
+	// annProvisioningToken).  Plugins should store it with the asset, or
+	// pass it to the storage backend's idempotency mechanism if it has one.
+	Token string
+}
+
+// newProvisionOptions returns the options for provisioning a volume for pvc
+// in class.
+func newProvisionOptions(pvc *PVClaim, class *StorageClass) (ProvisionOptions, error) {
+	credentials, err := resolveProvisionerCredentials(pvc, class)
+	if err != nil {
+		return ProvisionOptions{}, err
+	}
+	return ProvisionOptions{
+		Claim:             pvc,
+		Class:             class,
+		Parameters:        expandClaimParameters(class.Parameters, pvc),
+		PVName:            pvNamer.PVName(pvc, class),
+		AllowedTopologies: class.AllowedTopologies,
+		Credentials:       credentials,
+	}, nil
+}
+
+// expandClaimParameters returns a copy of class parameters with
+// "${pvc.namespace}" and "${pvc.name}" in the values replaced by those of
+// the claim, so that tenants sharing a backend can get their own paths or
+// prefixes.  Plugins never see the templates.  Other "${...}" are left alone.
+func expandClaimParameters(parameters map[string]string, pvc *PVClaim) map[string]string {
+	expanded := make(map[string]string, len(parameters))
+	for key, value := range parameters {
+		expanded[key] = expandClaimTemplate(value, pvc)
+	}
+	return expanded
+}
+
+func expandClaimTemplate(value string, pvc *PVClaim) string {
+	return strings.NewReplacer("${pvc.namespace}", pvc.Namespace, "${pvc.name}", pvc.Name).Replace(value)
+}
+
+// classReclaimPolicy returns the reclaim policy of the PVs provisioned in
+// class.  Whatever the plugin put in the PV is overwritten: the class is
+// where the admin decides what happens to the data.
+func classReclaimPolicy(class *StorageClass) string {
+	if class.ReclaimPolicy == "" {
+		return "Delete"
+	}
+	return class.ReclaimPolicy
+}
+
+// This label applies to Secrets.  A secret in the namespace of a claim with
+// this label, whose value is the name of a class, replaces the class's
+// credentials secret for claims of that namespace (e.g. each tenant pays for
+// its own storage account).
+const labelCredentialsOverride = "storage.kubernetes.io/provisioner-credentials-for"
+
+// resolveProvisionerCredentials returns the credentials a provisioner needs
+// for a claim: the per-namespace override if there is one, otherwise the
+// secret referenced by class.CredentialsSecretRef, otherwise nothing.
+func resolveProvisionerCredentials(pvc *PVClaim, class *StorageClass) (map[string]string, error) {
+	overrides := api.ListSecrets(pvc.Namespace, labelCredentialsOverride+"="+class.Name)
+	if len(overrides) > 1 {
+		return nil, fmt.Errorf("namespace %s has %d secrets overriding the credentials of class %s, expected at most one", pvc.Namespace, len(overrides), class.Name)
+	} else if len(overrides) == 1 {
+		return overrides[0].Data, nil
+	}
+	ref := class.CredentialsSecretRef
+	if ref == nil {
+		return nil, nil
+	}
+	secret := api.GetSecret(ref.Namespace, ref.Name)
+	if secret == nil {
+		return nil, fmt.Errorf("credentials secret %s/%s of class %s not found", ref.Namespace, ref.Name, class.Name)
+	}
+	return secret.Data, nil
+}
+
+// setNodeAffinity makes sure a provisioned PV carries node affinity that
+// matches opts.AllowedTopologies, so that pods using it are scheduled where
+// the volume can be attached.  If the plugin did not set any, the allowed
+// topologies are used.  Returns an error if the plugin chose a topology
+// outside of them.
+func setNodeAffinity(pv *PV, opts ProvisionOptions) error {
+	if len(opts.AllowedTopologies) == 0 {
+		return nil
+	}
+	if pv.Spec.NodeAffinity == nil {
+		pv.Spec.NodeAffinity = nodeAffinityFromTopologies(opts.AllowedTopologies)
+		return nil
+	}
+	if !isNodeAffinityWithin(pv.Spec.NodeAffinity, opts.AllowedTopologies) {
+		return fmt.Errorf("volume was created outside of the allowed topologies of class %s", opts.Class.Name)
+	}
+	return nil
+}
+
+// nodeAffinityFromTopologies returns node affinity that selects the nodes
+// in any of topologies: one term per topology, with an "In" requirement per
+// label.
+func nodeAffinityFromTopologies(topologies []TopologySelectorTerm) *VolumeNodeAffinity {
+	selector := &NodeSelector{}
+	for _, topology := range topologies {
+		term := NodeSelectorTerm{}
+		for _, key := range slices.Sorted(maps.Keys(topology.MatchLabelExpressions)) {
+			term.MatchExpressions = append(term.MatchExpressions, NodeSelectorRequirement{
+				Key:      key,
+				Operator: "In",
+				Values:   slices.Clone(topology.MatchLabelExpressions[key]),
+			})
+		}
+		selector.Terms = append(selector.Terms, term)
+	}
+	return &VolumeNodeAffinity{Required: selector}
+}
+
+// isNodeAffinityWithin returns true if every node that affinity selects is
+// in one of topologies.  Each term of the affinity must be within a single
+// topology: for each label of the topology, the term must require one of
+// its values ("In").  Terms with other operators are not understood and
+// count as outside; so does affinity that selects all nodes.
+func isNodeAffinityWithin(affinity *VolumeNodeAffinity, topologies []TopologySelectorTerm) bool {
+	if affinity == nil || affinity.Required == nil {
+		return false
+	}
+	for _, term := range affinity.Required.Terms {
+		if !slices.ContainsFunc(topologies, func(topology TopologySelectorTerm) bool {
+			return isTermWithin(term, topology)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTermWithin(term NodeSelectorTerm, topology TopologySelectorTerm) bool {
+	for key, allowed := range topology.MatchLabelExpressions {
+		if !slices.ContainsFunc(term.MatchExpressions, func(r NodeSelectorRequirement) bool {
+			return r.Key == key && r.Operator == "In" && !slices.ContainsFunc(r.Values, func(v string) bool {
+				return !slices.Contains(allowed, v)
+			})
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// ProvisionedVolumeLookup may be implemented by a ProvisionerPlugin to find
+// the asset created by an earlier Provision call with the same
+// opts.Token.  It returns nil (and no error) if there is none.  Plugins
+// that don't implement this get a second Provision call after a crash, with
+// the same token.
+type ProvisionedVolumeLookup interface {
+	FindProvisioned(ctx context.Context, opts ProvisionOptions) (*PV, error)
+}
+
+// PVNamer names dynamically provisioned PVs.  Names must be deterministic
+// (derived from the claim UID), so that a retry after a crash or a failed
+// CreatePV reuses the name instead of creating a duplicate.
+type PVNamer interface {
+	PVName(pvc *PVClaim, class *StorageClass) string
+}
+
+// uidPVNamer names PVs "pvc-<claim UID>".  This is the default.
+type uidPVNamer struct{}
+
+func (uidPVNamer) PVName(pvc *PVClaim, class *StorageClass) string {
+	return "pvc-" + string(pvc.UID)
+}
+
+// classPVNamer names PVs "<class>-<claim UID>".
+type classPVNamer struct{}
+
+func (classPVNamer) PVName(pvc *PVClaim, class *StorageClass) string {
+	return class.Name + "-" + string(pvc.UID)
+}
+
+// pvNamer is set by initController.
+var pvNamer PVNamer = uidPVNamer{}
+
+// ParameterValidator may be implemented by a ProvisionerPlugin to reject
+// class parameters it does not understand before anything is provisioned.
+type ParameterValidator interface {
+	ValidateParameters(parameters map[string]string) error
+}
+
+// validateClassParameters returns an error if the plugin rejects the
+// parameters of the class of pvc.
+func validateClassParameters(plugin ProvisionerPlugin, pvc *PVClaim) error {
+	validator, ok := plugin.(ParameterValidator)
+	if !ok {
+		return nil
+	}
+	class := api.GetClass(getClaimClass(pvc))
+	if err := validator.ValidateParameters(class.Parameters); err != nil {
+		return fmt.Errorf("invalid parameters %v of class %s: %v", redactParameters(class.Parameters), class.Name, err)
+	}
+	return nil
+}
+
+// Parameters whose keys contain any of these (case-insensitive) are
+// replaced by redactParameters.
+var secretParameterKeys = []string{"secret", "password", "token", "key", "credential"}
+
+// redactParameters returns a copy of parameters that is safe to put in logs
+// and events.
+func redactParameters(parameters map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for key, value := range parameters {
+		redacted[key] = value
+		for _, secret := range secretParameterKeys {
+			if strings.Contains(strings.ToLower(key), secret) {
+				redacted[key] = "<redacted>"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// provisionerPlugins is filled by RegisterProvisionerPlugin at controller
+// start and read-only afterwards.
+var provisionerPlugins []ProvisionerPlugin
+
+// RegisterProvisionerPlugin must be called before initController.
+func RegisterProvisionerPlugin(plugin ProvisionerPlugin) {
+	provisionerPlugins = append(provisionerPlugins, plugin)
+}
+
+// findProvisionerPluginForPV returns the plugin that provisions the PV for a
+// claim, or nil if no registered plugin handles the class of the claim.
+func findProvisionerPluginForPV(pvc *PVClaim) ProvisionerPlugin {
+	class := api.GetClass(getClaimClass(pvc))
+	if class == nil {
+		return nil
+	}
+	for _, plugin := range provisionerPlugins {
+		if plugin.CanProvision(class) {
+			return plugin
+		}
+	}
+	return nil
+}
+
+// DeleterPlugin destroys the storage asset behind a PV.
+type DeleterPlugin interface {
+	// Name must match the annDynamicallyProvisioned annotation of the PVs
+	// this plugin may delete (see isProvisionedBy).
+	Name() string
+	// Delete destroys the storage asset of pv.  It must succeed if the
+	// asset is already gone: it is called again when deleting the PV API
+	// object failed.
+	Delete(pv *PV) error
+}
+
+// deleterPlugins is filled by RegisterDeleterPlugin at controller start and
+// read-only afterwards.  Keyed by volume source type (the name of the field
+// set in pv.Spec.PersistentVolumeSource, e.g. "gcePersistentDisk"), as that
+// is all a PV says about what made it.  CSI volumes are not in here; they
+// are dispatched by driver name (see findCSIPluginForPV).
+var deleterPlugins = map[string]DeleterPlugin{}
+
+// RegisterDeleterPlugin must be called before initController.  Only one
+// plugin may handle a volume source type.
+func RegisterDeleterPlugin(sourceType string, plugin DeleterPlugin) {
+	if existing, found := deleterPlugins[sourceType]; found {
+		panic(fmt.Sprintf("deleter plugins %s and %s both registered for volume source %s", existing.Name(), plugin.Name(), sourceType))
+	}
+	deleterPlugins[sourceType] = plugin
+}
+
+// findDeleterPluginForPV returns the plugin that deletes the storage asset of
+// pv, or nil if there is none.
+func findDeleterPluginForPV(pv *PV) DeleterPlugin {
+	if pv.Spec.CSI != nil {
+		if plugin := findCSIPluginForPV(pv); plugin != nil {
+			return plugin
+		}
+		// The driver did not register.
+		return nil
+	}
+	return deleterPlugins[volumeSourceType(pv)]
+}
+
+// volumeSourceType returns the type of the volume source of pv, as
+// registered plugins know it: the API name of the field set in
+// pv.Spec.PersistentVolumeSource.  It is "" if none is set, e.g. for CSI
+// volumes.
+func volumeSourceType(pv *PV) string {
+	switch {
+	case pv.Spec.NFS != nil:
+		return "nfs"
+	case pv.Spec.HostPath != nil:
+		return "hostPath"
+	}
+	return ""
+}
+
+// deleteVolume deletes the storage asset and the API object of a Released
+// PV whose reclaim policy is Delete (or that was provisioned for a claim
+// that ended up bound elsewhere).
+func deleteVolume(pv *PV) syncResult {
+	plugin := findDeleterPluginForPV(pv)
+	if plugin != nil && !isProvisionedBy(pv, plugin) {
+		// Someone else created the storage asset (e.g. the admin created
+		// this PV by hand); it is not ours to destroy.  The PV stays
+		// Released.
+		recordEvent(pv, reasonDeleteRefused, pv.Name, plugin.Name())
+		return done
+	} else if plugin != nil && isDeletionDryRun(pv) {
+		// Everything up to here was real (approval, ownership); only the
+		// deletion itself is skipped.  The PV stays Released, and we say
+		// it once per sync, which is what the admin wants to watch.
+		recordEvent(pv, reasonDeleteDryRun, describeAsset(pv), plugin.Name())
+		return done
+	} else if plugin != nil {
+		if !deletionBackoff.IsAllowed(pv.UID) {
+			// The last attempt failed; wait.
+			_, next := deletionBackoff.Get(pv.UID)
+			return requeueAfter(clock.Until(next))
+		}
+		if !acquireDeleterSlot() {
+			// Too many deletions running; the PV stays Released.
+			return requeueAfter(retryWhileProvisioning)
+		}
+		started := runningDeleters.Run(string(pv.UID), "pv/"+pv.Name, func(ctx context.Context) {
+			defer releaseDeleterSlot()
+			recordEvent(pv, reasonDeleteStarted, describeAsset(pv), plugin.Name())
+			start := clock.Now()
+			if err := plugin.Delete(pv); err != nil {
+				observeReclaim(pv, plugin.Name(), "failed", start)
+				deletionFailed(pv, err)
+				return
+			}
+			observeReclaim(pv, plugin.Name(), "succeeded", start)
+			recordEvent(pv, reasonDeleteSucceeded, describeAsset(pv))
+			deletionBackoff.Forget(pv.UID)
+			if err := removePVProtection(pv); err != nil {
+				recordEvent(pv, reasonDeleteFailed, err)
+				return
+			}
+			if err := api.DeletePV(pv); err != nil {
+				// The asset is gone, but the PV is not.  The next syncPV
+				// calls the deleter again, which must succeed for an asset
+				// that no longer exists.
+				recordEvent(pv, reasonDeleteFailed, err)
+			}
+		})
+		if !started {
+			// Already being deleted (the resync loop got here again while
+			// the cloud call is in flight).
+			releaseDeleterSlot()
+		}
+	} else if provisioner, found := pv.Annotations[annDynamicallyProvisioned]; found && isDeletionDryRun(pv) {
+		recordEvent(pv, reasonDeleteDryRun, describeAsset(pv), provisioner)
+	} else if provisioner, found := pv.Annotations[annDynamicallyProvisioned]; found {
+		// Provisioned by something that is not in-tree, i.e. an external
+		// provisioner.  It is also the deleter: ask it to delete the
+		// volume, and wait for the PV to go away.
+		if !hasAnnotation(pv, annDeletionRequested) {
+			// The external deleter must be able to delete the PV object.
+			removeFinalizer(pv, finalizerPVProtection)
+			pv.Annotations[annDeletionRequested] = provisioner
+			if err := CommitPV(pv); err != nil {
+				return commitFailed(err)
+			}
+			recordEvent(pv, reasonExternalDeletion, provisioner)
+		}
+	} else {
+		recordEvent(pv, reasonNoDeleter, pv.Name)
+		pv.Status.Phase = Failed
+		if err := CommitPVStatus(pv); err != nil {
+			return commitFailed(err)
+		}
+	}
+	return done
+}
+
+// After this many failed Delete calls for a PV, give up and mark it Failed;
+// the admin has to look at it.  Zero means retry forever.  Set from a
+// command line flag.
+var maxDeleteAttempts = 10
+
+// deletionBackoff tracks failed Delete calls per PV UID, with the same
+// intervals as provisioningBackoff.  It lives in memory only.
+var deletionBackoff = newBackoff()
+
+// recyclingBackoff does the same for failed recycle attempts (see
+// recycleFailed).  It is here and not in recycler.go so that the PV watch
+// can forget deleted PVs in all builds.
+var recyclingBackoff = newBackoff()
+
+// deletionFailed records a failed Delete call.  The PV stays Released and
+// is retried after a backoff, until maxDeleteAttempts is reached.
+func deletionFailed(pv *PV, err error) {
+	attempts, next := deletionBackoff.Failed(pv.UID, err)
+	if maxDeleteAttempts == 0 || attempts < maxDeleteAttempts {
+		recordEvent(pv, reasonDeleteBackoff, attempts, err, next)
+		return
+	}
+	// A Failed PV is not deleted again; syncPV leaves it alone until
+	// the admin deletes it or sets it back to Released.
+	recordEvent(pv, reasonDeleteFailedPermanently, attempts, err)
+	pv.Status.Phase = Failed
+	pv.Status.Message = message(reasonDeleteFailedPermanently, attempts, err)
+	if err := CommitPVStatus(pv); err != nil {
+		// The next syncPV tries to delete once more, fails and gets
+		// here again.
+		return
+	}
+	deletionBackoff.Forget(pv.UID)
+}
+
+// observeReclaim counts a reclaim decision or outcome of pv, by reclaim
+// policy and plugin.  If start is set, the duration of the operation is
+// recorded too.
+func observeReclaim(pv *PV, plugin, result string, start time.Time) {
+	policy := pv.Spec.ReclaimPolicy
+	metrics.Counter("pv_controller_reclaims_total", "policy", policy, "plugin", plugin, "result", result).Inc()
+	if !start.IsZero() {
+		metrics.Histogram("pv_controller_reclaim_duration_seconds", "policy", policy, "plugin", plugin).Observe(clock.Since(start).Seconds())
+	}
+}
+
+// If set, deleteVolume only tells what it would delete, in an event on the
+// PV, for admins checking the reclaim configuration of a new cluster.  The
+// annDeleteDryRun annotation does the same for a single PV.  Set from a
+// command line flag.
+var deletionDryRun = false
+
+// This annotation applies to PVs; see deletionDryRun.
+const annDeleteDryRun = "pv.kubernetes.io/delete-dry-run"
+
+func isDeletionDryRun(pv *PV) bool {
+	return deletionDryRun || hasAnnotation(pv, annDeleteDryRun)
+}
+
+// describeAsset returns a description of the storage asset of pv that an
+// admin can look up in the storage backend.
+func describeAsset(pv *PV) string {
+	if pv.Spec.CSI != nil {
+		return fmt.Sprintf("%s volume %s", pv.Spec.CSI.Driver, pv.Spec.CSI.VolumeHandle)
+	}
+	return fmt.Sprintf("%s volume %s", volumeSourceType(pv), volumeSourceID(pv))
+}
+
+// volumeSourceID returns what identifies the asset of pv in its storage
+// backend, for volumes that are not CSI volumes; see volumeSourceType.
+func volumeSourceID(pv *PV) string {
+	switch {
+	case pv.Spec.NFS != nil:
+		return pv.Spec.NFS.Server + ":" + pv.Spec.NFS.Path
+	case pv.Spec.HostPath != nil:
+		return pv.Spec.HostPath.Path
+	}
+	return ""
+}
+
+// Limit on the number of deleter goroutines running at the same time, like
+// maxProvisioners.  Zero means no limit.  Set from a command line flag.
+var maxDeleters = 50
+
+var deleterSlots = struct {
+	lock    sync.Mutex
+	running int
+}{}
+
+func acquireDeleterSlot() bool {
+	deleterSlots.lock.Lock()
+	defer deleterSlots.lock.Unlock()
+	if maxDeleters > 0 && deleterSlots.running >= maxDeleters {
+		return false
+	}
+	deleterSlots.running++
+	return true
+}
+
+func releaseDeleterSlot() {
+	deleterSlots.lock.Lock()
+	defer deleterSlots.lock.Unlock()
+	deleterSlots.running--
+}
+
+// VolumeArchiver may be implemented by a DeleterPlugin to support the
+// Archive reclaim policy: the asset is snapshotted (or backed up) before it
+// is deleted, so that the admin can still get the data back.
+type VolumeArchiver interface {
+	// Archive returns an identifier of the archive, which the admin can
+	// restore from.  It must be idempotent: after a crash it is called
+	// again for the same PV.
+	Archive(ctx context.Context, pv *PV) (string, error)
+}
+
+// This annotation is added to a Released PV with the Archive reclaim policy
+// once it has been archived.  Its value is the identifier returned by
+// VolumeArchiver.Archive; it is also in the event, which outlives the PV.
+const annArchivedAs = "pv.kubernetes.io/archived-as"
+
+// archiveVolume archives a Released PV whose reclaim policy is Archive, and
+// then deletes it like deleteVolume.
+func archiveVolume(pv *PV) syncResult {
+	if hasAnnotation(pv, annArchivedAs) {
+		return deleteVolume(pv)
+	}
+	plugin := findDeleterPluginForPV(pv)
+	if plugin == nil {
+		return deleteVolume(pv) // handles the missing deleter
+	}
+	archiver, ok := plugin.(VolumeArchiver)
+	if !ok {
+		// Never delete without the archive the admin asked for.
+		recordEvent(pv, reasonArchiveUnsupported, plugin.Name())
+		pv.Status.Phase = Failed
+		if err := CommitPVStatus(pv); err != nil {
+			return commitFailed(err)
+		}
+		return done
+	}
+	if !deletionBackoff.IsAllowed(pv.UID) {
+		_, next := deletionBackoff.Get(pv.UID)
+		return requeueAfter(clock.Until(next))
+	}
+	if !acquireDeleterSlot() {
+		// Archives count against maxDeleters like deletions.
+		return requeueAfter(retryWhileProvisioning)
+	}
+	started := runningDeleters.Run("archive/"+string(pv.UID), "pv/"+pv.Name, func(ctx context.Context) {
+		defer releaseDeleterSlot()
+		id, err := archiver.Archive(ctx, pv)
+		if err != nil {
+			attempts, next := deletionBackoff.Failed(pv.UID, err)
+			recordEvent(pv, reasonArchiveFailed, attempts, err, next)
+			return
+		}
+		deletionBackoff.Forget(pv.UID)
+		recordEvent(pv, reasonArchived, id)
+		// The MODIFY event of this update brings the PV back to
+		// syncPV, which deletes it.  If this fails, the next pass
+		// archives again; Archive is idempotent.
+		updatePVWithRetry(pv, func(pv *PV) error {
+			if pv.Status.Phase != Released {
+				return fmt.Errorf("%s is %s now", pv.Name, pv.Status.Phase)
+			}
+			setAnnotationValue(pv, annArchivedAs, id)
+			return nil
+		})
+	})
+	if !started {
+		// Already being archived.
+		releaseDeleterSlot()
+	}
+	return done
+}
+
+// AssetLister may be implemented by a DeleterPlugin to list the storage
+// assets it provisioned, so that assets without a PV can be found.  Those
+// are left behind when the controller crashes between Provision and
+// CreatePV, or when deleteLeakedAsset fails.
+type AssetLister interface {
+	// ListAssets returns the assets the plugin tagged as provisioned by
+	// this controller.
+	ListAssets(ctx context.Context) ([]Asset, error)
+	// DeleteAsset deletes an asset that has no PV.
+	DeleteAsset(ctx context.Context, asset Asset) error
+}
+
+type Asset struct {
+	// Plugin specific ID, for events.
+	ID string
+	// The name of the PV the asset was provisioned for (opts.PVName).
+	PVName  string
+	Created time.Time
+}
+
+// How often scanOrphanedAssets runs, and how old an asset without a PV must
+// be to count as orphaned; younger ones may be in the middle of
+// provisioning.  If deleteOrphanedAssets is not set, orphans are only
+// reported.  Set from command line flags.
+var orphanScanInterval = time.Hour
+var orphanMinAge = time.Hour
+var deleteOrphanedAssets = false
+
+// scanOrphanedAssets finds (and maybe deletes) storage assets that were
+// provisioned by the controller but have no PV.
+func scanOrphanedAssets(ctx context.Context) {
+	if apiBreaker.Open() > 0 {
+		// Reads fail now too; an asset whose PV we can't read is not an
+		// orphan.  Wait for the next scan.
+		return
+	}
+	plugins := []DeleterPlugin{}
+	for _, plugin := range deleterPlugins {
+		plugins = append(plugins, plugin)
+	}
+	for _, plugin := range csiPlugins {
+		plugins = append(plugins, plugin)
+	}
+	for _, plugin := range plugins {
+		if ctx.Err() != nil {
+			return
+		}
+		lister, ok := plugin.(AssetLister)
+		if !ok {
+			continue
+		}
+		assets, err := lister.ListAssets(ctx)
+		if err != nil {
+			// Try again at the next scan.
+			continue
+		}
+		orphans := 0
+		for _, asset := range assets {
+			if !hasExpired(asset.Created.Add(orphanMinAge)) {
+				continue
+			}
+			// Read the PV from the API server, not the cache: a PV created
+			// after the cache was filled must not be mistaken for missing.
+			// Only a NotFound makes it an orphan; any other error may be
+			// an API server in trouble, where every asset looks orphaned.
+			if pv, err := getPVFromServer(asset.PVName); pv != nil || err != nil {
+				continue
+			}
+			orphans++
+			recordEvent(nil, reasonOrphanedAsset, asset.ID, plugin.Name(), asset.PVName)
+			if deleteOrphanedAssets && !observeOnly {
+				if err := lister.DeleteAsset(ctx, asset); err != nil {
+					recordEvent(nil, reasonOrphanedAssetDeleteFailed, asset.ID, plugin.Name(), err)
+				}
+			}
+		}
+		metrics.Gauge("pv_controller_orphaned_assets", "plugin", plugin.Name()).Set(float64(orphans))
+	}
+}
+
+// If set, the Recycle reclaim policy is treated as unsupported: Released
+// volumes with that policy are marked Failed instead of being scrubbed.
+// Building with the "norecycler" tag has the same effect and leaves the
+// scrubber pod code out of the binary.
+var recyclingDisabled = false
+
+// If set, the Recycle reclaim policy is treated as Delete, with a warning
+// event: a migration path off recycling for admins whose PVs still say
+// Recycle.  Takes precedence over recyclingDisabled.  Set from a command
+// line flag.
+var recycleAsDelete = false
+
+// isProvisionedBy returns true if the annDynamicallyProvisioned annotation of
+// pv names the plugin, i.e. the asset was created by the controller through
+// that plugin.  Deleters must only delete such assets.
+func isProvisionedBy(pv *PV, plugin DeleterPlugin) bool {
+	return pv.Annotations[annDynamicallyProvisioned] == plugin.Name()
+}
+
+// deleteLeakedAsset deletes the storage asset of a PV provisioned for pvc
+// whose API object could not be created.  Nobody else knows about the
+// asset, so if this fails, it must be deleted manually.
+func deleteLeakedAsset(pv *PV, pvc *PVClaim) {
+	plugin := findDeleterPluginForPV(pv)
+	if plugin == nil {
+		recordEvent(pvc, reasonLeakedVolume)
+		return
+	}
+	if err := plugin.Delete(pv); err != nil {
+		recordEvent(pvc, reasonLeakedVolumeDeleteFailed, err)
+	}
+}
+
+// createProvisionedPV creates the API object of a PV freshly provisioned
+// for pvc.
+// AlreadyExists is success: the PV name is derived from the claim, so an
+// earlier attempt, or a retry inside the client, got there first.  Any
+// other error may come from a write that was persisted nevertheless (a
+// timeout, a dropped connection), and deleting the asset of a PV that
+// exists loses the claim's data.  So the asset is deleted only once the
+// server confirms that there is no PV of that name pre-bound to the same
+// claim; if even that read fails, the asset is left to
+// scanOrphanedAssets.  The error of CreatePV is returned if the PV was not
+// created.
+func createProvisionedPV(pv *PV, pvc *PVClaim) error {
+	err := api.CreatePV(pv)
+	if err == nil || IsAlreadyExists(err) {
+		return nil
+	}
+	existing, getErr := getPVFromServer(pv.Name)
+	switch {
+	case getErr != nil:
+		// We can't tell; keep the asset.
+	case existing != nil && refersTo(existing.Spec.ClaimPtr, &pvc.ObjectMeta):
+		// Created after all.
+		return nil
+	default:
+		deleteLeakedAsset(pv, pvc)
+	}
+	return err
+}
+
+// claimPods is fed by the pod watch.  It maps each claim ("namespace/name")
+// to the pods that use it and are not finished yet.
+var claimPods = newClaimPodIndex()
+
+type claimPodIndex struct {
+	lock sync.Mutex
+	// claim key -> pod name -> true
+	pods map[string]map[string]bool
+}
+
+func newClaimPodIndex() *claimPodIndex {
+	return &claimPodIndex{pods: map[string]map[string]bool{}}
+}
+
+// Update records a pod event and returns the claims whose set of pods
+// changed.
+func (i *claimPodIndex) Update(pod *Pod, ev Event) []*PVClaim {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	finished := ev == DELETE || pod.Status.Phase == Succeeded || pod.Status.Phase == PodFailed
+	changed := []*PVClaim{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		key := pod.Namespace + "/" + volume.PersistentVolumeClaim.ClaimName
+		pods := i.pods[key]
+		if finished == !pods[pod.Name] {
+			continue
+		}
+		if finished {
+			delete(pods, pod.Name)
+			if len(pods) == 0 {
+				delete(i.pods, key)
+			}
+		} else {
+			if pods == nil {
+				pods = map[string]bool{}
+				i.pods[key] = pods
+			}
+			pods[pod.Name] = true
+		}
+		if pvc := pvcLister.Get(pod.Namespace, volume.PersistentVolumeClaim.ClaimName); pvc != nil {
+			changed = append(changed, pvc)
+		}
+	}
+	return changed
+}
+
+// isClaimInUse returns true if a pod that is not finished uses pvc.
+func isClaimInUse(pvc *PVClaim) bool {
+	claimPods.lock.Lock()
+	defer claimPods.lock.Unlock()
+	return len(claimPods.pods[pvc.Namespace+"/"+pvc.Name]) > 0
+}
+
+// operationRegistry tracks running goroutines (provisioners, deleters,
+// recyclers), so that at most one operation runs per object.  The resync
+// loop calls into the sync functions every 15s, while a cloud operation may
+// take minutes.
+type operationRegistry struct {
+	lock sync.Mutex
+	// operation key (e.g. claim UID) -> running operation
+	running map[string]*operation
+	// Set by Shutdown; no operation is started after that.
+	closed bool
+	// Counts the running goroutines (a batch is one).
+	wg sync.WaitGroup
+}
+
+type operation struct {
+	// Key of the object being worked on ("pv/<name>" or
+	// "pvc/<namespace>/<name>").
+	objectKey string
+	cancel    context.CancelCauseFunc
+	// Set for the members of a batch, see RunBatch.
+	batch     *batchOperation
+	cancelled bool
+}
+
+// batchOperation is the state shared by the members of a batch.
+type batchOperation struct {
+	// Cancels the context of the whole batch, and so of all members.
+	cancel context.CancelCauseFunc
+	// The number of members not cancelled yet.
+	live int
+}
+
+// Causes of a cancelled operation context (context.Cause).  An operation
+// cancelled by Cancel is not wanted any more and should clean up after
+// itself; one cancelled by Shutdown should stop where it can be resumed
+// by the next leader, and clean up nothing.
+var (
+	errOperationCancelled = errors.New("operation cancelled")
+	errShuttingDown       = errors.New("controller shutting down")
+)
+
+func shuttingDown(ctx context.Context) bool {
+	return context.Cause(ctx) == errShuttingDown
+}
+
+func newOperationRegistry() *operationRegistry {
+	return &operationRegistry{running: map[string]*operation{}}
+}
+
+// Run launches op in a goroutine, unless an operation with the same key is
+// already running.  The key is removed when op returns.  Returns false if
+// the operation was already running, or the registry is shut down.  The
+// context passed to op is cancelled by Cancel and Shutdown.
+func (r *operationRegistry) Run(key, objectKey string, op func(ctx context.Context)) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, found := r.running[key]; found || r.closed {
+		return false
+	}
+	if observeOnly {
+		log.Info("observe-only: would start operation", "key", key, "object", objectKey)
+		return false
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r.running[key] = &operation{objectKey: objectKey, cancel: cancel}
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.running, key)
+			r.lock.Unlock()
+			cancel(nil)
+			r.wg.Done()
+		}()
+		op(ctx)
+	}()
+	return true
+}
+
+// RunBatch is Run for an operation that works on several keys at once.
+// Keys that are already running are left out; op gets a context for each
+// key it owns, and is not called at all if there are none.  Cancel of a key
+// cancels only the context of that key; the context of the whole batch is
+// cancelled once all keys are, or by Shutdown (and then all keys are).
+func (r *operationRegistry) RunBatch(objectKeys map[string]string, op func(ctx context.Context, members map[string]context.Context)) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return false
+	}
+	if observeOnly {
+		log.Info("observe-only: would start batch operation", "objects", len(objectKeys))
+		return false
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	batch := &batchOperation{cancel: cancel}
+	members := map[string]context.Context{}
+	for key, objectKey := range objectKeys {
+		if _, found := r.running[key]; found {
+			continue
+		}
+		memberCtx, memberCancel := context.WithCancelCause(ctx)
+		r.running[key] = &operation{objectKey: objectKey, cancel: memberCancel, batch: batch}
+		members[key] = memberCtx
+		batch.live++
+	}
+	if len(members) == 0 {
+		cancel(nil)
+		return false
+	}
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			for key := range members {
+				delete(r.running, key)
+			}
+			r.lock.Unlock()
+			cancel(nil)
+			r.wg.Done()
+		}()
+		op(ctx, members)
+	}()
+	return true
+}
+
+// Cancel cancels the context of a running operation, if any.  The operation
+// is still registered until it returns.
+func (r *operationRegistry) Cancel(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	op, found := r.running[key]
+	if !found {
+		return
+	}
+	op.cancel(errOperationCancelled)
+	if op.batch != nil && !op.cancelled {
+		op.batch.live--
+		if op.batch.live == 0 {
+			op.batch.cancel(errOperationCancelled)
+		}
+	}
+	op.cancelled = true
+}
+
+// Shutdown stops r from starting operations and waits for the running ones
+// until deadline.  Those still running then are cancelled with
+// errShuttingDown and given until cancelDeadline to return.  Returns the
+// object keys of the operations that did not finish in time.
+func (r *operationRegistry) Shutdown(deadline, cancelDeadline time.Time) []string {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-clock.After(clock.Until(deadline)):
+	}
+	keys := r.ObjectKeys()
+	r.lock.Lock()
+	for _, op := range r.running {
+		if op.batch != nil {
+			op.batch.cancel(errShuttingDown)
+		}
+		op.cancel(errShuttingDown)
+	}
+	r.lock.Unlock()
+	select {
+	case <-finished:
+	case <-clock.After(clock.Until(cancelDeadline)):
+	}
+	return keys
+}
+
+// Snapshot returns the object key of each running operation, by operation
+// key.
+func (r *operationRegistry) Snapshot() map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	snapshot := map[string]string{}
+	for key, op := range r.running {
+		snapshot[key] = op.objectKey
+	}
+	return snapshot
+}
+
+// ObjectKeys returns the keys of the objects with running operations.
+func (r *operationRegistry) ObjectKeys() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	keys := []string{}
+	for _, op := range r.running {
+		keys = append(keys, op.objectKey)
+	}
+	return keys
+}
+
+var runningProvisioners = newOperationRegistry()
+var runningDeleters = newOperationRegistry()
+var runningRecyclers = newOperationRegistry()
+
+// Limits on the number of provisioner goroutines running at the same time,
+// so that a burst of claims does not turn into hundreds of simultaneous
+// cloud API calls.  Zero means no limit.  Set from command line flags.
+var maxProvisioners = 50
+var maxProvisionersPerPlugin = 10
+
+// provisionerSlots counts the running provisioner goroutines, in total ("")
+// and per plugin name.
+var provisionerSlots = struct {
+	lock    sync.Mutex
+	running map[string]int
+}{running: map[string]int{}}
+
+func acquireProvisionerSlot(plugin string) bool {
+	provisionerSlots.lock.Lock()
+	defer provisionerSlots.lock.Unlock()
+	if maxProvisioners > 0 && provisionerSlots.running[""] >= maxProvisioners {
+		return false
+	}
+	if maxProvisionersPerPlugin > 0 && provisionerSlots.running[plugin] >= maxProvisionersPerPlugin {
+		return false
+	}
+	provisionerSlots.running[""]++
+	provisionerSlots.running[plugin]++
+	return true
+}
+
+func releaseProvisionerSlot(plugin string) {
+	provisionerSlots.lock.Lock()
+	defer provisionerSlots.lock.Unlock()
+	provisionerSlots.running[""]--
+	provisionerSlots.running[plugin]--
+}
+
+// runProvisioner runs op in runningProvisioners, within the concurrency
+// limits.  If there is no free slot, nothing happens; the claim is still
+// Pending and syncPVC will try again.
+func runProvisioner(plugin ProvisionerPlugin, key, objectKey string, op func(ctx context.Context)) {
+	if !acquireProvisionerSlot(plugin.Name()) {
+		return
+	}
+	started := runningProvisioners.Run(key, objectKey, func(ctx context.Context) {
+		defer releaseProvisionerSlot(plugin.Name())
+		op(ctx)
+	})
+	if !started {
+		// Already running.
+		releaseProvisionerSlot(plugin.Name())
+	}
+}
+
+// provisionClaim launches a goroutine that provisions a volume for the
+// claim, unless one is already running for this claim.  The claim itself is
+// not modified here; the next syncPVC finds the new PV (it is pre-bound to
+// the claim) and completes the binding.
+func provisionClaim(pvc *PVClaim, plugin ProvisionerPlugin) {
+	if !provisioningBackoff.IsAllowed(pvc.UID) {
+		// The last attempt failed; wait.
+		return
+	}
+	if err := validateClassParameters(plugin, pvc); err != nil {
+		// Retry later, the admin may fix the class.
+		recordEvent(pvc, reasonProvisioningFailed, err)
+		return
+	}
+	runProvisioner(plugin, string(pvc.UID), "pvc/"+pvc.Namespace+"/"+pvc.Name, func(ctx context.Context) {
+		pv := provisionVolume(ctx, plugin, pvc, api.GetClass(getClaimClass(pvc)))
+		if pv == nil {
+			return
+		}
+		if ctx.Err() != nil && !shuttingDown(ctx) {
+			// The claim was deleted while we were provisioning; nobody
+			// wants the volume.  If this fails, the asset is leaked.  (If
+			// the claim is deleted after this check, the PV is created
+			// bound to a missing claim and syncPV releases and deletes it.)
+			deleteLeakedAsset(pv, pvc)
+			return
+		}
+		if err := createProvisionedPV(pv, pvc); err != nil {
+			recordEvent(pvc, reasonCreatePVFailed, err)
+		}
+	})
+}
+
+// provisionVolume makes the storage asset for pvc, the same way for every
+// provisioning path: with the claim's idempotency token
+// (annProvisioningToken), the attempt and failure metrics, and
+// provisioningBackoff.  It returns the PV to create, or nil if there is
+// none; the reason is recorded as an event.
+//
+// The PV API object must:
+//   - have annDynamicallyProvisioned annotation.
+//   - be fully bound to the claim that created it (incl.
+//     PV.Spec.ClaimPtr.UID) to delete it when the claim is deleted.
+//   - name the class of the claim (StorageClassName): the class decides
+//     the shard of the PV and how it is reclaimed.
+func provisionVolume(ctx context.Context, plugin ProvisionerPlugin, pvc *PVClaim, class *StorageClass) *PV {
+	opts, err := newProvisionOptions(pvc, class)
+	if err != nil {
+		// Retry later, the admin may fix the secret.
+		recordEvent(pvc, reasonProvisioningFailed, err)
+		return nil
+	}
+	var pv *PV
+	if token, found := pvc.Annotations[annProvisioningToken]; found {
+		// A previous attempt (maybe by an instance that crashed) may
+		// have created the asset.  Ask before creating another one.
+		if lookup, ok := plugin.(ProvisionedVolumeLookup); ok {
+			opts.Token = token
+			pv, err = lookup.FindProvisioned(ctx, opts)
+			if err != nil {
+				// We can't tell; don't risk a second copy.
+				recordEvent(pvc, reasonProvisioningFailed, err)
+				return nil
+			}
+		}
+	} else {
+		// Persist the token before calling the plugin, so that we know
+		// about this attempt after a crash.
+		setAnnotationValue(pvc, annProvisioningToken, opts.PVName)
+		if err := CommitPVC(pvc); err != nil {
+			// Retry later.
+			return nil
+		}
+	}
+	opts.Token = pvc.Annotations[annProvisioningToken]
+	if pv == nil {
+		metrics.Counter("pv_controller_provision_attempts_total", "plugin", plugin.Name(), "class", class.Name).Inc()
+		pv, err = plugin.Provision(ctx, opts)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Cancelled because the claim was deleted, or because we are
+		// shutting down; then the next leader provisions again, with
+		// the same annProvisioningToken.
+		return nil
+	} else if err != nil {
+		metrics.Counter("pv_controller_provision_failures_total", "plugin", plugin.Name(), "class", class.Name).Inc()
+		attempts, next := provisioningBackoff.Failed(pvc.UID, err)
+		recordEvent(pvc, reasonProvisioningBackoff, attempts, err, next)
+		return nil
+	}
+	if err := setNodeAffinity(pv, opts); err != nil {
+		// The plugin put the volume where the class does not allow it.
+		recordEvent(pvc, reasonProvisioningFailed, err)
+		deleteLeakedAsset(pv, pvc)
+		return nil
+	}
+	provisioningBackoff.Forget(pvc.UID)
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Name = opts.PVName
+	pv.Annotations[annDynamicallyProvisioned] = plugin.Name()
+	pv.Spec.StorageClassName = opts.Class.Name
+	pv.Spec.ReclaimPolicy = classReclaimPolicy(opts.Class)
+	pv.Spec.ClaimPtr = claimReference(pvc)
+	setAnnotation(pv, annBoundByController)
+	return pv
+}
+
+// provisionClaimGroup provisions volumes for all claims in the group of pvc
+// in one goroutine.  Nothing is done until all members of the group exist.
+// Each member is provisioned by provisionVolume, as in provisionClaim
+// (token, backoff, metrics).  If provisioning of any member fails, or a
+// member is deleted meanwhile, the assets created so far are deleted
+// (best-effort) and no PV is created, so the group is retried as a whole.
+// PVs are only created once all assets exist; each is pre-bound to its
+// claim and syncPVC binds them.
+func provisionClaimGroup(pvc *PVClaim, plugin ProvisionerPlugin) {
+	group := pvc.Annotations[annClaimGroup]
+	members := api.ListPVCs(pvc.Namespace, func(c *PVClaim) bool {
+		return c.Annotations[annClaimGroup] == group
+	})
+	if strconv.Itoa(len(members)) != pvc.Annotations[annClaimGroupSize] {
+		// Not all members exist yet; retry later.
+		return
+	}
+	for _, member := range members {
+		if !provisioningBackoff.IsAllowed(member.UID) {
+			// The group waits for its member with the longest backoff.
+			return
+		}
+		if err := validateClassParameters(plugin, member); err != nil {
+			recordEvent(member, reasonClaimGroupProvisioningFailed, group, err)
+			return
+		}
+	}
+	runProvisioner(plugin, claimGroupKey(pvc), "pvc/"+pvc.Namespace+"/"+pvc.Name, func(ctx context.Context) {
+		// The assets provisioned so far, and the member of each.
+		pvs, owners := []*PV{}, []*PVClaim{}
+		rollback := func() {
+			for i, created := range pvs {
+				deleteLeakedAsset(created, owners[i])
+			}
+		}
+		for _, member := range members {
+			if ctx.Err() != nil {
+				break
+			}
+			if member.Spec.VolumePtr != nil || api.FindPVBoundTo(member) != nil {
+				// Provisioned before, e.g. by a previous leader that crashed
+				// in the middle of creating the PVs.
+				continue
+			}
+			pv := provisionVolume(ctx, plugin, member, api.GetClass(getClaimClass(member)))
+			if pv == nil && ctx.Err() == nil {
+				recordEvent(member, reasonClaimGroupProvisioningFailed, group, member.Name)
+				rollback()
+				return
+			}
+			if pv != nil {
+				pvs, owners = append(pvs, pv), append(owners, member)
+			}
+		}
+		if ctx.Err() != nil && !shuttingDown(ctx) {
+			// A member was deleted (see the PVC watch); the group is
+			// incomplete for good.
+			rollback()
+			return
+		}
+		// On shutdown, create the PVs of the assets we have; the next
+		// leader skips those members and provisions the rest.
+		for i, pv := range pvs {
+			if err := createProvisionedPV(pv, owners[i]); err != nil {
+				// Some PVs of the group may exist now; those are skipped on
+				// the next attempt.
+				recordEvent(owners[i], reasonClaimGroupCreatePVFailed, group, err)
+			}
+		}
+	})
+}
+
+// claimGroupKey is the runningProvisioners key of the group of pvc.
+func claimGroupKey(pvc *PVClaim) string {
+	return "group/" + pvc.Namespace + "/" + pvc.Annotations[annClaimGroup]
+}
+
+// BatchProvisioner may be implemented by a ProvisionerPlugin that can
+// create several volumes in one call (fewer cloud API round trips when a
+// StatefulSet creates many identical claims at once).  The results are in
+// the order of opts; each volume succeeds or fails on its own.
+type BatchProvisioner interface {
+	ProvisionBatch(ctx context.Context, opts []ProvisionOptions) ([]*PV, []error)
+}
+
+// Upper limit for the number of claims in a ProvisionBatch call.
+var maxProvisionBatch = 20
+
+// provisionBatch provisions volumes for pvc and the other pending claims
+// that are identical to it (same namespace, class and size) in one
+// ProvisionBatch call.  Claims that are in backoff or already being
+// provisioned are left out.  Each claim gets an idempotency token as in
+// provisionClaim, and a claim that has one already is looked up first
+// (ProvisionedVolumeLookup) instead of being provisioned again; what
+// happens to each volume afterwards is the same, too.  A claim deleted
+// meanwhile only loses its own volume.
+func provisionBatch(pvc *PVClaim, plugin ProvisionerPlugin) {
+	if err := validateClassParameters(plugin, pvc); err != nil {
+		// Same class for the whole batch.
+		recordEvent(pvc, reasonProvisioningFailed, err)
+		return
+	}
+	class := api.GetClass(getClaimClass(pvc))
+	size := pvc.Spec.Resources.Requests[Storage]
+	claims := map[string]*PVClaim{}
+	objectKeys := map[string]string{}
+	for _, c := range api.ListPVCs(pvc.Namespace, func(c *PVClaim) bool {
+		return c.Status.Phase == Pending && c.Spec.VolumePtr == nil &&
+			getClaimClass(c) == class.Name && c.Spec.Resources.Requests[Storage] == size &&
+			!hasAnnotation(c, annClaimGroup) && provisioningBackoff.IsAllowed(c.UID)
+	}) {
+		if len(claims) == maxProvisionBatch {
+			break
+		}
+		claims[string(c.UID)] = c
+		objectKeys[string(c.UID)] = "pvc/" + c.Namespace + "/" + c.Name
+	}
+	if !acquireProvisionerSlot(plugin.Name()) {
+		return
+	}
+	started := runningProvisioners.RunBatch(objectKeys, func(ctx context.Context, members map[string]context.Context) {
+		defer releaseProvisionerSlot(plugin.Name())
+		// finish does what provisionVolume and provisionClaim do with the
+		// result of Provision.
+		finish := func(c *PVClaim, opts ProvisionOptions, pv *PV, err error) {
+			memberCtx := members[string(c.UID)]
+			if err == nil {
+				err = setNodeAffinity(pv, opts)
+			}
+			if err != nil && memberCtx.Err() != nil {
+				// Cancelled, see provisionClaim.
+				return
+			} else if err != nil {
+				metrics.Counter("pv_controller_provision_failures_total", "plugin", plugin.Name(), "class", class.Name).Inc()
+				attempts, next := provisioningBackoff.Failed(c.UID, err)
+				recordEvent(c, reasonProvisioningBackoff, attempts, err, next)
+				return
+			}
+			provisioningBackoff.Forget(c.UID)
+			pv.Name = opts.PVName
+			setAnnotationValue(pv, annDynamicallyProvisioned, plugin.Name())
+			pv.Spec.StorageClassName = opts.Class.Name
+			pv.Spec.ReclaimPolicy = classReclaimPolicy(opts.Class)
+			if memberCtx.Err() != nil && !shuttingDown(memberCtx) {
+				// This claim was deleted; the others keep their volumes.
+				// (On shutdown, the volumes are fine; create the PVs.)
+				deleteLeakedAsset(pv, c)
+				return
+			}
+			pv.Spec.ClaimPtr = claimReference(c)
+			setAnnotation(pv, annBoundByController)
+			if err := createProvisionedPV(pv, c); err != nil {
+				recordEvent(c, reasonCreatePVFailed, err)
+			}
+		}
+		lookup, canLookup := plugin.(ProvisionedVolumeLookup)
+		batch := []*PVClaim{}
+		opts := []ProvisionOptions{}
+		for key, memberCtx := range members {
+			c := claims[key]
+			_, retried := c.Annotations[annProvisioningToken]
+			if !retried {
+				setAnnotationValue(c, annProvisioningToken, pvNamer.PVName(c, class))
+				if err := CommitPVC(c); err != nil {
+					// Leave it for the next batch.
+					continue
+				}
+			}
+			o, err := newProvisionOptions(c, class)
+			if err != nil {
+				recordEvent(c, reasonProvisioningFailed, err)
+				continue
+			}
+			o.Token = c.Annotations[annProvisioningToken]
+			if retried && canLookup {
+				// As in provisionVolume: an earlier batch may have created
+				// the asset, and failed to create its PV.
+				pv, err := lookup.FindProvisioned(memberCtx, o)
+				if err != nil {
+					// We can't tell; don't risk a second copy.
+					recordEvent(c, reasonProvisioningFailed, err)
+					continue
+				}
+				if pv != nil {
+					finish(c, o, pv, nil)
+					continue
+				}
+			}
+			batch = append(batch, c)
+			opts = append(opts, o)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		metrics.Counter("pv_controller_provision_attempts_total", "plugin", plugin.Name(), "class", class.Name).Add(float64(len(opts)))
+		pvs, errs := plugin.(BatchProvisioner).ProvisionBatch(ctx, opts)
+		if len(pvs) != len(batch) || len(errs) != len(batch) {
+			// A broken plugin; we can't tell which volume is whose.  Any
+			// asset it created is found by scanOrphanedAssets.
+			err := fmt.Errorf("plugin %s returned %d volumes and %d errors for a batch of %d", plugin.Name(), len(pvs), len(errs), len(batch))
+			for _, c := range batch {
+				metrics.Counter("pv_controller_provision_failures_total", "plugin", plugin.Name(), "class", class.Name).Inc()
+				attempts, next := provisioningBackoff.Failed(c.UID, err)
+				recordEvent(c, reasonProvisioningBackoff, attempts, err, next)
+			}
+			return
+		}
+		for i, c := range batch {
+			finish(c, opts[i], pvs[i], errs[i])
+		}
+	})
+	if !started {
+		releaseProvisionerSlot(plugin.Name())
+	}
+}
+
+// replacesFailedVolumes returns true if the class of the claim opted in to
+// replacing Failed volumes (class.ReplaceFailedVolumes).
+func replacesFailedVolumes(pvc *PVClaim) bool {
+	class := api.GetClass(getClaimClass(pvc))
+	return class != nil && class.ReplaceFailedVolumes
+}
+
+// replaceFailedVolume provisions a new volume for a bound claim whose volume
+// has failed (optionally restored from the latest snapshot of the failed
+// volume, if class.RestoreFromSnapshot) and rebinds the claim to it.
+//
+// The failed PV is not touched here.  Once the claim points to the new PV,
+// syncPV sees a PV whose claim is bound elsewhere and deletes it (if it was
+// provisioned) or makes it Available again (if it was bound by the
+// controller).  Either way the data on it is gone from the claim's point of
+// view, which is why this is opt-in.
+func replaceFailedVolume(pvc *PVClaim, failed *PV) {
+	class := api.GetClass(getClaimClass(pvc))
+	plugin := findProvisionerPluginForPV(pvc)
+	if plugin == nil {
+		recordEvent(pvc, reasonNoProvisionerForReplacement)
+		return
+	}
+	runProvisioner(plugin, "replace/"+string(pvc.UID), "pvc/"+pvc.Namespace+"/"+pvc.Name, func(ctx context.Context) {
+		var source *Snapshot
+		if class.RestoreFromSnapshot {
+			source = api.FindLatestSnapshot(failed)
+			if source == nil {
+				recordEvent(pvc, reasonNoSnapshotForReplacement)
+			}
+		}
+		opts, err := newProvisionOptions(pvc, class)
+		if err != nil {
+			recordEvent(pvc, reasonReplacementProvisioningFailed, err)
+			return
+		}
+		opts.Source = source
+		// Must differ from the name of the failed PV, which may have been
+		// provisioned for the same claim.  The whole UID: it has no fixed
+		// length, and a prefix of it need not be unique.
+		opts.PVName += "-" + string(failed.UID)
+		pv, err := plugin.Provision(ctx, opts)
+		if err == nil {
+			err = setNodeAffinity(pv, opts)
+		}
+		if err != nil {
+			recordEvent(pvc, reasonReplacementProvisioningFailed, err)
+			return
+		}
+		pv.Name = opts.PVName
+		pv.Spec.ClaimPtr = claimReference(pvc)
+		setAnnotationValue(pv, annDynamicallyProvisioned, plugin.Name())
+		pv.Spec.StorageClassName = opts.Class.Name
+		pv.Spec.ReclaimPolicy = classReclaimPolicy(opts.Class)
+		setAnnotation(pv, annBoundByController)
+		if err := createProvisionedPV(pv, pvc); err != nil {
+			recordEvent(pvc, reasonReplacementCreatePVFailed, err)
+			return
+		}
+		pvc.Spec.VolumePtr = volumeReference(pv)
+		setAnnotation(pvc, annBoundByController)
+		if err := CommitPVC(pvc); err != nil {
+			// The new PV is pre-bound to the claim; the failed PV is still
+			// Failed, so we will end up here again and create yet another
+			// replacement.  The extra one is deleted by syncPV since the
+			// claim will be bound elsewhere.
+			recordEvent(pvc, reasonReplacementRebindFailed, err)
+			return
+		}
+		recordEvent(pvc, reasonReplacedFailedVolume, failed.Name, pv.Name)
+	})
+}
+
+// How long a planned shutdown waits for in-flight operations (a
+// provisioner in a cloud call, a scrubber pod) before cancelling them, and
+// then for the cancelled ones to return.  Together, they must fit in the
+// termination grace period of the controller pod (30s by default), or the
+// kubelet kills us mid-commit anyway.  Set from command line flags.
+var shutdownGracePeriod = 20 * time.Second
+var shutdownCancelGracePeriod = 5 * time.Second
+
+// syncWorkersDone counts the running sync workers.
+var syncWorkersDone sync.WaitGroup
+
+// drainController is called on a planned shutdown, after the context of
+// startController is cancelled.  The informers, periodic jobs and watch
+// handlers stop on their own; the sync workers finish the sync they are in
+// (a sync commits its changes before it returns) and stop.  Operations
+// running in their own goroutines get shutdownGracePeriod to finish; those
+// that do not are cancelled, stop at a point the next leader can resume
+// from (see shuttingDown), and are listed in the handoff record.
+func drainController() {
+	syncWorkersDone.Wait()
+	deadline := clock.Now().Add(shutdownGracePeriod)
+	cancelDeadline := deadline.Add(shutdownCancelGracePeriod)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	keys := []string{}
+	for _, r := range []*operationRegistry{runningProvisioners, runningDeleters, runningRecyclers} {
+		wg.Add(1)
+		go func(r *operationRegistry) {
+			defer wg.Done()
+			unfinished := r.Shutdown(deadline, cancelDeadline)
+			lock.Lock()
+			keys = append(keys, unfinished...)
+			lock.Unlock()
+		}(r)
+	}
+	wg.Wait()
+	publishHandoff(keys)
+	log.Info("controller drained", "unfinishedOperations", len(keys))
+}
+
+// publishHandoff is called on a planned shutdown of the leader.  It writes
+// the keys of the operations that did not finish (provisioning, deleting,
+// recycling) into the handoff record (stored next to the leader lease), so
+// the next leader can check them first.  This is only an optimization: the
+// next leader must still be correct if the record is missing or stale.
+func publishHandoff(keys []string) {
+	if err := WriteHandoffRecord(HandoffRecord{InFlightKeys: keys}); err != nil {
+		// Nothing to do, the next leader will find these in the full resync.
+		log.Error(err, "failed to publish handoff record", "keys", len(keys))
+	}
+}
+
+// lastSeenVersions holds the highest resourceVersion seen for each object
+// key.  A reconnecting watch may replay events we have already seen; acting
+// on them would regress the cache to an old state of the object.
+var lastSeenVersions = struct {
+	lock     sync.Mutex
+	versions map[string]uint64
+}{versions: map[string]uint64{}}
+
+// isStaleEvent returns true if a watch event carries an older
+// resourceVersion than one we already saw for the same object; such events
+// must be dropped.  resourceVersions are opaque in the API, but in practice
+// they are increasing integers (etcd revisions), and nothing else works
+// here.
+func isStaleEvent(key string, resourceVersion string, ev Event) bool {
+	version, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		// Not a number; we can't tell, so trust it.
+		return false
+	}
+	lastSeenVersions.lock.Lock()
+	defer lastSeenVersions.lock.Unlock()
+	if version < lastSeenVersions.versions[key] {
+		metrics.Counter("pv_controller_stale_events_dropped_total").Inc()
+		return true
+	}
+	if ev == DELETE {
+		// The name may be reused by a new object, whose versions start
+		// wherever etcd is then; still higher, but don't keep garbage.
+		delete(lastSeenVersions.versions, key)
+	} else {
+		lastSeenVersions.versions[key] = version
+	}
+	return false
+}
+
+// getPVFromServer reads a PV from the API server.  Unlike GetPVFromServer,
+// it tells a PV that does not exist (nil, nil) from a failed read (nil,
+// err).
+func getPVFromServer(name string) (*PV, error) {
+	pv, err := api.GetPV(name)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	return pv, err
+}
+
+// The sync loops read PVs and PVCs from these informer caches instead of
+// the API server: a full resync would otherwise cost a GET per object and
+// pass.  The caches may be a little behind; that is fine, because the
+// watch brings every change back to us.  Where acting on a stale "not
+// found" would do damage, read from the server (GetPVFromServer).
+var pvInformer = NewSharedInformer(PVs)
+var pvcInformer = NewSharedInformer(PVClaims)
+var pvLister PVLister = pvInformer.Lister()
+var pvcLister PVCLister = pvcInformer.Lister()
+
+// log is the structured, leveled logger of the controller.  Every line about
+// an object carries its name and UID under the same keys ("claim",
+// "claimUID", "volume", "volumeUID"), so that the history of one claim can
+// be found with a single grep.  Levels:
+//
+//	0: errors, and things an admin must know (lost lease)
+//	2: state changes: binding, release, Lost, provisioning
+//	4: every sync, with its result
+//
+// Events are for users; logs are for whoever debugs the controller.
+var log = NewLogger("persistentvolume-controller")
+
+// Sync work is split by sub-controller: the binder syncs claims, the
+// reclaimer syncs volumes (provisioners and deleters run in their own
+// goroutines, with their own limits).  Each has its own queue, so that a
+// flood of reclaim work can't starve binding or vice versa.  The queues hold
+// keys ("pv/<name>" or "pvc/<namespace>/<name>") of objects that need a
+// sync, see syncResult; keys that are added while already queued are
+// coalesced.
+type subsystem struct {
+	name  string
+	queue DelayingQueue
+	// Served when queue is empty, see pendingClaims.
+	pending *classQueues
+	// Out of every sum(weights) keys the workers take while both queues
+	// are busy, at least weight come from this queue.
+	weight int
+}
+
+var binder = &subsystem{name: "binder", queue: NewDelayingQueue(), pending: pendingClaims, weight: 2}
+var reclaimer = &subsystem{name: "reclaimer", queue: NewDelayingQueue(), weight: 1}
+var subsystems = []*subsystem{binder, reclaimer}
+
+// Number of workers shared by all subsystems; see ControllerOptions.
+var syncWorkers = 4
+
+// workAvailable is signalled whenever a key is added to any queue.
+var workAvailable = make(chan struct{}, 1)
+
+// enqueue adds a key to the queue of the subsystem that owns it, after
+// delay.
+func enqueue(key string, delay time.Duration) {
+	s := reclaimer
+	if strings.HasPrefix(key, "pvc/") {
+		s = binder
+	}
+	s.queue.AddAfter(key, delay, notifyWorkers)
+}
+
+func notifyWorkers() {
+	select {
+	case workAvailable <- struct{}{}:
+	default:
+	}
+}
+
+// runSyncWorker serves the subsystems by weighted round robin: in each
+// round it takes up to weight keys from each queue.  A subsystem with
+// nothing to do gives its share to the others.  Once ctx is cancelled, it
+// returns after the sync it is in; keys left in the queues are found again
+// by the next leader's resync.
+func runSyncWorker(ctx context.Context) {
+	defer syncWorkersDone.Done()
+	for ctx.Err() == nil {
+		served := 0
+		for _, s := range subsystems {
+			for i := 0; i < s.weight && ctx.Err() == nil; i++ {
+				key, queuedAt, ok := s.queue.TryGet()
+				if !ok && s.pending != nil {
+					// Keys from watch events first; the pending claims
+					// are resync work.
+					if pvc := s.pending.Next(); pvc != nil {
+						syncKey("pvc/" + pvc.Namespace + "/" + pvc.Name)
+						served++
+						continue
+					}
+				}
+				if !ok {
+					break
+				}
+				metrics.Histogram("pv_controller_queue_latency_seconds", "subsystem", s.name).Observe(clock.Since(queuedAt).Seconds())
+				syncKey(key)
+				s.queue.Done(key)
+				served++
+			}
+		}
+		if served == 0 {
+			select {
+			case <-workAvailable:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func syncKey(key string) {
+	if pause := apiBreaker.Open(); pause > 0 {
+		// Not through requeue: this is not a failure of this object.
+		enqueue(key, pause)
+		return
+	}
+	// The shard is checked again: the class may have been relabeled since
+	// the key was queued.
+	if pv := pvLister.GetByKey(key); pv != nil {
+		if volumeInShard(pv) {
+			unlock := objectLocks.Lock(key, pairedKey("pvc/", pv.Spec.ClaimPtr))
+			defer unlock()
+			syncPVAndRequeue(pv)
+		}
+	} else if pvc := pvcLister.GetByKey(key); pvc != nil {
+		if claimInShard(pvc) {
+			unlock := objectLocks.Lock(key, pairedKey("pv/", pvc.Spec.VolumePtr))
+			defer unlock()
+			syncPVCAndRequeue(pvc)
+		}
+	}
+	// else the object was deleted in the meantime; nothing to do.
+}
+
+// pairedKey returns the queue key of the object at the other end of a
+// pointer ("pv/" or "pvc/" prefix), or "" if there is none.
+func pairedKey(prefix string, ref *ObjectReference) string {
+	switch {
+	case ref == nil:
+		return ""
+	case ref.Namespace == "":
+		return prefix + ref.Name
+	default:
+		return prefix + ref.Namespace + "/" + ref.Name
+	}
+}
+
+// objectLocks serializes the syncs that touch the same objects.  The queue
+// never hands the same key to two workers, but syncPVC commits the PV as
+// well as the claim, and syncPV the claim as well as the PV; without the
+// lock, the two ends of a binding can be written by two workers at once,
+// and their commits interleave (the resourceVersion check catches a lost
+// update of one object, not a half-done pair).  A sync holds the locks of
+// its object and of the one it points to.
+//
+// OBSERVATION: operations in their own goroutines (provisioners, deleters,
+// recyclers) do not take these locks: they run for minutes.  They
+// re-read what they commit, and the resourceVersion check does the rest.
+var objectLocks = newKeyLocks()
+
+type keyLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// Holders and waiters; the entry is removed at zero.
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*keyLock{}}
+}
+
+// Lock locks all keys ("" is skipped) and returns the function that unlocks
+// them.  Keys are always locked in sorted order, so two callers that want
+// the same pair can't deadlock.
+func (k *keyLocks) Lock(keys ...string) (unlock func()) {
+	sorted := []string{}
+	for _, key := range keys {
+		if key != "" && !slices.Contains(sorted, key) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		k.get(key).Lock()
+	}
+	return func() {
+		for _, key := range sorted {
+			k.release(key)
+		}
+	}
+}
+
+// TryLock locks key if nobody holds it.  Unlike Lock, it is safe to call
+// while holding other locks.
+func (k *keyLocks) TryLock(key string) (unlock func(), ok bool) {
+	if !k.get(key).TryLock() {
+		k.put(key)
+		return nil, false
+	}
+	return func() { k.release(key) }, true
+}
+
+func (k *keyLocks) get(key string) *keyLock {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	l, found := k.locks[key]
+	if !found {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// put drops a reference taken by get.
+func (k *keyLocks) put(key string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if l := k.locks[key]; l != nil {
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+func (k *keyLocks) release(key string) {
+	k.lock.Lock()
+	l := k.locks[key]
+	k.lock.Unlock()
+	l.Unlock()
+	k.put(key)
+}
+
+func syncPVCAndRequeue(pvc *PVClaim) {
+	key := "pvc/" + pvc.Namespace + "/" + pvc.Name
+	result := syncRecovered(key, pvc, func() syncResult { return SyncPVC(pvc) })
+	log.V(4).Info("synced claim", "claim", pvc.Namespace+"/"+pvc.Name, "claimUID", pvc.UID, "phase", pvc.Status.Phase, "requeueAfter", result.requeueAfter)
+	requeue(key, result)
+}
+
+func syncPVAndRequeue(pv *PV) {
+	key := "pv/" + pv.Name
+	result := syncRecovered(key, pv, func() syncResult { return syncPV(pv) })
+	log.V(4).Info("synced volume", "volume", pv.Name, "volumeUID", pv.UID, "phase", pv.Status.Phase, "requeueAfter", result.requeueAfter)
+	requeue(key, result)
+}
+
+// syncFailures counts, per key, the syncs in a row that failed on an API
+// error.  An object that keeps failing (e.g. a webhook rejects every
+// update) is retried with exponential backoff instead of every
+// retryAfterAPIError.
+var syncFailures = struct {
+	lock     sync.Mutex
+	failures map[string]int
+}{failures: map[string]int{}}
+
+// requeue queues key again as result asks, rate limited.
+func requeue(key string, result syncResult) {
+	syncFailures.lock.Lock()
+	delay := result.requeueAfter
+	if result.failed {
+		syncFailures.failures[key]++
+		delay = retryAfterAPIError << (syncFailures.failures[key] - 1)
+		if delay > maxBackoff || delay <= 0 {
+			delay = maxBackoff
+		}
+	} else {
+		delete(syncFailures.failures, key)
+	}
+	syncFailures.lock.Unlock()
+	if delay > 0 {
+		enqueue(key, delay)
+	}
+}
+
+func forgetSyncFailures(key string) {
+	syncFailures.lock.Lock()
+	defer syncFailures.lock.Unlock()
+	delete(syncFailures.failures, key)
+}
+
+// A key whose sync panicked is quarantined (not synced) for
+// initialQuarantine, doubled with each further panic up to maxQuarantine.
+const (
+	initialQuarantine = time.Minute
+	maxQuarantine     = time.Hour
+)
+
+// quarantine holds the keys of objects whose sync panicked.  One malformed
+// object must not take the whole controller down with it, again and again.
+var quarantine = struct {
+	lock    sync.Mutex
+	entries map[string]*backoffEntry
+}{entries: map[string]*backoffEntry{}}
+
+// syncRecovered calls sync unless key is quarantined, and quarantines key
+// if sync panics.
+func syncRecovered(key string, obj Object, sync func() syncResult) (result syncResult) {
+	quarantine.lock.Lock()
+	entry, quarantined := quarantine.entries[key]
+	quarantine.lock.Unlock()
+	if quarantined && clock.Now().Before(entry.nextRetry) {
+		return requeueAfter(entry.nextRetry.Sub(clock.Now()))
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			if quarantined {
+				// It worked this time (the object was fixed).
+				quarantine.lock.Lock()
+				delete(quarantine.entries, key)
+				quarantine.lock.Unlock()
+			}
+			return
+		}
+		quarantine.lock.Lock()
+		defer quarantine.lock.Unlock()
+		entry, found := quarantine.entries[key]
+		if !found {
+			entry = &backoffEntry{}
+			quarantine.entries[key] = entry
+		}
+		entry.failures++
+		entry.lastError = fmt.Errorf("%v", r)
+		delay := initialQuarantine << (entry.failures - 1)
+		if delay > maxQuarantine || delay <= 0 {
+			delay = maxQuarantine
+		}
+		entry.nextRetry = clock.Now().Add(delay)
+		log.Error(fmt.Errorf("%v", r), "sync panicked", "key", key, "quarantinedUntil", entry.nextRetry, "stack", string(debug.Stack()))
+		recordEvent(obj, reasonSyncPanicked, key, r, entry.nextRetry)
+		metrics.Counter("pv_controller_sync_panics_total").Inc()
+		result = requeueAfter(delay)
+	}()
+	return sync()
+}
+
+// cachesSynced returns true once both informer caches hold a full list.
+// Before that, a partial cache would make claims look unbound and volumes
+// look unclaimed, so nothing may iterate over them.  (Single objects from
+// watch events are fine: they are real.)
+func cachesSynced() bool {
+	return pvInformer.HasSynced() && pvcInformer.HasSynced()
+}
+
+// syncAllPVCs queues all claims: the pending ones through pendingClaims, for
+// fairness between classes, the others directly.  The binder's workers take
+// the pending claims one by one; the queue stays visible on
+// /debug/pending-claims until they do.
+func syncAllPVCs() {
+	if !cachesSynced() {
+		return
+	}
+	for _, pvc := range pvcLister.List() {
+		if !claimInShard(pvc) {
+			continue
+		}
+		if !hasAnnotation(pvc, annWasEverBound) {
+			pendingClaims.Add(pvc)
+		} else {
+			enqueue("pvc/"+pvc.Namespace+"/"+pvc.Name, 0)
+		}
+	}
+	notifyWorkers()
+}
+
+// pendingClaims holds claims that have not completed binding, with one FIFO
+// sub-queue per storage class (getClaimClass; "" is a class too).  A single
+// queue would let one noisy class (e.g. a burst of claims whose provisioner
+// is slow) starve everybody else.
+//
+// The class of a claim that does not ask for one is the default class, which
+// the admin can change while the claim is queued.  So the class a claim is
+// queued under is recorded on Add, and Remove goes by that; adding the claim
+// again with a different class moves it.
+var pendingClaims = newClassQueues()
+
+type classQueues struct {
+	lock   sync.Mutex
+	queues map[string][]*PVClaim
+	// The class each queued claim is queued under.
+	classes map[UID]string
+	// Classes in the order they will be served; a class is appended when
+	// its queue becomes non-empty.
+	order []string
+}
+
+func newClassQueues() *classQueues {
+	return &classQueues{queues: map[string][]*PVClaim{}, classes: map[UID]string{}}
+}
+
+// Add appends a claim to its class's queue, unless it is already queued
+// there.  A claim queued under another class is moved.
+func (q *classQueues) Add(pvc *PVClaim) {
+	class := getClaimClass(pvc)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if queued, found := q.classes[pvc.UID]; found {
+		if queued == class {
+			return
+		}
+		q.remove(pvc.UID, queued)
+	}
+	if len(q.queues[class]) == 0 {
+		q.order = append(q.order, class)
+	}
+	q.queues[class] = append(q.queues[class], pvc)
+	q.classes[pvc.UID] = class
+}
+
+// Remove removes a claim from the queue it was added to, if it is queued.
+func (q *classQueues) Remove(pvc *PVClaim) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if class, found := q.classes[pvc.UID]; found {
+		q.remove(pvc.UID, class)
+	}
+}
+
+func (q *classQueues) remove(uid UID, class string) {
+	delete(q.classes, uid)
+	queue := slices.DeleteFunc(q.queues[class], func(queued *PVClaim) bool {
+		return queued.UID == uid
+	})
+	if len(queue) > 0 {
+		q.queues[class] = queue
+		return
+	}
+	delete(q.queues, class)
+	q.order = slices.DeleteFunc(q.order, func(c string) bool { return c == class })
+}
+
+// pendingClaimInfo describes a queued claim for operators.
+type pendingClaimInfo struct {
+	Claim        string // namespace/name
+	Class        string
+	Position     int // 0 is next to be synced, across all classes
+	Attempts     int
+	BackoffUntil time.Time
+}
+
+// Snapshot returns the queued claims of each class in the order they will be
+// synced, taking round-robin between classes into account.
+func (q *classQueues) Snapshot() map[string][]pendingClaimInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	result := map[string][]pendingClaimInfo{}
+	// Simulate Next on copies of the queues.
+	order := append([]string{}, q.order...)
+	heads := map[string]int{}
+	for position := 0; len(order) > 0; position++ {
+		class := order[0]
+		order = order[1:]
+		pvc := q.queues[class][heads[class]]
+		heads[class]++
+		if heads[class] < len(q.queues[class]) {
+			order = append(order, class)
+		}
+		attempts, until := provisioningAttempts(pvc)
+		result[class] = append(result[class], pendingClaimInfo{
+			Claim:        pvc.Namespace + "/" + pvc.Name,
+			Class:        class,
+			Position:     position,
+			Attempts:     attempts,
+			BackoffUntil: until,
+		})
+	}
+	return result
+}
+
+// Next removes and returns the next claim, taking one claim from each class
+// in turn (round-robin), so claims of different classes make progress
+// independently.  Returns nil if all queues are empty.
+func (q *classQueues) Next() *PVClaim {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.order) == 0 {
+		return nil
+	}
+	class := q.order[0]
+	q.order = q.order[1:]
+	pvc := q.queues[class][0]
+	q.queues[class] = q.queues[class][1:]
+	delete(q.classes, pvc.UID)
+	if len(q.queues[class]) > 0 {
+		// Back of the line for this class.
+		q.order = append(q.order, class)
+	} else {
+		delete(q.queues, class)
+	}
+	return pvc
+}
+
+// provisioningAttempts returns how many times provisioning failed for a
+// claim and when the next attempt is allowed.
+func provisioningAttempts(pvc *PVClaim) (int, time.Time) {
+	return provisioningBackoff.Get(pvc.UID)
+}
+
+// Failed provisioning is retried after initialBackoff, doubled with each
+// further failure up to maxBackoff.
+const (
+	initialBackoff = 5 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// provisioningBackoff tracks failed Provision calls per claim UID.  It lives
+// in memory only; after a restart every claim gets one immediate attempt.
+var provisioningBackoff = newBackoff()
+
+type backoffEntry struct {
+	failures  int
+	lastError error
+	nextRetry time.Time
+}
+
+type backoff struct {
+	lock    sync.Mutex
+	entries map[UID]*backoffEntry
+}
+
+func newBackoff() *backoff {
+	return &backoff{entries: map[UID]*backoffEntry{}}
+}
+
+// IsAllowed returns true if there is no pending backoff for uid, i.e. from
+// the time of the next allowed attempt on.
+func (b *backoff) IsAllowed(uid UID) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, found := b.entries[uid]
+	return !found || !clock.Now().Before(entry.nextRetry)
+}
+
+// Failed records a failure and returns the number of failures so far and the
+// time of the next allowed attempt.
+func (b *backoff) Failed(uid UID, err error) (int, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, found := b.entries[uid]
+	if !found {
+		entry = &backoffEntry{}
+		b.entries[uid] = entry
+	}
+	entry.failures++
+	entry.lastError = err
+	delay := initialBackoff << (entry.failures - 1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	entry.nextRetry = clock.Now().Add(delay)
+	return entry.failures, entry.nextRetry
+}
+
+// Get returns the number of failures and the time of the next allowed
+// attempt for uid.
+func (b *backoff) Get(uid UID) (int, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if entry, found := b.entries[uid]; found {
+		return entry.failures, entry.nextRetry
+	}
+	return 0, time.Time{}
+}
+
+// Forget must be called when an operation succeeds or its object is
+// deleted.
+func (b *backoff) Forget(uid UID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.entries, uid)
+}
+
+// Snapshot returns the state of all entries, by UID.
+func (b *backoff) Snapshot() map[string]backoffInfo {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	snapshot := map[string]backoffInfo{}
+	for uid, entry := range b.entries {
+		snapshot[string(uid)] = entry.info()
+	}
+	return snapshot
+}
+
+// servePendingClaims serves "who's next in line for provisioning" per class,
+// e.g. GET /debug/pending-claims?class=gold.
+func servePendingClaims(w ResponseWriter, r *Request) {
+	snapshot := pendingClaims.Snapshot()
+	if class, found := r.Query["class"]; found {
+		WriteJSON(w, snapshot[class])
+		return
+	}
+	WriteJSON(w, snapshot)
+}
+
+// PrintPendingClaims prints an answer of /debug/pending-claims, for all
+// classes or for one, as a table in the order the claims will be synced.
+// It is the output of the pending-claims command of the controller binary,
+// which fetches the answer from a running instance.
+func PrintPendingClaims(out io.Writer, body []byte) error {
+	var claims []pendingClaimInfo
+	var byClass map[string][]pendingClaimInfo
+	if err := json.Unmarshal(body, &byClass); err == nil {
+		for _, classClaims := range byClass {
+			claims = append(claims, classClaims...)
+		}
+	} else if err := json.Unmarshal(body, &claims); err != nil {
+		return fmt.Errorf("not an answer of /debug/pending-claims: %v", err)
+	}
+	slices.SortFunc(claims, func(a, b pendingClaimInfo) int { return a.Position - b.Position })
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tCLASS\tCLAIM\tATTEMPTS\tBACKOFF UNTIL")
+	for _, claim := range claims {
+		backoffUntil := "-"
+		if !claim.BackoffUntil.IsZero() {
+			backoffUntil = claim.BackoffUntil.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", claim.Position, claim.Class, claim.Claim, claim.Attempts, backoffUntil)
+	}
+	return w.Flush()
+}
+
+// controllerState is what serveState dumps.  Each part is copied under its
+// own lock, so the parts may be a few milliseconds apart.
+type controllerState struct {
+	PendingClaims map[string][]pendingClaimInfo
+	// Unbound claims by class, as seen by enqueueClaimsFor.
+	UnboundClaims map[string][]string
+	// Operation key -> object key, per kind of operation.
+	Operations map[string]map[string]string
+	// Object key (or UID, for the operation backoffs) -> state, per kind.
+	Backoffs    map[string]map[string]backoffInfo
+	Quarantined map[string]backoffInfo
+	// Zero when the API breaker is closed.
+	SyncsPausedFor time.Duration
+}
+
+type backoffInfo struct {
+	Failures  int
+	LastError string `json:",omitempty"`
+	NextRetry time.Time
+}
+
+func (e *backoffEntry) info() backoffInfo {
+	info := backoffInfo{Failures: e.failures, NextRetry: e.nextRetry}
+	if e.lastError != nil {
+		info.LastError = e.lastError.Error()
+	}
+	return info
+}
+
+// serveState dumps the internal state of the controller, for
+// troubleshooting a live instance: GET /debug/state.  The same is logged
+// on SIGUSR1, for when the debug port is not reachable.
+func serveState(w ResponseWriter, r *Request) {
+	WriteJSON(w, dumpState())
+}
+
+func logState() {
+	log.Info("controller state", "state", dumpState())
+}
+
+func dumpState() controllerState {
+	state := controllerState{
+		PendingClaims: pendingClaims.Snapshot(),
+		UnboundClaims: unboundClaims.Snapshot(),
+		Operations: map[string]map[string]string{
+			"provision": runningProvisioners.Snapshot(),
+			"delete":    runningDeleters.Snapshot(),
+			"recycle":   runningRecyclers.Snapshot(),
+		},
+		Backoffs: map[string]map[string]backoffInfo{
+			"provision": provisioningBackoff.Snapshot(),
+			"delete":    deletionBackoff.Snapshot(),
+			"recycle":   recyclingBackoff.Snapshot(),
+			"sync":      {},
+		},
+		Quarantined:    map[string]backoffInfo{},
+		SyncsPausedFor: apiBreaker.Open(),
+	}
+	syncFailures.lock.Lock()
+	for key, failures := range syncFailures.failures {
+		state.Backoffs["sync"][key] = backoffInfo{Failures: failures}
+	}
+	syncFailures.lock.Unlock()
+	quarantine.lock.Lock()
+	for key, entry := range quarantine.entries {
+		state.Quarantined[key] = entry.info()
+	}
+	quarantine.lock.Unlock()
+	return state
+}
+
+// Thresholds for aggregate conditions that operators want to hear about,
+// for clusters without an external alerting stack.  Zero disables a
+// threshold.  Set from command line flags.
+var alertFailedPVs = 0
+var alertPendingClaims = 0
+var alertPendingClaimsAge = 10 * time.Minute
+
+// How often the alert thresholds are evaluated.  Set from a command line
+// flag.
+var alertInterval = 15 * time.Second
+
+// AlertHook is called when an aggregate condition crosses its threshold,
+// and again when it clears.  Embedders can set it; the --alert-webhook flag
+// sets it to a function that POSTs the alert as JSON.
+var AlertHook func(alert Alert)
+
+type Alert struct {
+	Name      string // "FailedPVs" or "PendingClaims"
+	Value     int
+	Threshold int
+	Firing    bool
+}
+
+// Alerts that are currently firing, so the hook is only called on changes.
+// The lock is held while the hook runs, so that its calls are never
+// reordered.
+var firingAlerts = struct {
+	lock   sync.Mutex
+	firing map[string]bool
+}{firing: map[string]bool{}}
+
+// evaluateAlerts computes the aggregate conditions from the cache, over the
+// objects of this shard.  A partial cache would make the numbers wrong, so
+// nothing is evaluated until it is synced.
+func evaluateAlerts() {
+	if AlertHook == nil || !cachesSynced() {
+		return
+	}
+	failed := 0
+	for _, pv := range pvLister.List() {
+		if pv.Status.Phase == Failed && volumeInShard(pv) {
+			failed++
+		}
+	}
+	pending := 0
+	for _, pvc := range pvcLister.List() {
+		if pvc.Status.Phase == Pending && hasExpired(pvc.CreationTimestamp.Add(alertPendingClaimsAge)) && claimInShard(pvc) {
+			pending++
+		}
+	}
+	checkAlert("FailedPVs", failed, alertFailedPVs)
+	checkAlert("PendingClaims", pending, alertPendingClaims)
+}
+
+func checkAlert(name string, value, threshold int) {
+	if threshold == 0 {
+		return
+	}
+	firing := value > threshold
+	firingAlerts.lock.Lock()
+	defer firingAlerts.lock.Unlock()
+	if firing == firingAlerts.firing[name] {
+		return
+	}
+	firingAlerts.firing[name] = firing
+	AlertHook(Alert{Name: name, Value: value, Threshold: threshold, Firing: firing})
+}
+
+// syncAllPVs queues all volumes.
+func syncAllPVs() {
+	if !cachesSynced() {
+		return
+	}
+	for _, pv := range pvLister.List() {
+		if volumeInShard(pv) {
+			enqueue("pv/"+pv.Name, 0)
+		}
+	}
+}
+
+// logResyncSummary logs, once per full resync, how many objects are
+// failing: those whose last syncs failed on API errors (see requeue) and
+// those quarantined after a panic.  Syncs happen in the workers, so this
+// reports the state left by the previous pass.
+func logResyncSummary() {
+	syncFailures.lock.Lock()
+	failing := len(syncFailures.failures)
+	syncFailures.lock.Unlock()
+	quarantine.lock.Lock()
+	quarantined := len(quarantine.entries)
+	quarantine.lock.Unlock()
+	if failing > 0 || quarantined > 0 {
+		log.Info("objects failing to sync", "failing", failing, "quarantined", quarantined)
+	} else {
+		log.V(4).Info("all objects synced")
+	}
+	metrics.Gauge("pv_controller_failing_objects").Set(float64(failing))
+	metrics.Gauge("pv_controller_quarantined_objects").Set(float64(quarantined))
+}
+
+// If set, the controller refuses claims that were pre-bound by the user (i.e.
+// pvc.Spec.VolumePtr is set but annBoundByController is not); all binding
+// must go through the controller.  Classes can request the same behavior
+// individually via class.StrictBinding.
+var strictBinding = false
+
+func isStrictBinding(pvc *PVClaim) bool {
+	if strictBinding {
+		return true
+	}
+	class := api.GetClass(getClaimClass(pvc))
+	return class != nil && class.StrictBinding
+}
+
+// BindMutator lets embedders change a PV and PVC while they are being bound,
+// before anything is committed (e.g. set mount options from claim labels).
+// Mutators may only change bindMutableFields; a mutator that touches
+// anything else, returns an error or panics fails the binding, which is
+// retried later.
+type BindMutator interface {
+	Name() string
+	MutateBind(pv *PV, pvc *PVClaim) error
+}
+
+// bindMutators is filled by RegisterBindMutator at controller start and
+// read-only afterwards.  Mutators run in registration order.
+var bindMutators []BindMutator
+
+// RegisterBindMutator must be called before initController.
+func RegisterBindMutator(mutator BindMutator) {
+	bindMutators = append(bindMutators, mutator)
+}
+
+// runBindMutators runs all mutators on copies of pv and pvc, and copies the
+// results back only if every mutator behaved.
+func runBindMutators(pv *PV, pvc *PVClaim) error {
+	for _, mutator := range bindMutators {
+		newPV, newPVC := pv.DeepCopy(), pvc.DeepCopy()
+		if err := callBindMutator(mutator, newPV, newPVC); err != nil {
+			return fmt.Errorf("%s: %v", mutator.Name(), err)
+		}
+		if err := checkBindMutation(pv, newPV, pvc, newPVC); err != nil {
+			return fmt.Errorf("%s: %v", mutator.Name(), err)
+		}
+		*pv, *pvc = *newPV, *newPVC
+	}
+	return nil
+}
+
+// callBindMutator isolates the controller from panicking mutators.
+func callBindMutator(mutator BindMutator, pv *PV, pvc *PVClaim) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return mutator.MutateBind(pv, pvc)
+}
+
+// checkBindMutation returns an error if a mutator changed anything but
+// bindMutableFields: PV mount options, and annotations and labels of both
+// objects, except the annotations owned by the controller.
+func checkBindMutation(oldPV, newPV *PV, oldPVC, newPVC *PVClaim) error {
+	for _, ann := range controllerAnnotations {
+		if oldPV.Annotations[ann] != newPV.Annotations[ann] || oldPVC.Annotations[ann] != newPVC.Annotations[ann] {
+			return fmt.Errorf("annotation %s is owned by the controller", ann)
+		}
+	}
+	// Compare everything else with the mutable fields reset.
+	newPV, newPVC = newPV.DeepCopy(), newPVC.DeepCopy()
+	newPV.Spec.MountOptions = oldPV.Spec.MountOptions
+	newPV.Annotations, newPV.Labels = oldPV.Annotations, oldPV.Labels
+	newPVC.Annotations, newPVC.Labels = oldPVC.Annotations, oldPVC.Labels
+	if !objectMetaEqual(oldPV.ObjectMeta, newPV.ObjectMeta) || !pvSpecEqual(oldPV.Spec, newPV.Spec) || !pvStatusEqual(oldPV.Status, newPV.Status) {
+		return fmt.Errorf("only mount options, annotations and labels of the PV may be changed")
+	}
+	if !objectMetaEqual(oldPVC.ObjectMeta, newPVC.ObjectMeta) || !pvcSpecEqual(oldPVC.Spec, newPVC.Spec) || !pvcStatusEqual(oldPVC.Status, newPVC.Status) {
+		return fmt.Errorf("only annotations and labels of the PVC may be changed")
+	}
+	return nil
+}
+
+// controllerAnnotations must not be touched by bind mutators.
+var controllerAnnotations = []string{
+	annWasEverBound,
+	annBoundByController,
+	annClass,
+	annDynamicallyProvisioned,
+	annStorageProvisioner,
+	annProvisioningToken,
+	annClaimGroup,
+	annClaimGroupSize,
+	annDeleteApproved,
+	annDeletionRequested,
+	annArchivedAs,
+	annRecycleRequested,
+	annRecycleCompleted,
+}
+
+// VolumePlugin tells which mount options the kubelet's volume plugin for a
+// volume source type accepts.
+type VolumePlugin interface {
+	Name() string
+	SupportsMountOptions() bool
+	IsValidMountOption(option string) bool
+}
+
+// volumePlugins is filled by RegisterVolumePlugin at controller start and
+// read-only afterwards.  Keyed by volume source type, like deleterPlugins.
+var volumePlugins = map[string]VolumePlugin{}
+
+// RegisterVolumePlugin must be called before initController.  Only one
+// plugin may handle a volume source type.
+func RegisterVolumePlugin(sourceType string, plugin VolumePlugin) {
+	if existing, found := volumePlugins[sourceType]; found {
+		panic(fmt.Sprintf("volume plugins %s and %s both registered for volume source %s", existing.Name(), plugin.Name(), sourceType))
+	}
+	volumePlugins[sourceType] = plugin
+}
+
+// findVolumePluginForPV returns the plugin that mounts pv, or nil if there
+// is none.  CSI drivers check mount options themselves.
+func findVolumePluginForPV(pv *PV) VolumePlugin {
+	if pv.Spec.CSI != nil {
+		return nil
+	}
+	return volumePlugins[volumeSourceType(pv)]
+}
+
+// validateMountOptions checks pv.Spec.MountOptions against the capabilities
+// of the volume plugin that will mount the PV.  Invalid combinations must be
+// caught at bind time; otherwise the kubelet fails later, when the user can
+// no longer pick a different PV.
+func validateMountOptions(pv *PV) error {
+	if len(pv.Spec.MountOptions) == 0 {
+		return nil
+	}
+	plugin := findVolumePluginForPV(pv)
+	if plugin == nil {
+		// We can't tell; let the kubelet decide.
+		return nil
+	}
+	if !plugin.SupportsMountOptions() {
+		return fmt.Errorf("volume plugin %s does not support mount options", plugin.Name())
+	}
+	for _, opt := range pv.Spec.MountOptions {
+		if !plugin.IsValidMountOption(opt) {
+			return fmt.Errorf("mount option %q is not supported by volume plugin %s", opt, plugin.Name())
+		}
+	}
+	return nil
+}
+
+// If set, no volumes are provisioned; claims are only bound to existing
+// PVs.  Classes can disable provisioning individually via
+// class.ProvisioningDisabled.
+var provisioningDisabled = false
+
+func isProvisioningDisabled(pvc *PVClaim) bool {
+	if provisioningDisabled {
+		return true
+	}
+	class := api.GetClass(getClaimClass(pvc))
+	return class != nil && class.ProvisioningDisabled
+}
+
+// checkProvisioningQuota returns an error if provisioning a volume for pvc
+// would exceed the provisioning quota of its namespace (total capacity or
+// number of provisioned volumes), as configured by the admin.  Volumes being
+// provisioned right now are not counted, so a burst of claims can overshoot
+// the quota by up to maxProvisionersPerPlugin volumes.
+func checkProvisioningQuota(pvc *PVClaim) error {
+	quota := api.GetProvisioningQuota(pvc.Namespace)
+	if quota == nil {
+		return nil
+	}
+	count := 0
+	capacity := int64(0)
+	for _, pv := range pvLister.List() {
+		if hasAnnotation(pv, annDynamicallyProvisioned) && pv.Spec.ClaimPtr != nil && pv.Spec.ClaimPtr.Namespace == pvc.Namespace {
+			count++
+			capacity += pv.Spec.Capacity
+		}
+	}
+	requested := pvc.Spec.Resources.Requests[Storage]
+	if quota.MaxVolumes > 0 && count+1 > quota.MaxVolumes {
+		return fmt.Errorf("%d of %d volumes used", count, quota.MaxVolumes)
+	}
+	if quota.MaxCapacity > 0 && capacity+requested > quota.MaxCapacity {
+		return fmt.Errorf("%d of %d bytes used, %d requested", capacity, quota.MaxCapacity, requested)
+	}
+	return nil
+}
+
+// checkClassSizeLimits returns an error if the size requested by the claim is
+// outside of class.MinClaimSize and class.MaxClaimSize (either may be unset).
+func checkClassSizeLimits(pvc *PVClaim) error {
+	class := api.GetClass(getClaimClass(pvc))
+	if class == nil {
+		return nil
+	}
+	size := pvc.Spec.Resources.Requests[Storage]
+	if class.MinClaimSize != nil && size < *class.MinClaimSize {
+		return fmt.Errorf("requested size %d is smaller than the minimum %d of class %s", size, *class.MinClaimSize, class.Name)
+	}
+	if class.MaxClaimSize != nil && size > *class.MaxClaimSize {
+		return fmt.Errorf("requested size %d is larger than the maximum %d of class %s", size, *class.MaxClaimSize, class.Name)
+	}
+	return nil
+}
+
+// How the class of a claim was resolved, see resolveClaimClass.
+const (
+	// The user asked for the class (field or annotation).
+	classResolvedExplicit = "Explicit"
+	// The class is the default class of the namespace or cluster.
+	classResolvedDefault = "Default"
+	// The class is the controller's fallback class.
+	classResolvedFallback = "Fallback"
+)
+
+// getClaimClass returns the storage class that applies to a claim.
+func getClaimClass(pvc *PVClaim) string {
+	class, _ := resolveClaimClass(pvc)
+	return class
+}
+
+// resolveClaimClass returns the storage class that applies to a claim and
+// how it was resolved.  The StorageClassName field takes precedence over the
+// legacy annClass annotation; if they disagree, the annotation is ignored.
+// Claims that ask for neither get the default class, or else the fallback
+// class.
+func resolveClaimClass(pvc *PVClaim) (class string, mode string) {
+	if pvc.Spec.StorageClassName != "" {
+		return pvc.Spec.StorageClassName, classResolvedExplicit
+	}
+	if hasAnnotation(pvc, annClass) {
+		return pvc.Annotations[annClass], classResolvedExplicit
+	}
+	if class := api.GetDefaultClass(); class != nil {
+		// The class marked as default by the admin.  If several are, the
+		// admin made a mistake; GetDefaultClass returns nil then.
+		return class.Name, classResolvedDefault
+	}
+	if fallbackClass != "" {
+		return fallbackClass, classResolvedFallback
+	}
+	return "", ""
+}
+
+// The class used for claims that don't ask for one when no class is marked
+// as default.  Empty means claims without a class are only bound to
+// existing PVs without a class and never provisioned.  Set from a command
+// line flag.
+var fallbackClass = ""
+
+// recordResolvedClass writes the class that applied to the claim, and how it
+// was resolved, into the claim status.  The caller must commit the status.
+// This is done at bind and provision time, so users can see which class
+// was actually used.  Returns true if the status was changed.
+func recordResolvedClass(pvc *PVClaim) bool {
+	class, mode := resolveClaimClass(pvc)
+	if pvc.Status.ResolvedClass == class && pvc.Status.ResolvedClassMode == mode {
+		return false
+	}
+	pvc.Status.ResolvedClass = class
+	pvc.Status.ResolvedClassMode = mode
+	metrics.Counter("pv_controller_class_resolutions_total", "mode", mode).Inc()
+	return true
+}
+
+// The *Equal helpers decide whether a Commit is needed: they return true if
+// committing one value over the other would change nothing.  Use them at
+// every "commit only if changed" site; comparing single fields (e.g. only
+// the phase) silently breaks when fields are added, which is why they
+// compare everything except the fields the API server manages:
+//   - metadata.resourceVersion, creationTimestamp and deletionTimestamp;
+//   - metadata.managedFields, which ObjectMeta does not even have;
+//   - the LastTransitionTime of status conditions, which setCondition
+//     derives from the condition's status.
+// The fuzz tests in controller_test.go check that every other field counts.
+
+func pvSpecEqual(a, b PVSpec) bool {
+	return semanticDeepEqual(a, b)
+}
+
+func pvStatusEqual(a, b PVStatus) bool {
+	a.Conditions, b.Conditions = withoutTransitionTimes(a.Conditions), withoutTransitionTimes(b.Conditions)
+	return semanticDeepEqual(a, b)
+}
+
+func pvcSpecEqual(a, b PVClaimSpec) bool {
+	return semanticDeepEqual(a, b)
+}
+
+func pvcStatusEqual(a, b PVClaimStatus) bool {
+	a.Conditions, b.Conditions = withoutTransitionTimes(a.Conditions), withoutTransitionTimes(b.Conditions)
+	return semanticDeepEqual(a, b)
+}
+
+func objectMetaEqual(a, b ObjectMeta) bool {
+	a.ResourceVersion, b.ResourceVersion = "", ""
+	a.CreationTimestamp, b.CreationTimestamp = time.Time{}, time.Time{}
+	a.DeletionTimestamp, b.DeletionTimestamp = nil, nil
+	return semanticDeepEqual(a, b)
+}
+
+// withoutTransitionTimes returns a copy of conditions with
+// LastTransitionTime cleared.
+func withoutTransitionTimes(conditions []Condition) []Condition {
+	conditions = slices.Clone(conditions)
+	for i := range conditions {
+		conditions[i].LastTransitionTime = time.Time{}
+	}
+	return conditions
+}
+
+// semanticDeepEqual is reflect.DeepEqual, except that a nil map or slice
+// equals an empty one (the API server returns either for "none"), and
+// times are compared with time.Time.Equal (the server drops the location
+// and the monotonic reading).
+func semanticDeepEqual(a, b any) bool {
+	return semanticEqual(reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func semanticEqual(a, b reflect.Value) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			value := b.MapIndex(key)
+			if !value.IsValid() || !semanticEqual(a.MapIndex(key), value) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !semanticEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return semanticEqual(a.Elem(), b.Elem())
+	case reflect.Struct:
+		if a.Type() == timeType {
+			return a.Interface().(time.Time).Equal(b.Interface().(time.Time))
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if !semanticEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
+
+// If set, Released volumes with the Delete reclaim policy are only deleted
+// after approval (annDeleteApproved).  Classes can request the same
+// individually via class.RequireDeleteApproval.
+var requireDeleteApproval = false
+
+// How long to wait for approval, and what to do when nobody approved in
+// time: "Retain" keeps the volume Released forever, "Delete" deletes it
+// anyway.
+var deleteApprovalTimeout = 72 * time.Hour
+var deleteApprovalTimeoutAction = "Retain"
+
+func requiresDeleteApproval(pv *PV) bool {
+	if requireDeleteApproval {
+		return true
+	}
+	class := api.GetClass(pv.Spec.StorageClassName)
+	return class != nil && class.RequireDeleteApproval
+}
+
+// waitForDeleteApproval sets the AwaitingApproval condition on a Released
+// PV that needs approval before deletion.  Returns true if the deletion may
+// proceed anyway because approval timed out; otherwise the caller must
+// return result.
+func waitForDeleteApproval(pv *PV) (bool, syncResult) {
+	condition := pv.Status.GetCondition("AwaitingApproval")
+	if condition == nil {
+		pv.Status.SetCondition("AwaitingApproval", "True", message(reasonAwaitingApproval, annDeleteApproved))
+		if err := CommitPVStatus(pv); err != nil {
+			return false, commitFailed(err)
+		}
+		recordEvent(pv, reasonWaitingForApproval)
+		return false, requeueAfter(deleteApprovalTimeout)
+	}
+	if !hasExpired(condition.LastTransitionTime.Add(deleteApprovalTimeout)) {
+		// Adding the annotation triggers a watch event; this is only for
+		// the timeout.
+		return false, requeueAfter(deleteApprovalTimeout)
+	}
+	if deleteApprovalTimeoutAction == "Delete" {
+		recordEvent(pv, reasonApprovalTimeoutDelete)
+		return true, done
+	}
+	recordEvent(pv, reasonApprovalTimeoutRetain)
+	return false, done
+}
+
+func hasAnnotation(obj Object, ann string) bool {
+	_, found := obj.GetObjectMeta().Annotations[ann]
+	return found
+}
+
+func setAnnotation(obj Object, ann string) {
+	setAnnotationValue(obj, ann, "yes")
+}
+
+func setAnnotationValue(obj Object, ann, value string) {
+	meta := obj.GetObjectMeta()
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[ann] = value
+}
+
+func hasFinalizer(obj Object, finalizer string) bool {
+	for _, f := range obj.GetObjectMeta().Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func addFinalizer(obj Object, finalizer string) {
+	if !hasFinalizer(obj, finalizer) {
+		meta := obj.GetObjectMeta()
+		meta.Finalizers = append(meta.Finalizers, finalizer)
+	}
+}
+
+func removeFinalizer(obj Object, finalizer string) {
+	meta := obj.GetObjectMeta()
+	kept := []string{}
+	for _, f := range meta.Finalizers {
+		if f != finalizer {
+			kept = append(kept, f)
+		}
+	}
+	meta.Finalizers = kept
+}
+
+// removePVProtection removes finalizerPVProtection from pv, if it is there.
+func removePVProtection(pv *PV) error {
+	if !hasFinalizer(pv, finalizerPVProtection) {
+		return nil
+	}
+	// Called from deleter goroutines too, which have no sync to retry them.
+	return updatePVWithRetry(pv, func(pv *PV) error {
+		removeFinalizer(pv, finalizerPVProtection)
+		return nil
+	})
+}
+
+// FindAcceptablePV looks for a PV that matches the PVC.
+//   - The class of the PVC is read with getClaimClass(), never from the
+//     annotation or the field directly.
+//   - A PV that is pre-bound to the PVC is returned as the top priority.
+//   - Placeholder PVs from Kubernetes 1.2 are ignored, see isPlaceholderPV()
+//     below!  They are pre-bound to the PVC!
+//   - Claims with annClaimGroup only match PVs pre-bound to them; binding a
+//     member of a group to an existing PV would break the group.
+//   - PVs whose Spec.AllowedClaimNamespaces do not include the namespace of
+//     the PVC never match, see isClaimNamespaceAllowed().
+//   - PVs reserved with labelReservation only match claims with the same
+//     token, see isReservationAllowed(); a claim with a token prefers the
+//     PVs reserved for it over all other PVs (except pre-bound ones).
+//   - PVs with mount options their volume plugin rejects never match, see
+//     validateMountOptions(); otherwise the claim would be matched to the
+//     same unusable PV on every retry.  (A pre-bound PV is still returned;
+//     SyncPVC refuses to bind it with an event.)
+//   - Otherwise, the smallest matching volume is returned; ties are broken
+//     by isBetterMatch().
+func FindAcceptablePV(pvc *PVC) *PV {
+	return findAcceptablePV(pvc, pvLister.List())
+}
+
+func findAcceptablePV(pvc *PVC, pvs []*PV) *PV {
+	class := getClaimClass(pvc)
+	size := pvc.Spec.Resources.Requests[Storage]
+	var best *PV
+	bestReserved := false
+	for _, pv := range pvs {
+		if isPlaceholderPV(pv) {
+			continue
+		}
+		if pv.Spec.ClaimPtr != nil {
+			if refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) {
+				return pv
+			}
+			continue
+		}
+		if hasAnnotation(pvc, annClaimGroup) || pv.Spec.StorageClassName != class || pv.Spec.Capacity < size ||
+			!isClaimNamespaceAllowed(pv, pvc) || !isReservationAllowed(pv, pvc) || validateMountOptions(pv) != nil {
+			continue
+		}
+		reserved := isReservedFor(pv, pvc)
+		if best == nil || (reserved && !bestReserved) || (reserved == bestReserved && isBetterMatch(pv, best)) {
+			best, bestReserved = pv, reserved
+		}
+	}
+	return best
+}
+
+// This label applies to PVs and PVCs.  Storage admins provision volumes
+// ahead of time and label them with a reservation token; claims created
+// later with the same token bind to those volumes, and nothing else does.
+const labelReservation = "pv.kubernetes.io/reservation"
+
+// isReservationAllowed returns true if the controller may bind pv to pvc
+// with respect to labelReservation: a reserved PV is exclusive to claims
+// with the same token.
+func isReservationAllowed(pv *PV, pvc *PVClaim) bool {
+	token, reserved := pv.Labels[labelReservation]
+	if !reserved {
+		return true
+	}
+	return pvc.Labels[labelReservation] == token
+}
+
+// isReservedFor returns true if pv is reserved for pvc, i.e. the matcher
+// must prefer it.
+func isReservedFor(pv *PV, pvc *PVClaim) bool {
+	token, found := pvc.Labels[labelReservation]
+	return found && pv.Labels[labelReservation] == token
+}
+
+// ValidateClaimReservation is called on admission of a PVC.  It rejects
+// malformed tokens, and claims that are pre-bound to a PV reserved with a
+// different token (they could never bind).
+func ValidateClaimReservation(pvc *PVClaim) error {
+	token, found := pvc.Labels[labelReservation]
+	if !found {
+		return nil
+	}
+	if errs := IsValidLabelValue(token); len(errs) > 0 || token == "" {
+		return fmt.Errorf("invalid reservation token %q", token)
+	}
+	if pvc.Spec.VolumePtr != nil {
+		if pv := pvLister.Get(pvc.Spec.VolumePtr.Name); pv != nil && !isReservationAllowed(pv, pvc) {
+			return fmt.Errorf("PV %s is reserved with a different token", pv.Name)
+		}
+	}
+	return nil
+}
+
+// isBetterMatch returns true if PV a should be chosen over PV b, both of
+// which match the claim.  The result must never depend on the order in
+// which the PVs were listed (i.e. map iteration order), so this is a
+// behavioral guarantee:
+//  1. the smaller volume wins,
+//  2. then the older volume (CreationTimestamp) wins,
+//  3. then the volume whose name sorts first wins.
+//
+// Names are unique, so this is a total order.
+func isBetterMatch(a, b *PV) bool {
+	if a.Spec.Capacity != b.Spec.Capacity {
+		return a.Spec.Capacity < b.Spec.Capacity
+	}
+	if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// isClaimNamespaceAllowed returns true if the controller may bind pv to pvc
+// with respect to pv.Spec.AllowedClaimNamespaces.  An empty list means any
+// namespace.
+func isClaimNamespaceAllowed(pv *PV, pvc *PVClaim) bool {
+	if len(pv.Spec.AllowedClaimNamespaces) == 0 {
+		return true
+	}
+	for _, ns := range pv.Spec.AllowedClaimNamespaces {
+		if ns == pvc.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// FIXME: remove in Kubernetes 1.4 (or do we support upgrade 1.2 -> 1.4?)
+func isPlaceholderPV(pv *PV) bool {
+	const annPlaceholderProvisioningRequired = "volume.experimental.kubernetes.io/provisioning-required"
+	const provisioningCompleted = "volume.experimental.kubernetes.io/provisioning-completed"
+	return hasAnnotation(pv, annPlaceholderProvisioningRequired) && pv.Annotations[annPlaceholderProvisioningRequired] != provisioningCompleted
+}
+
+// upgradePVFrom12 upgrades a PV from old Kubernetes version.
+// FIXME: remove in Kubernetes 1.4 (or do we support upgrade 1.2 -> 1.4?)
+func upgradePVFrom12(pv *PV) (deleted bool, err error) {
+	// In the old 1.2 version we created placeholder PVs before provisioning.
+	// We should delete those and let the controller provision a new one.
+
+	if isPlaceholderPV(pv) {
+		if err := api.DeletePV(pv); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Leader leases, timestamps on API objects (creation times, condition
+// transitions) and the creation times of storage assets are written by
+// other clocks: another controller instance, the API server, a storage
+// backend.  We cannot fix the clocks, but we can notice when they disagree
+// and be conservative about it: compare such times with hasExpired.
+// In-memory deadlines (backoffs, quarantines, the API breaker) are written
+// and read by our own clock only and compare with clock.Now() directly.
+
+// Expiry comparisons always allow for at least this much skew between
+// instances.
+const minClockSkewSlack = 2 * time.Second
+
+// Skew beyond this is reported, once each time it is crossed in either
+// direction.
+const maxTolerableClockSkew = 10 * time.Second
+
+// Clock is what the controller reads the time from: the resync and other
+// periodic jobs tick on it, backoffs and quarantines compute their retry
+// times with it, and timeouts (recycleTimeout, the shutdown grace periods)
+// expire by it.  Never call time.Now() and friends directly.
+//
+// OBSERVATION: the delays of the work queues and the leader lease are on
+// the system clock; they belong to the client library.  Tests drive
+// syncKey directly and don't need them.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	// WithDeadline is context.WithDeadline on this clock.
+	WithDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Until(t time.Time) time.Duration        { return time.Until(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) WithDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(ctx, deadline)
+}
+
+var clock Clock = realClock{}
+
+// The last observed difference between the API server clock and ours
+// (server - local), in nanoseconds.  Updated from every API response that
+// carries a Date header, on the goroutine of the request.
+var observedClockSkew atomic.Int64
+
+// observeServerTime is called by the client (ClientConfig.OnServerTime)
+// with the Date of each API server response.
+func observeServerTime(serverNow time.Time) {
+	skew := serverNow.Sub(clock.Now())
+	observedClockSkew.Store(int64(skew))
+	metrics.Gauge("pv_controller_clock_skew_seconds").Set(skew.Seconds())
+	tooLarge := absDuration(skew) > maxTolerableClockSkew
+	if clockSkewReported.Swap(tooLarge) == tooLarge {
+		// Reported already; this is called for every response.
+		return
+	}
+	if tooLarge {
+		// Leases are not trustworthy if this persists.
+		recordEvent(nil, reasonClockSkew, skew)
+	} else {
+		recordEvent(nil, reasonClockSkewResolved, maxTolerableClockSkew)
+	}
+}
+
+// Whether the skew last observed was beyond maxTolerableClockSkew.
+var clockSkewReported atomic.Bool
+
+// clockSlack is the margin every expiry comparison must add.
+func clockSlack() time.Duration {
+	return max(minClockSkewSlack, absDuration(time.Duration(observedClockSkew.Load())))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// hasExpired reports whether a timestamp written by (possibly) another
+// instance is in the past.  Use this instead of comparing with clock.Now()
+// directly: it errs on the side of "not expired yet".
+func hasExpired(deadline time.Time) bool {
+	return clock.Now().After(deadline.Add(clockSlack()))
 }
@@ -0,0 +1,1568 @@
+package persistentvolume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPV(name, class string, capacity int64, created time.Time) *PV {
+	pv := &PV{ObjectMeta: ObjectMeta{Name: name, UID: UID(name + "-uid"), CreationTimestamp: created}}
+	pv.Spec.StorageClassName = class
+	pv.Spec.Capacity = capacity
+	return pv
+}
+
+func testClaim(namespace, name, class string, size int64) *PVClaim {
+	pvc := &PVClaim{ObjectMeta: ObjectMeta{Namespace: namespace, Name: name, UID: UID(name + "-uid")}}
+	pvc.Spec.StorageClassName = class
+	pvc.Spec.Resources.Requests = map[ResourceName]int64{Storage: size}
+	return pvc
+}
+
+// testVolumePlugin supports no mount options.
+type testVolumePlugin struct{}
+
+func (testVolumePlugin) Name() string                   { return "test" }
+func (testVolumePlugin) SupportsMountOptions() bool     { return false }
+func (testVolumePlugin) IsValidMountOption(string) bool { return false }
+
+func TestFindAcceptablePV(t *testing.T) {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	claim := testClaim("ns", "claim", "gold", 10)
+
+	preBound := testPV("pre-bound", "gold", 100, t0)
+	preBound.Spec.ClaimPtr = &ObjectReference{Namespace: "ns", Name: "claim"}
+	boundElsewhere := testPV("bound-elsewhere", "gold", 10, t0)
+	boundElsewhere.Spec.ClaimPtr = &ObjectReference{Namespace: "ns", Name: "other", UID: "other-uid"}
+	placeholder := testPV("placeholder", "gold", 10, t0)
+	placeholder.Annotations = map[string]string{"volume.experimental.kubernetes.io/provisioning-required": "yes"}
+	placeholder.Spec.ClaimPtr = claimReference(claim)
+	otherNamespace := testPV("other-namespace", "gold", 10, t0)
+	otherNamespace.Spec.AllowedClaimNamespaces = []string{"other"}
+	reservedForOthers := testPV("reserved-for-others", "gold", 10, t0)
+	reservedForOthers.Labels = map[string]string{labelReservation: "theirs"}
+	reservedForClaim := testPV("reserved-for-claim", "gold", 100, t0)
+	reservedForClaim.Labels = map[string]string{labelReservation: "ours"}
+
+	// The "nfs" plugin (see below) rejects mount options.
+	badMountOptions := testPV("bad-mount-options", "gold", 10, t0)
+	badMountOptions.Spec.NFS = &NFSVolumeSource{Server: "server", Path: "/a"}
+	badMountOptions.Spec.MountOptions = []string{"hard"}
+
+	reservingClaim := testClaim("ns", "claim", "gold", 10)
+	reservingClaim.Labels = map[string]string{labelReservation: "ours"}
+	groupClaim := testClaim("ns", "claim", "gold", 10)
+	groupClaim.Annotations = map[string]string{annClaimGroup: "db"}
+
+	tests := []struct {
+		name     string
+		claim    *PVClaim
+		pvs      []*PV
+		expected string // "" for no match
+	}{
+		{
+			name:     "nothing",
+			claim:    claim,
+			expected: "",
+		},
+		{
+			name:     "too small",
+			claim:    claim,
+			pvs:      []*PV{testPV("small", "gold", 5, t0)},
+			expected: "",
+		},
+		{
+			name:     "other class",
+			claim:    claim,
+			pvs:      []*PV{testPV("silver", "silver", 10, t0)},
+			expected: "",
+		},
+		{
+			name:     "smallest wins",
+			claim:    claim,
+			pvs:      []*PV{testPV("big", "gold", 100, t0), testPV("fits", "gold", 10, t0), testPV("medium", "gold", 50, t0)},
+			expected: "fits",
+		},
+		{
+			name:     "same size: oldest wins",
+			claim:    claim,
+			pvs:      []*PV{testPV("a-new", "gold", 10, t0.Add(time.Hour)), testPV("b-old", "gold", 10, t0)},
+			expected: "b-old",
+		},
+		{
+			name:     "same size and age: first name wins",
+			claim:    claim,
+			pvs:      []*PV{testPV("b", "gold", 10, t0), testPV("a", "gold", 10, t0)},
+			expected: "a",
+		},
+		{
+			name:     "pre-bound wins over smaller",
+			claim:    claim,
+			pvs:      []*PV{testPV("fits", "gold", 10, t0), preBound},
+			expected: "pre-bound",
+		},
+		{
+			name:     "bound elsewhere",
+			claim:    claim,
+			pvs:      []*PV{boundElsewhere},
+			expected: "",
+		},
+		{
+			name:     "placeholder ignored",
+			claim:    claim,
+			pvs:      []*PV{placeholder},
+			expected: "",
+		},
+		{
+			name:     "namespace not allowed",
+			claim:    claim,
+			pvs:      []*PV{otherNamespace},
+			expected: "",
+		},
+		{
+			name:     "reserved for another token",
+			claim:    reservingClaim,
+			pvs:      []*PV{reservedForOthers},
+			expected: "",
+		},
+		{
+			name:     "reserved for the claim wins over smaller",
+			claim:    reservingClaim,
+			pvs:      []*PV{testPV("fits", "gold", 10, t0), reservedForClaim},
+			expected: "reserved-for-claim",
+		},
+		{
+			name:     "reserved PV needs the token",
+			claim:    claim,
+			pvs:      []*PV{reservedForClaim},
+			expected: "",
+		},
+		{
+			name:     "invalid mount options",
+			claim:    claim,
+			pvs:      []*PV{badMountOptions, testPV("bigger", "gold", 50, t0)},
+			expected: "bigger",
+		},
+		{
+			name:     "group member: unbound PVs don't match",
+			claim:    groupClaim,
+			pvs:      []*PV{testPV("fits", "gold", 10, t0)},
+			expected: "",
+		},
+	}
+	volumePlugins = map[string]VolumePlugin{"nfs": testVolumePlugin{}}
+	defer func() { volumePlugins = map[string]VolumePlugin{} }()
+	for _, test := range tests {
+		// The result must not depend on the order of the list.
+		reversed := slices.Clone(test.pvs)
+		slices.Reverse(reversed)
+		for _, pvs := range [][]*PV{test.pvs, reversed} {
+			got := ""
+			if pv := findAcceptablePV(test.claim, pvs); pv != nil {
+				got = pv.Name
+			}
+			if got != test.expected {
+				t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+			}
+		}
+	}
+}
+
+// fuzzBytes feeds fuzzFill.  Once it runs out, it returns 1: every pointer
+// is set and every map and slice has one element, so that the seed corpus
+// (no bytes at all) reaches every field.
+type fuzzBytes []byte
+
+func (b *fuzzBytes) next() byte {
+	if len(*b) == 0 {
+		return 1
+	}
+	c := (*b)[0]
+	*b = (*b)[1:]
+	return c
+}
+
+// fuzzFill sets everything reachable from v from data.
+func fuzzFill(v reflect.Value, data *fuzzBytes) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(rune('a' + data.next()%26)))
+	case reflect.Bool:
+		v.SetBool(data.next()%2 == 1)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(data.next()))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(data.next()))
+	case reflect.Pointer:
+		if data.next()%4 != 0 {
+			v.Set(reflect.New(v.Type().Elem()))
+			fuzzFill(v.Elem(), data)
+		}
+	case reflect.Slice:
+		n := int(data.next() % 3)
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			fuzzFill(v.Index(i), data)
+		}
+	case reflect.Map:
+		n := int(data.next() % 3)
+		v.Set(reflect.MakeMap(v.Type()))
+		for i := 0; i < n; i++ {
+			key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+			fuzzFill(key, data)
+			fuzzFill(value, data)
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			v.Set(reflect.ValueOf(time.Unix(int64(data.next()), 0)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			fuzzFill(v.Field(i), data)
+		}
+	}
+}
+
+// mutateLeaf changes the n-th string, number, bool or time reachable from v
+// and returns its path (field names only); "" if there are not that many.
+func mutateLeaf(v reflect.Value, path string, n *int) string {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		if *n > 0 {
+			*n--
+			return ""
+		}
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(v.String() + "x")
+		case reflect.Bool:
+			v.SetBool(!v.Bool())
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(v.Float() + 1)
+		default:
+			v.SetInt(v.Int() + 1)
+		}
+		return path
+	case reflect.Pointer:
+		if v.IsNil() {
+			return ""
+		}
+		return mutateLeaf(v.Elem(), path, n)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if p := mutateLeaf(v.Index(i), path, n); p != "" {
+				return p
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if p := mutateLeaf(value, path, n); p != "" {
+				v.SetMapIndex(key, value)
+				return p
+			}
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			if *n > 0 {
+				*n--
+				return ""
+			}
+			v.Set(reflect.ValueOf(v.Interface().(time.Time).Add(time.Second)))
+			return path
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if p := mutateLeaf(v.Field(i), strings.TrimPrefix(path+"."+v.Type().Field(i).Name, "."), n); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// fuzzEqual checks an *Equal helper: a value equals an identical one, and
+// changing any single field makes it unequal, unless the field is one of
+// the ignored ones.  A field added to the type is covered without touching
+// the test: the empty seed sets every field.
+func fuzzEqual[T any](f *testing.F, equal func(a, b T) bool, ignored ...string) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{2, 7, 3, 2, 0, 1, 5, 9, 2, 2, 4})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fill := func() T {
+			var v T
+			bytes := fuzzBytes(data)
+			fuzzFill(reflect.ValueOf(&v).Elem(), &bytes)
+			return v
+		}
+		a := fill()
+		if !equal(a, fill()) {
+			t.Fatalf("%+v is not equal to itself", a)
+		}
+		for n := 0; ; n++ {
+			b := fill()
+			i := n
+			path := mutateLeaf(reflect.ValueOf(&b).Elem(), "", &i)
+			if path == "" {
+				break
+			}
+			if expected := slices.Contains(ignored, path); equal(a, b) != expected {
+				t.Errorf("changed %s: expected equal=%v", path, expected)
+			}
+		}
+	})
+}
+
+func FuzzPVSpecEqual(f *testing.F) {
+	fuzzEqual(f, pvSpecEqual)
+}
+
+func FuzzPVStatusEqual(f *testing.F) {
+	fuzzEqual(f, pvStatusEqual, "Conditions.LastTransitionTime")
+}
+
+func FuzzPVCSpecEqual(f *testing.F) {
+	fuzzEqual(f, pvcSpecEqual)
+}
+
+func FuzzPVCStatusEqual(f *testing.F) {
+	fuzzEqual(f, pvcStatusEqual, "Conditions.LastTransitionTime")
+}
+
+func FuzzObjectMetaEqual(f *testing.F) {
+	fuzzEqual(f, objectMetaEqual, "ResourceVersion", "CreationTimestamp", "DeletionTimestamp")
+}
+
+func TestSemanticDeepEqual(t *testing.T) {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		a, b     any
+		expected bool
+	}{
+		{"nil and empty map", PVClaimSpec{}, PVClaimSpec{Resources: ResourceRequirements{Requests: map[ResourceName]int64{}}}, true},
+		{"nil and empty slice", PVSpec{}, PVSpec{MountOptions: []string{}}, true},
+		{"nil and empty pointer", PVSpec{}, PVSpec{ClaimPtr: &ObjectReference{}}, false},
+		{"same time, other location", ObjectMeta{DeletionTimestamp: &t0}, ObjectMeta{DeletionTimestamp: ptrTo(t0.In(time.FixedZone("x", 3600)))}, true},
+		{"map entry missing", map[string]string{"a": ""}, map[string]string{"b": ""}, false},
+		{"order of a slice", []string{"a", "b"}, []string{"b", "a"}, false},
+	}
+	for _, test := range tests {
+		if got := semanticDeepEqual(test.a, test.b); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+func TestIsNodeAffinityWithin(t *testing.T) {
+	zone := func(zones ...string) TopologySelectorTerm {
+		return TopologySelectorTerm{MatchLabelExpressions: map[string][]string{"zone": zones}}
+	}
+	in := func(key string, values ...string) NodeSelectorRequirement {
+		return NodeSelectorRequirement{Key: key, Operator: "In", Values: values}
+	}
+	affinity := func(terms ...NodeSelectorTerm) *VolumeNodeAffinity {
+		return &VolumeNodeAffinity{Required: &NodeSelector{Terms: terms}}
+	}
+	tests := []struct {
+		name       string
+		affinity   *VolumeNodeAffinity
+		topologies []TopologySelectorTerm
+		expected   bool
+	}{
+		{"no affinity", nil, []TopologySelectorTerm{zone("a")}, false},
+		{"same zone", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "a")}}), []TopologySelectorTerm{zone("a")}, true},
+		{"narrower", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "a"), in("rack", "1")}}), []TopologySelectorTerm{zone("a", "b")}, true},
+		{"other zone", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "c")}}), []TopologySelectorTerm{zone("a"), zone("b")}, false},
+		{"one term outside", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "a")}}, NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "c")}}), []TopologySelectorTerm{zone("a")}, false},
+		{"wider", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{in("zone", "a", "c")}}), []TopologySelectorTerm{zone("a")}, false},
+		{"NotIn", affinity(NodeSelectorTerm{[]NodeSelectorRequirement{{Key: "zone", Operator: "NotIn", Values: []string{"c"}}}}), []TopologySelectorTerm{zone("a")}, false},
+		{"from the topologies", nodeAffinityFromTopologies([]TopologySelectorTerm{zone("a"), zone("b")}), []TopologySelectorTerm{zone("a"), zone("b")}, true},
+	}
+	for _, test := range tests {
+		if got := isNodeAffinityWithin(test.affinity, test.topologies); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+// Every pair of phases, against the transitions documented in types.go.
+// Staying in a phase is always allowed.
+func TestPhaseTransitions(t *testing.T) {
+	phases := []Phase{"", Pending, Available, Bound, Released, Failed, Lost}
+	pvAllowed := map[[2]Phase]bool{
+		{"", Available}: true, {"", Bound}: true, {"", Released}: true,
+		{Available, Bound}: true, {Available, Released}: true,
+		{Bound, Released}: true, {Bound, Available}: true,
+		{Released, Available}: true, {Released, Failed}: true,
+		{Failed, Available}: true,
+	}
+	claimAllowed := map[[2]Phase]bool{
+		{"", Pending}: true, {"", Bound}: true, {"", Lost}: true,
+		{Pending, Bound}: true, {Pending, Lost}: true,
+		{Bound, Lost}: true,
+		{Lost, Bound}: true,
+	}
+	for _, from := range phases {
+		for _, to := range phases {
+			want := from == to || pvAllowed[[2]Phase{from, to}]
+			if err := ValidatePVPhaseTransition(from, to); (err == nil) != want {
+				t.Errorf("volume %q -> %q: expected allowed=%v, got %v", from, to, want, err)
+			}
+			want = from == to || claimAllowed[[2]Phase{from, to}]
+			if err := ValidateClaimPhaseTransition(from, to); (err == nil) != want {
+				t.Errorf("claim %q -> %q: expected allowed=%v, got %v", from, to, want, err)
+			}
+		}
+	}
+}
+
+// An illegal phase change is not written; a legal one is.
+func TestCommitStatusPhaseTransition(t *testing.T) {
+	store := newFakeStore(t)
+	pv := testPV("volume", "gold", 10, time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC))
+	pv.Status.Phase = Bound
+	store.AddPV(pv)
+	claim := testClaim("ns", "claim", "gold", 10)
+	claim.Status.Phase = Bound
+	store.AddPVC(claim)
+
+	pv = store.PV("volume")
+	pv.Status.Phase = Failed
+	if err := CommitPVStatus(pv); err == nil {
+		t.Errorf("expected Bound -> Failed refused")
+	}
+	claim = store.PVC("ns", "claim")
+	claim.Status.Phase = Pending
+	if err := CommitPVCStatus(claim); err == nil {
+		t.Errorf("expected Bound -> Pending refused")
+	}
+	if writes := store.Writes(); len(writes) != 0 {
+		t.Errorf("expected no writes, got %v", writes)
+	}
+
+	pv.Status.Phase = Released
+	if err := CommitPVStatus(pv); err != nil {
+		t.Errorf("expected Bound -> Released written, got %v", err)
+	}
+	claim.Status.Phase = Lost
+	if err := CommitPVCStatus(claim); err != nil {
+		t.Errorf("expected Bound -> Lost written, got %v", err)
+	}
+	expected := []string{"update-status pv/volume", "update-status pvc/ns/claim"}
+	if writes := store.Writes(); !slices.Equal(writes, expected) {
+		t.Errorf("expected writes %v, got %v", expected, writes)
+	}
+}
+
+func TestCommitPatchHelpers(t *testing.T) {
+	tests := []struct {
+		patch    string
+		empty    bool
+		expected string
+	}{
+		{`{}`, true, `{"metadata":{"resourceVersion":"42"}}`},
+		{` { } `, true, `{"metadata":{"resourceVersion":"42"}}`},
+		{`{"spec":{"claimRef":null}}`, false, `{"metadata":{"resourceVersion":"42"},"spec":{"claimRef":null}}`},
+		{`{"metadata":{"annotations":{"a":"b"}}}`, false, `{"metadata":{"annotations":{"a":"b"},"resourceVersion":"42"}}`},
+	}
+	for _, test := range tests {
+		if got := isEmptyPatch([]byte(test.patch)); got != test.empty {
+			t.Errorf("isEmptyPatch(%s): expected %v, got %v", test.patch, test.empty, got)
+		}
+		got, err := addResourceVersionToPatch([]byte(test.patch), "42")
+		if err != nil || string(got) != test.expected {
+			t.Errorf("addResourceVersionToPatch(%s): expected %s, got %s, %v", test.patch, test.expected, got, err)
+		}
+	}
+}
+
+func TestClassQueues(t *testing.T) {
+	q := newClassQueues()
+	a, b, c := testClaim("ns", "a", "gold", 1), testClaim("ns", "b", "gold", 1), testClaim("ns", "c", "silver", 1)
+	q.Add(a)
+	q.Add(b)
+	q.Add(c)
+	q.Add(a)
+	// The class of a changes while it is queued (as the default class of
+	// a claim without one can): it moves to the back of the new class.
+	moved := a.DeepCopy()
+	moved.Spec.StorageClassName = "silver"
+	q.Add(moved)
+	// Removing b does not need its class to be unchanged either.
+	renamed := b.DeepCopy()
+	renamed.Spec.StorageClassName = "bronze"
+	q.Remove(renamed)
+
+	got := []string{}
+	for pvc := q.Next(); pvc != nil; pvc = q.Next() {
+		got = append(got, pvc.Name+"/"+getClaimClass(pvc))
+	}
+	if expected := []string{"c/silver", "a/silver"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if len(q.queues) != 0 || len(q.classes) != 0 || len(q.order) != 0 {
+		t.Errorf("not empty after Next: %+v", q)
+	}
+}
+
+func TestPrintPendingClaims(t *testing.T) {
+	newFakeClock(t)
+	newOperations(t)
+	q := newClassQueues()
+	a, b, c := testClaim("ns", "a", "gold", 1), testClaim("ns", "b", "gold", 1), testClaim("ns", "c", "silver", 1)
+	q.Add(a)
+	q.Add(b)
+	q.Add(c)
+	provisioningBackoff.Failed(b.UID, errors.New("quota exceeded"))
+	snapshot := q.Snapshot()
+
+	for _, test := range []struct {
+		name     string
+		answer   any
+		expected string
+	}{
+		{"all classes", snapshot, `POSITION  CLASS   CLAIM  ATTEMPTS  BACKOFF UNTIL
+0         gold    ns/a   0         -
+1         silver  ns/c   0         -
+2         gold    ns/b   1         2016-05-01T00:00:05Z
+`},
+		{"one class", snapshot["gold"], `POSITION  CLASS  CLAIM  ATTEMPTS  BACKOFF UNTIL
+0         gold   ns/a   0         -
+2         gold   ns/b   1         2016-05-01T00:00:05Z
+`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := json.Marshal(test.answer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			if err := PrintPendingClaims(&out, body); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.expected {
+				t.Errorf("expected\n%s\ngot\n%s", test.expected, out.String())
+			}
+		})
+	}
+	if err := PrintPendingClaims(io.Discard, []byte("404 page not found")); err == nil {
+		t.Errorf("expected an error for an answer that is not JSON")
+	}
+}
+
+// syncUntilDone calls sync, as the queue would, until it returns done or
+// asks to wait for the user; it returns the results.  Syncs that keep
+// asking for a retry fail the test.
+func syncUntilDone(t *testing.T, sync func() syncResult) []syncResult {
+	t.Helper()
+	results := []syncResult{}
+	for range 10 {
+		result := sync()
+		results = append(results, result)
+		if result == done || result.requeueAfter >= retryAfterUserError {
+			return results
+		}
+	}
+	t.Fatalf("no end in sight: %+v", results)
+	return nil
+}
+
+func syncClaimFromCache(t *testing.T, namespace, name string) func() syncResult {
+	return func() syncResult {
+		pvc := pvcLister.Get(namespace, name)
+		if pvc == nil {
+			t.Fatalf("claim %s/%s is gone", namespace, name)
+		}
+		return SyncPVC(pvc)
+	}
+}
+
+func syncVolumeFromCache(t *testing.T, name string) func() syncResult {
+	return func() syncResult {
+		pv := pvLister.Get(name)
+		if pv == nil {
+			return done
+		}
+		return syncPV(pv)
+	}
+}
+
+// checkBound fails the test unless the claim and the volume are bound to
+// each other.
+func checkBound(t *testing.T, store *fakeStore, namespace, claimName, volumeName string) {
+	t.Helper()
+	pvc, pv := store.PVC(namespace, claimName), store.PV(volumeName)
+	if pv.Spec.ClaimPtr == nil || !refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) || pv.Status.Phase != Bound {
+		t.Errorf("volume not bound to claim: %+v %+v", pv.Spec.ClaimPtr, pv.Status)
+	}
+	if pvc.Spec.VolumePtr == nil || !refersTo(pvc.Spec.VolumePtr, &pv.ObjectMeta) || pvc.Status.Phase != Bound || !hasAnnotation(pvc, annWasEverBound) {
+		t.Errorf("claim not bound to volume: %+v %+v %v", pvc.Spec.VolumePtr, pvc.Status, pvc.Annotations)
+	}
+}
+
+func TestSyncPVCBind(t *testing.T) {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// The claim is pre-bound to the volume.
+		preBound bool
+		// The first attempt of this write fails.
+		failVerb, failKey string
+		err               error
+		expected          syncResult
+	}{
+		{
+			name:     "no failure",
+			expected: done,
+		},
+		{
+			name:     "claim finalizer fails",
+			failVerb: "update", failKey: "pvc/ns/claim",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+		{
+			name:     "volume pointer conflicts",
+			failVerb: "update", failKey: "pv/volume",
+			err:      NewConflict("pv", "volume"),
+			expected: requeueAfter(retryAfterConflict),
+		},
+		{
+			name:     "volume pointer fails",
+			failVerb: "update", failKey: "pv/volume",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+		{
+			name:     "volume status fails",
+			failVerb: "update-status", failKey: "pv/volume",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+		{
+			name:     "claim status fails",
+			failVerb: "update-status", failKey: "pvc/ns/claim",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+		{
+			name:     "pre-bound: volume pointer fails",
+			preBound: true,
+			failVerb: "update", failKey: "pv/volume",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+		{
+			name:     "pre-bound: claim status fails",
+			preBound: true,
+			failVerb: "update-status", failKey: "pvc/ns/claim",
+			err:      errFakeAPI,
+			expected: apiFailed(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeStore(t)
+			claim := testClaim("ns", "claim", "gold", 10)
+			if test.preBound {
+				claim.Spec.VolumePtr = &ObjectReference{Name: "volume"}
+			}
+			store.AddPVC(claim)
+			store.AddPV(testPV("volume", "gold", 10, t0))
+			if test.err != nil {
+				store.Fail(test.failVerb, test.failKey, 1, test.err)
+			}
+
+			results := syncUntilDone(t, syncClaimFromCache(t, "ns", "claim"))
+			if results[0] != test.expected {
+				t.Errorf("expected %+v first, got %+v", test.expected, results[0])
+			}
+			if last := results[len(results)-1]; last != done {
+				t.Errorf("expected done at last, got %+v", results)
+			}
+			checkBound(t, store, "ns", "claim", "volume")
+			// Bound and synced again: nothing left to write.
+			store.Writes()
+			if result := syncClaimFromCache(t, "ns", "claim")(); result != done {
+				t.Errorf("resync: expected done, got %+v", result)
+			}
+			if writes := store.Writes(); len(writes) != 0 {
+				t.Errorf("resync: expected no writes, got %v", writes)
+			}
+		})
+	}
+}
+
+// Another claim takes the volume between the read and the write of ours:
+// the write conflicts and the volume is not bound twice.
+func TestSyncPVCBindRace(t *testing.T) {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	store := newFakeStore(t)
+	store.AddPVC(testClaim("ns", "claim", "gold", 10))
+	store.AddPV(testPV("volume", "gold", 10, t0))
+	other := testClaim("ns", "other", "gold", 10)
+	store.React(func(verb, key string) (bool, error) {
+		if verb == "update" && key == "pv/volume" {
+			// Reactors run with the lock held.
+			if pv := store.pvs["volume"]; pv.Spec.ClaimPtr == nil {
+				pv.Spec.ClaimPtr = claimReference(other)
+				pv.ResourceVersion = store.nextResourceVersion()
+			}
+		}
+		return false, nil
+	})
+
+	if result := syncClaimFromCache(t, "ns", "claim")(); result != requeueAfter(retryAfterConflict) {
+		t.Errorf("expected a conflict, got %+v", result)
+	}
+	if result := syncClaimFromCache(t, "ns", "claim")(); result != requeueAfter(retryWhileProvisioning) {
+		t.Errorf("expected the claim to wait, got %+v", result)
+	}
+	if pv := store.PV("volume"); !refersTo(pv.Spec.ClaimPtr, &other.ObjectMeta) {
+		t.Errorf("expected the volume bound to the other claim, got %+v", pv.Spec.ClaimPtr)
+	}
+	if pvc := store.PVC("ns", "claim"); pvc.Spec.VolumePtr != nil || pvc.Status.Phase == Bound {
+		t.Errorf("expected the claim unbound, got %+v %+v", pvc.Spec.VolumePtr, pvc.Status)
+	}
+}
+
+func TestSyncPV(t *testing.T) {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	claim := testClaim("ns", "claim", "gold", 10)
+	claim.Spec.VolumePtr = &ObjectReference{Name: "volume", UID: "volume-uid"}
+	elsewhere := testClaim("ns", "claim", "gold", 10)
+	elsewhere.Spec.VolumePtr = &ObjectReference{Name: "other", UID: "other-uid"}
+
+	unbound := testPV("volume", "gold", 10, t0)
+	bound := testPV("volume", "gold", 10, t0)
+	bound.Spec.ClaimPtr = claimReference(claim)
+	retained := bound.DeepCopy()
+	retained.Spec.ReclaimPolicy = "Retain"
+	retained.Finalizers = []string{finalizerPVProtection}
+	boundByController := bound.DeepCopy()
+	boundByController.Annotations = map[string]string{annBoundByController: "yes"}
+
+	tests := []struct {
+		name   string
+		claim  *PVClaim
+		volume *PV
+		// The first attempt of this write fails.
+		failVerb, failKey string
+		expectedPhase     Phase
+		expectedClaim     string // "" for no ClaimPtr
+		expectedEvents    []string
+		check             func(t *testing.T, pv *PV)
+	}{
+		{
+			name:          "unbound: available",
+			volume:        unbound,
+			failVerb:      "update-status",
+			failKey:       "pv/volume",
+			expectedPhase: Available,
+		},
+		{
+			name:          "bound: protected",
+			claim:         claim,
+			volume:        bound,
+			failVerb:      "update",
+			failKey:       "pv/volume",
+			expectedPhase: Bound,
+			expectedClaim: "claim",
+			check: func(t *testing.T, pv *PV) {
+				if !hasFinalizer(pv, finalizerPVProtection) {
+					t.Errorf("expected finalizer, got %v", pv.Finalizers)
+				}
+			},
+		},
+		{
+			name:           "claim deleted: retained",
+			volume:         retained,
+			failVerb:       "update-status",
+			failKey:        "pv/volume",
+			expectedPhase:  Released,
+			expectedClaim:  "claim",
+			expectedEvents: []string{"VolumeRetained pv/volume"},
+			check: func(t *testing.T, pv *PV) {
+				if hasFinalizer(pv, finalizerPVProtection) {
+					t.Errorf("expected no finalizer, got %v", pv.Finalizers)
+				}
+			},
+		},
+		{
+			name:           "claim deleted: retained, finalizer fails",
+			volume:         retained,
+			failVerb:       "update",
+			failKey:        "pv/volume",
+			expectedPhase:  Released,
+			expectedClaim:  "claim",
+			expectedEvents: []string{"VolumeRetained pv/volume"},
+		},
+		{
+			name:          "claim bound elsewhere: we bound it, unbind",
+			claim:         elsewhere,
+			volume:        boundByController,
+			failVerb:      "update",
+			failKey:       "pv/volume",
+			expectedPhase: Available,
+		},
+		{
+			name:          "claim bound elsewhere: unbind, status fails",
+			claim:         elsewhere,
+			volume:        boundByController,
+			failVerb:      "update-status",
+			failKey:       "pv/volume",
+			expectedPhase: Available,
+		},
+		{
+			name:          "claim bound elsewhere: pre-bound by the admin",
+			claim:         elsewhere,
+			volume:        bound,
+			failVerb:      "update-status",
+			failKey:       "pv/volume",
+			expectedPhase: Available,
+			expectedClaim: "claim",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeStore(t)
+			if test.claim != nil {
+				store.AddPVC(test.claim)
+			}
+			store.AddPV(test.volume)
+			store.Fail(test.failVerb, test.failKey, 1, errFakeAPI)
+
+			results := syncUntilDone(t, syncVolumeFromCache(t, "volume"))
+			if results[0] != apiFailed() {
+				t.Errorf("expected %+v first, got %+v", apiFailed(), results[0])
+			}
+			pv := store.PV("volume")
+			if pv.Status.Phase != test.expectedPhase {
+				t.Errorf("expected phase %q, got %q", test.expectedPhase, pv.Status.Phase)
+			}
+			got := ""
+			if pv.Spec.ClaimPtr != nil {
+				got = pv.Spec.ClaimPtr.Name
+			}
+			if got != test.expectedClaim {
+				t.Errorf("expected claim %q, got %q", test.expectedClaim, got)
+			}
+			if events := store.Events(); !slices.Equal(events, test.expectedEvents) {
+				t.Errorf("expected events %v, got %v", test.expectedEvents, events)
+			}
+			if test.check != nil {
+				test.check(t, pv)
+			}
+		})
+	}
+}
+
+// testBatchProvisioner keeps its assets by token, and fails the claims in
+// fail.
+type testBatchProvisioner struct {
+	lock sync.Mutex
+	// Copies of the volumes it made, by token.
+	assets map[string]*PV
+	// The claims it was asked to provision.
+	provisioned []string
+	fail        map[string]error
+}
+
+func (p *testBatchProvisioner) Name() string                          { return "batch" }
+func (p *testBatchProvisioner) CanProvision(class *StorageClass) bool { return true }
+
+func (p *testBatchProvisioner) Provision(ctx context.Context, opts ProvisionOptions) (*PV, error) {
+	pvs, errs := p.ProvisionBatch(ctx, []ProvisionOptions{opts})
+	return pvs[0], errs[0]
+}
+
+func (p *testBatchProvisioner) ProvisionBatch(ctx context.Context, opts []ProvisionOptions) ([]*PV, []error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pvs, errs := make([]*PV, len(opts)), make([]error, len(opts))
+	for i, o := range opts {
+		p.provisioned = append(p.provisioned, o.Claim.Name)
+		if errs[i] = p.fail[o.Claim.Name]; errs[i] != nil {
+			continue
+		}
+		pv := &PV{}
+		pv.Spec.Capacity = o.Claim.Spec.Resources.Requests[Storage]
+		p.assets[o.Token] = pv.DeepCopy()
+		pvs[i] = pv
+	}
+	return pvs, errs
+}
+
+func (p *testBatchProvisioner) FindProvisioned(ctx context.Context, opts ProvisionOptions) (*PV, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pv := p.assets[opts.Token]; pv != nil {
+		return pv.DeepCopy(), nil
+	}
+	return nil, nil
+}
+
+// Provisioned returns the claims provisioned so far, sorted, and forgets
+// them.
+func (p *testBatchProvisioner) Provisioned() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	provisioned := p.provisioned
+	p.provisioned = nil
+	slices.Sort(provisioned)
+	return provisioned
+}
+
+// A batch in which one claim fails to provision and one fails to get its
+// PV created, then a retry: only the failed claim is provisioned again, the
+// other gets the asset it has already.
+func TestProvisionBatchRetry(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+
+	class := &StorageClass{ObjectMeta: ObjectMeta{Name: "gold"}, Provisioner: "batch"}
+	store.AddClass(class)
+	for _, name := range []string{"a", "b", "c"} {
+		claim := testClaim("ns", name, "gold", 10)
+		claim.Status.Phase = Pending
+		store.AddPVC(claim)
+	}
+	plugin := &testBatchProvisioner{assets: map[string]*PV{}, fail: map[string]error{"b": errFakeAPI}}
+	// The PV of c may or may not have been created; the asset stays.
+	store.Fail("create", "pv/pvc-c-uid", 1, errFakeAPI)
+	store.Fail("get", "pv/pvc-c-uid", 1, errFakeAPI)
+
+	provisionBatch(store.PVC("ns", "a"), plugin)
+	runningProvisioners.wg.Wait()
+	if got := plugin.Provisioned(); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("first batch: expected a, b and c provisioned, got %v", got)
+	}
+	if store.PV("pvc-a-uid") == nil || store.PV("pvc-b-uid") != nil || store.PV("pvc-c-uid") != nil {
+		t.Errorf("first batch: expected only the PV of a, got %v", store.Writes())
+	}
+	if provisioningBackoff.IsAllowed("b-uid") {
+		t.Errorf("first batch: expected b in backoff")
+	}
+
+	// The backoff of b expires.
+	provisioningBackoff.Forget("b-uid")
+	plugin.fail = nil
+	provisionBatch(store.PVC("ns", "a"), plugin)
+	runningProvisioners.wg.Wait()
+	if got := plugin.Provisioned(); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("retry: expected only b provisioned, got %v", got)
+	}
+	if len(plugin.assets) != 3 {
+		t.Errorf("retry: expected 3 assets, got %d", len(plugin.assets))
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		pv, pvc := store.PV("pvc-"+name+"-uid"), store.PVC("ns", name)
+		if pv == nil || !refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) || pv.Spec.StorageClassName != "gold" {
+			t.Errorf("retry: expected the PV of %s pre-bound to it, got %+v", name, pv)
+		}
+	}
+}
+
+// newSteadyState returns a store with n claims bound to their volumes and
+// n available volumes, after the syncs that got them there.
+func newSteadyState(t testing.TB, n int) *fakeStore {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	store := newFakeStore(t)
+	for i := range n {
+		name := strconv.Itoa(i)
+		store.AddPVC(testClaim("ns", "claim-"+name, "gold", 10))
+		store.AddPV(testPV("bound-"+name, "gold", 10, t0), testPV("available-"+name, "gold", 100, t0))
+	}
+	for range 3 {
+		resync()
+	}
+	store.Writes()
+	return store
+}
+
+// resync syncs every object in the caches once, as the full resync does,
+// and returns the results that are not done.
+func resync() []syncResult {
+	notDone := []syncResult{}
+	for _, pvc := range pvcLister.List() {
+		if result := SyncPVC(pvc); result != done {
+			notDone = append(notDone, result)
+		}
+	}
+	for _, pv := range pvLister.List() {
+		if result := syncPV(pv); result != done {
+			notDone = append(notDone, result)
+		}
+	}
+	return notDone
+}
+
+// The budget of a no-op sync, in allocations per object, including the
+// copies the (fake) listers hand out.
+const maxNoOpSyncAllocs = 20
+
+// A full resync of objects in their desired state writes nothing and
+// allocates little: the *Equal checks must keep catching "no change".
+func TestNoOpResync(t *testing.T) {
+	const n = 50
+	store := newSteadyState(t, n)
+	for i := range n {
+		checkBound(t, store, "ns", "claim-"+strconv.Itoa(i), "bound-"+strconv.Itoa(i))
+	}
+	if notDone := resync(); len(notDone) != 0 {
+		t.Errorf("expected all syncs done, got %+v", notDone)
+	}
+	if writes := store.Writes(); len(writes) != 0 {
+		t.Errorf("expected no writes, got %v", writes)
+	}
+	allocs := testing.AllocsPerRun(10, func() { resync() })
+	if perObject := allocs / (3 * n); perObject > maxNoOpSyncAllocs {
+		t.Errorf("expected at most %d allocations per object, got %.1f", maxNoOpSyncAllocs, perObject)
+	}
+	if events := store.Events(); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func BenchmarkNoOpResync(b *testing.B) {
+	const n = 1000
+	store := newSteadyState(b, n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		resync()
+	}
+	b.StopTimer()
+	if writes := store.Writes(); len(writes) != 0 {
+		b.Errorf("expected no writes, got %d", len(writes))
+	}
+}
+
+// FuzzBinder syncs random populations of claims and volumes, with random
+// pointers and annotations (pre-binds by the user, half-finished binds of
+// a crashed instance, lost races) and random commit failures, and checks
+// the invariants of the binder:
+//   - after every sync: no volume is the volume of two Bound claims, and a
+//     Bound volume has a claim;
+//   - once the failures stop and the syncs settle: a Bound claim and its
+//     volume point to each other, and the volume is Bound too.
+func FuzzBinder(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{3, 3, 1, 1, 0, 2, 9, 1, 3, 0, 0, 1, 5, 2, 8, 0})
+	f.Add([]byte{1, 2, 7, 7, 7, 7, 4, 4, 4, 4, 0, 0, 0, 0, 6, 6})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+		bytes := fuzzBytes(data)
+		store := newFakeStore(t)
+		nClaims, nVolumes := 1+int(bytes.next()%4), 1+int(bytes.next()%4)
+		claims := make([]*PVClaim, nClaims)
+		for i := range claims {
+			claims[i] = testClaim("ns", "claim-"+strconv.Itoa(i), "gold", 10)
+		}
+		for i := range nVolumes {
+			pv := testPV("volume-"+strconv.Itoa(i), "gold", 10*int64(1+bytes.next()%2), t0)
+			pv.Spec.ReclaimPolicy = "Retain"
+			if c := int(bytes.next() % byte(nClaims+1)); c < nClaims {
+				pv.Spec.ClaimPtr = claimReference(claims[c])
+				if bytes.next()%2 == 0 {
+					// Pre-bound by the admin: no UID yet.
+					pv.Spec.ClaimPtr.UID = ""
+				}
+			}
+			if bytes.next()%2 == 0 {
+				setAnnotation(pv, annBoundByController)
+			}
+			store.AddPV(pv)
+		}
+		for _, pvc := range claims {
+			if v := int(bytes.next() % byte(nVolumes+1)); v < nVolumes {
+				pvc.Spec.VolumePtr = &ObjectReference{Name: "volume-" + strconv.Itoa(v)}
+				if bytes.next()%2 == 0 {
+					pvc.Spec.VolumePtr.UID = UID(pvc.Spec.VolumePtr.Name + "-uid")
+				}
+			}
+			if flags := bytes.next(); flags&1 != 0 {
+				setAnnotation(pvc, annWasEverBound)
+			} else if flags&2 != 0 {
+				setAnnotation(pvc, annBoundByController)
+			}
+			store.AddPVC(pvc)
+		}
+		failing := true
+		store.React(func(verb, key string) (bool, error) {
+			if !failing || verb == "get" {
+				return false, nil
+			}
+			switch bytes.next() % 8 {
+			case 0:
+				return true, errFakeAPI
+			case 1:
+				return true, NewConflict(strings.SplitN(key, "/", 2)[0], key)
+			}
+			return false, nil
+		})
+
+		checkAlways := func() {
+			t.Helper()
+			boundTo := map[string]string{}
+			for _, pvc := range pvcLister.List() {
+				if pvc.Status.Phase != Bound || pvc.Spec.VolumePtr == nil {
+					continue
+				}
+				if other, found := boundTo[pvc.Spec.VolumePtr.Name]; found {
+					t.Fatalf("claims %s and %s are both bound to %s", other, pvc.Name, pvc.Spec.VolumePtr.Name)
+				}
+				boundTo[pvc.Spec.VolumePtr.Name] = pvc.Name
+			}
+			for _, pv := range pvLister.List() {
+				if pv.Status.Phase == Bound && pv.Spec.ClaimPtr == nil {
+					t.Fatalf("volume %s is bound to nothing", pv.Name)
+				}
+			}
+		}
+		// The order of the syncs is random, too.
+		round := func() {
+			keys := []string{}
+			for _, pvc := range pvcLister.List() {
+				keys = append(keys, pvcKey(pvc.Namespace, pvc.Name))
+			}
+			for _, pv := range pvLister.List() {
+				keys = append(keys, pvKey(pv.Name))
+			}
+			for len(keys) > 0 {
+				i := int(bytes.next()) % len(keys)
+				if pv := pvLister.GetByKey(keys[i]); pv != nil {
+					syncPV(pv)
+				} else if pvc := pvcLister.GetByKey(keys[i]); pvc != nil {
+					SyncPVC(pvc)
+				}
+				checkAlways()
+				keys = slices.Delete(keys, i, i+1)
+			}
+		}
+		for range 1 + bytes.next()%4 {
+			round()
+		}
+		failing = false
+		for range 5 {
+			round()
+		}
+		store.Writes()
+		round()
+		if writes := store.Writes(); len(writes) != 0 {
+			t.Fatalf("not settled: %v", writes)
+		}
+
+		for _, pvc := range pvcLister.List() {
+			if pvc.Status.Phase != Bound {
+				continue
+			}
+			pv := pvLister.Get(pvc.Spec.VolumePtr.Name)
+			if pv == nil || !refersTo(pvc.Spec.VolumePtr, &pv.ObjectMeta) || pv.Spec.ClaimPtr == nil || !refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) {
+				t.Fatalf("claim %s is bound, but not to a volume bound to it: %+v", pvc.Name, pv)
+			}
+			if pv.Status.Phase != Bound {
+				t.Fatalf("claim %s is bound to %s, which is %s", pvc.Name, pv.Name, pv.Status.Phase)
+			}
+		}
+	})
+}
+
+// newOperations gives the test its own operation registries and backoffs.
+func newOperations(t testing.TB) {
+	oldRegistries := []*operationRegistry{runningProvisioners, runningDeleters, runningRecyclers}
+	oldBackoffs := []*backoff{provisioningBackoff, deletionBackoff, recyclingBackoff}
+	runningProvisioners, runningDeleters, runningRecyclers = newOperationRegistry(), newOperationRegistry(), newOperationRegistry()
+	provisioningBackoff, deletionBackoff, recyclingBackoff = newBackoff(), newBackoff(), newBackoff()
+	t.Cleanup(func() {
+		runningProvisioners, runningDeleters, runningRecyclers = oldRegistries[0], oldRegistries[1], oldRegistries[2]
+		provisioningBackoff, deletionBackoff, recyclingBackoff = oldBackoffs[0], oldBackoffs[1], oldBackoffs[2]
+	})
+}
+
+// blockingProvisioner blocks in Provision until release is closed.
+type blockingProvisioner struct {
+	started chan string
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func newBlockingProvisioner() *blockingProvisioner {
+	return &blockingProvisioner{started: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (p *blockingProvisioner) Name() string                          { return "blocking" }
+func (p *blockingProvisioner) CanProvision(class *StorageClass) bool { return true }
+
+func (p *blockingProvisioner) Provision(ctx context.Context, opts ProvisionOptions) (*PV, error) {
+	p.calls.Add(1)
+	p.started <- opts.Claim.Name
+	<-p.release
+	pv := &PV{}
+	pv.Spec.Capacity = opts.Claim.Spec.Resources.Requests[Storage]
+	return pv, nil
+}
+
+// Syncs of a claim while its provisioner runs don't start another one.
+func TestProvisionClaimDuplicates(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+	store.AddClass(&StorageClass{ObjectMeta: ObjectMeta{Name: "gold"}, Provisioner: "blocking"})
+	store.AddPVC(testClaim("ns", "claim", "gold", 10))
+	plugin := newBlockingProvisioner()
+
+	provisionClaim(store.PVC("ns", "claim"), plugin)
+	<-plugin.started
+	for range 3 {
+		provisionClaim(store.PVC("ns", "claim"), plugin)
+	}
+	if got := runningProvisioners.Snapshot(); !reflect.DeepEqual(got, map[string]string{"claim-uid": "pvc/ns/claim"}) {
+		t.Errorf("expected one provisioner for the claim, got %v", got)
+	}
+	close(plugin.release)
+	runningProvisioners.wg.Wait()
+	if calls := plugin.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 Provision call, got %d", calls)
+	}
+	pv := store.PV("pvc-claim-uid")
+	if pv == nil || !refersTo(pv.Spec.ClaimPtr, &store.PVC("ns", "claim").ObjectMeta) {
+		t.Errorf("expected a PV pre-bound to the claim, got %+v", pv)
+	}
+	if got := runningProvisioners.Snapshot(); len(got) != 0 {
+		t.Errorf("expected no provisioners left, got %v", got)
+	}
+}
+
+// A batch leaves out the keys that are running already.
+func TestOperationRegistryRunBatch(t *testing.T) {
+	r := newOperationRegistry()
+	release := make(chan struct{})
+	if !r.Run("a", "pvc/ns/a", func(ctx context.Context) { <-release }) {
+		t.Fatalf("a did not start")
+	}
+	if r.Run("a", "pvc/ns/a", func(ctx context.Context) { t.Errorf("a started twice") }) {
+		t.Errorf("a started twice")
+	}
+	got := []string{}
+	started := r.RunBatch(map[string]string{"a": "pvc/ns/a", "b": "pvc/ns/b"}, func(ctx context.Context, members map[string]context.Context) {
+		for key := range members {
+			got = append(got, key)
+		}
+	})
+	if !started {
+		t.Errorf("batch did not start")
+	}
+	close(release)
+	r.wg.Wait()
+	if !slices.Equal(got, []string{"b"}) {
+		t.Errorf("expected the batch to get b only, got %v", got)
+	}
+	if r.RunBatch(map[string]string{}, func(ctx context.Context, members map[string]context.Context) {}) {
+		t.Errorf("empty batch started")
+	}
+}
+
+// testDeleter deletes NFS volumes made by "test-deleter".  Delete blocks
+// until release is closed, and then fails with err.
+type testDeleter struct {
+	started chan string
+	release chan struct{}
+	err     error
+	calls   atomic.Int32
+}
+
+func newTestDeleter(t *testing.T) *testDeleter {
+	d := &testDeleter{started: make(chan string, 10), release: make(chan struct{})}
+	old := deleterPlugins
+	deleterPlugins = map[string]DeleterPlugin{"nfs": d}
+	t.Cleanup(func() { deleterPlugins = old })
+	return d
+}
+
+func (d *testDeleter) Name() string { return "test-deleter" }
+
+func (d *testDeleter) Delete(pv *PV) error {
+	d.calls.Add(1)
+	d.started <- pv.Name
+	<-d.release
+	return d.err
+}
+
+// releasedVolume returns a PV provisioned by the testDeleter for a claim
+// that is gone.
+func releasedVolume(name string) *PV {
+	pv := testPV(name, "gold", 10, time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC))
+	pv.Spec.NFS = &NFSVolumeSource{Server: "server", Path: "/" + name}
+	pv.Spec.ReclaimPolicy = "Delete"
+	pv.Spec.ClaimPtr = &ObjectReference{Namespace: "ns", Name: "gone", UID: "gone-uid"}
+	pv.Finalizers = []string{finalizerPVProtection}
+	setAnnotationValue(pv, annDynamicallyProvisioned, "test-deleter")
+	return pv
+}
+
+// Syncs of a PV while its deleter runs don't start another one.
+func TestDeleteVolumeDuplicates(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+	deleter := newTestDeleter(t)
+	store.AddPV(releasedVolume("volume"))
+
+	if result := syncVolumeFromCache(t, "volume")(); result != done {
+		t.Errorf("expected done, got %+v", result)
+	}
+	<-deleter.started
+	for range 3 {
+		if result := syncVolumeFromCache(t, "volume")(); result != done {
+			t.Errorf("expected done, got %+v", result)
+		}
+	}
+	if got := runningDeleters.Snapshot(); !reflect.DeepEqual(got, map[string]string{"volume-uid": "pv/volume"}) {
+		t.Errorf("expected one deleter for the volume, got %v", got)
+	}
+	close(deleter.release)
+	runningDeleters.wg.Wait()
+	if calls := deleter.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 Delete call, got %d", calls)
+	}
+	if pv := store.PV("volume"); pv != nil {
+		t.Errorf("expected the PV deleted, got %+v", pv)
+	}
+	expected := []string{"DeleteStarted pv/volume", "DeleteSucceeded pv/volume"}
+	if events := store.Events(); !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+	if deleterSlots.running != 0 {
+		t.Errorf("expected all deleter slots free, got %d taken", deleterSlots.running)
+	}
+}
+
+// No more than maxDeleters run at once; the others wait for a slot.
+func TestDeleteVolumeLimit(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+	deleter := newTestDeleter(t)
+	oldMax := maxDeleters
+	maxDeleters = 2
+	t.Cleanup(func() { maxDeleters = oldMax })
+	store.AddPV(releasedVolume("a"), releasedVolume("b"), releasedVolume("c"))
+
+	results := []syncResult{}
+	for _, name := range []string{"a", "b", "c"} {
+		results = append(results, syncVolumeFromCache(t, name)())
+	}
+	if expected := []syncResult{done, done, requeueAfter(retryWhileProvisioning)}; !slices.Equal(results, expected) {
+		t.Errorf("expected %+v, got %+v", expected, results)
+	}
+	close(deleter.release)
+	runningDeleters.wg.Wait()
+	if result := syncVolumeFromCache(t, "c")(); result != done {
+		t.Errorf("c: expected done, got %+v", result)
+	}
+	<-deleter.started
+	<-deleter.started
+	<-deleter.started
+	runningDeleters.wg.Wait()
+	for _, name := range []string{"a", "b", "c"} {
+		if store.PV(name) != nil {
+			t.Errorf("expected %s deleted", name)
+		}
+	}
+}
+
+// A failed Delete leaves the PV Released, in backoff.
+func TestDeleteVolumeFailure(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+	deleter := newTestDeleter(t)
+	deleter.err = errors.New("backend down")
+	close(deleter.release)
+	store.AddPV(releasedVolume("volume"))
+
+	syncVolumeFromCache(t, "volume")()
+	runningDeleters.wg.Wait()
+	pv := store.PV("volume")
+	if pv == nil || pv.Status.Phase != Released || !hasFinalizer(pv, finalizerPVProtection) {
+		t.Fatalf("expected the PV Released and protected, got %+v", pv)
+	}
+	if attempts, _ := deletionBackoff.Get(pv.UID); attempts != 1 {
+		t.Errorf("expected 1 failed attempt, got %d", attempts)
+	}
+	if result := syncVolumeFromCache(t, "volume")(); result.requeueAfter <= 0 || result.failed {
+		t.Errorf("expected a wait for the backoff, got %+v", result)
+	}
+	if calls := deleter.calls.Load(); calls != 1 {
+		t.Errorf("expected no Delete call in backoff, got %d", calls)
+	}
+}
+
+// The backoff of a failing deleter expires on the clock; after
+// maxDeleteAttempts the PV is Failed.
+func TestDeleteVolumeGivesUp(t *testing.T) {
+	store := newFakeStore(t)
+	fakeClock := newFakeClock(t)
+	newOperations(t)
+	deleter := newTestDeleter(t)
+	deleter.err = errors.New("backend down")
+	close(deleter.release)
+	old := maxDeleteAttempts
+	maxDeleteAttempts = 3
+	t.Cleanup(func() { maxDeleteAttempts = old })
+	store.AddPV(releasedVolume("volume"))
+
+	for attempt := 1; attempt < maxDeleteAttempts; attempt++ {
+		syncVolumeFromCache(t, "volume")()
+		runningDeleters.wg.Wait()
+		result := syncVolumeFromCache(t, "volume")()
+		if want := initialBackoff << (attempt - 1); result.requeueAfter != want {
+			t.Fatalf("attempt %d: expected a wait of %v, got %+v", attempt, want, result)
+		}
+		fakeClock.Step(result.requeueAfter - time.Nanosecond)
+		if deletionBackoff.IsAllowed(store.PV("volume").UID) {
+			t.Fatalf("attempt %d: backoff expired early", attempt)
+		}
+		fakeClock.Step(time.Nanosecond)
+	}
+	syncVolumeFromCache(t, "volume")()
+	runningDeleters.wg.Wait()
+	pv := store.PV("volume")
+	if pv.Status.Phase != Failed || pv.Status.Message != message(reasonDeleteFailedPermanently, 3, deleter.err) {
+		t.Errorf("expected the PV Failed, got %+v", pv.Status)
+	}
+	if calls := deleter.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 Delete calls, got %d", calls)
+	}
+	if events := store.Events(); !slices.Contains(events, "DeleteFailedPermanently pv/volume") {
+		t.Errorf("expected DeleteFailedPermanently, got %v", events)
+	}
+}
+
+// The breaker opens after breakerThreshold server errors, closes when its
+// period is over, and opens again, for twice as long, at the first error
+// after that.
+func TestCircuitBreaker(t *testing.T) {
+	fakeClock := newFakeClock(t)
+	b := &circuitBreaker{}
+	serverErr := NewInternalError(errors.New("etcd is down"))
+
+	for range breakerThreshold - 1 {
+		b.Record(serverErr)
+	}
+	b.Record(NewConflict("pv", "volume"))
+	if pause := b.Open(); pause != 0 {
+		t.Fatalf("expected a Conflict to reset the count, got a pause of %v", pause)
+	}
+	for range breakerThreshold {
+		b.Record(serverErr)
+	}
+	if pause := b.Open(); pause != breakerOpenPeriod {
+		t.Fatalf("expected a pause of %v, got %v", breakerOpenPeriod, pause)
+	}
+	fakeClock.Step(breakerOpenPeriod)
+	if pause := b.Open(); pause != 0 {
+		t.Fatalf("expected the breaker closed, got a pause of %v", pause)
+	}
+	b.Record(serverErr)
+	if pause := b.Open(); pause != 2*breakerOpenPeriod {
+		t.Fatalf("expected a pause of %v, got %v", 2*breakerOpenPeriod, pause)
+	}
+	fakeClock.Step(2 * breakerOpenPeriod)
+	b.Record(nil)
+	b.Record(serverErr)
+	if pause := b.Open(); pause != 0 {
+		t.Errorf("expected a success to reset the breaker, got a pause of %v", pause)
+	}
+}
+
+// A PV provisioned by another plugin is not deleted.
+func TestDeleteVolumeNotOurs(t *testing.T) {
+	store := newFakeStore(t)
+	newOperations(t)
+	deleter := newTestDeleter(t)
+	pv := releasedVolume("volume")
+	pv.Annotations[annDynamicallyProvisioned] = "other"
+	store.AddPV(pv)
+
+	if result := syncVolumeFromCache(t, "volume")(); result != done {
+		t.Errorf("expected done, got %+v", result)
+	}
+	if calls := deleter.calls.Load(); calls != 0 || len(runningDeleters.Snapshot()) != 0 {
+		t.Errorf("expected no deleter, got %d calls", calls)
+	}
+	if events := store.Events(); !slices.Equal(events, []string{"DeleteRefused pv/volume"}) {
+		t.Errorf("expected DeleteRefused, got %v", events)
+	}
+}
+
+// relistPVs returns n bound PVs, as a relist of a large cluster returns
+// them.
+func relistPVs(n int) []*PV {
+	t0 := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	pvs := make([]*PV, n)
+	for i := range pvs {
+		pv := testPV("pv-"+strconv.Itoa(i), "gold", 10<<30, t0)
+		pv.ResourceVersion = strconv.Itoa(1000 + i)
+		pv.Spec.NFS = &NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/pv-" + strconv.Itoa(i)}
+		pv.Spec.ClaimPtr = &ObjectReference{Namespace: "ns", Name: "claim-" + strconv.Itoa(i), UID: UID("claim-" + strconv.Itoa(i) + "-uid")}
+		pv.Annotations = map[string]string{annBoundByController: "yes", annDynamicallyProvisioned: "nfs"}
+		pv.Finalizers = []string{finalizerPVProtection}
+		pv.Status.Phase = Bound
+		pvs[i] = pv
+	}
+	return pvs
+}
+
+// The JSON decoding of a relist, the baseline for the content types in
+// apiContentTypes.  The protobuf side needs the client library's codec.
+func BenchmarkRelistJSON(b *testing.B) {
+	data, err := json.Marshal(relistPVs(10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(data))/10000, "bytes/pv")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		var pvs []*PV
+		if err := json.Unmarshal(data, &pvs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The controller's share of a relist: the watch handlers drop the events
+// of versions they have seen (isStaleEvent) before queueing anything.
+func BenchmarkRelistStaleEvents(b *testing.B) {
+	pvs := relistPVs(10000)
+	for _, pv := range pvs {
+		isStaleEvent("pv/"+pv.Name, pv.ResourceVersion, MODIFY)
+	}
+	b.Cleanup(func() {
+		for _, pv := range pvs {
+			isStaleEvent("pv/"+pv.Name, pv.ResourceVersion, DELETE)
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		for _, pv := range pvs {
+			isStaleEvent("pv/"+pv.Name, pv.ResourceVersion, MODIFY)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// This file represents a high-level view of the CSI volume plugin, as far as
+// the storage controller is concerned: provisioning and deleting volumes
+// through the CreateVolume and DeleteVolume calls of a CSI driver.
+//
+// There is one csiPlugin per CSI driver.  A class uses a CSI driver by
+// naming it as class.Provisioner; a PV belongs to a CSI driver if
+// pv.Spec.CSI.Driver is set.
+
+package persistentvolume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Class parameters with this prefix are for us, not for the driver.
+const csiParameterPrefix = "csi.storage.k8s.io/"
+
+// Class parameters naming the secrets passed to CreateVolume and
+// DeleteVolume.  "${pvc.namespace}" and "${pvc.name}" may be used in the
+// values, as in any class parameter.
+const csiProvisionerSecretName = "csi.storage.k8s.io/provisioner-secret-name"
+const csiProvisionerSecretNamespace = "csi.storage.k8s.io/provisioner-secret-namespace"
+
+// CSIControllerClient calls the controller service of a CSI driver.
+type CSIControllerClient interface {
+	CreateVolume(ctx context.Context, req CreateVolumeRequest) (*CSIVolume, error)
+	DeleteVolume(req DeleteVolumeRequest) error
+}
+
+type CreateVolumeRequest struct {
+	Name          string
+	CapacityBytes int64
+	Parameters    map[string]string
+	Secrets       map[string]string
+	// Restore the volume from this snapshot; nil for an empty volume.
+	Source                    *Snapshot
+	AccessibilityRequirements []TopologySelectorTerm
+}
+
+type DeleteVolumeRequest struct {
+	VolumeID string
+	Secrets  map[string]string
+}
+
+// CSIVolume is a volume CreateVolume made.
+type CSIVolume struct {
+	VolumeID      string
+	CapacityBytes int64
+	// Where the volume can be used; empty for everywhere.
+	AccessibleTopology []TopologySelectorTerm
+}
+
+type csiPlugin struct {
+	driver string
+	client CSIControllerClient
+}
+
+// csiPlugins holds a plugin for each CSI driver that registered with the
+// controller, by driver name.
+var csiPlugins = map[string]*csiPlugin{}
+
+// RegisterCSIDriver must be called before initController for each CSI
+// driver whose controller service is reachable.
+func RegisterCSIDriver(driver string, client CSIControllerClient) {
+	plugin := &csiPlugin{driver: driver, client: client}
+	csiPlugins[driver] = plugin
+	RegisterProvisionerPlugin(plugin)
+}
+
+func (p *csiPlugin) Name() string {
+	return p.driver
+}
+
+func (p *csiPlugin) CanProvision(class *StorageClass) bool {
+	return class.Provisioner == p.driver
+}
+
+func (p *csiPlugin) Provision(ctx context.Context, opts ProvisionOptions) (*PV, error) {
+	parameters := map[string]string{}
+	for key, value := range opts.Parameters {
+		if !strings.HasPrefix(key, csiParameterPrefix) {
+			parameters[key] = value
+		}
+	}
+	secretRef := csiSecretRef(opts.Parameters)
+	secrets, err := csiGetSecrets(secretRef)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := p.client.CreateVolume(ctx, CreateVolumeRequest{
+		// CreateVolume must be idempotent by name; a retry after a crash
+		// gets the same volume back.
+		Name:          opts.PVName,
+		CapacityBytes: opts.Claim.Spec.Resources.Requests[Storage],
+		Parameters:    parameters,
+		Secrets:       secrets,
+		Source:        opts.Source,
+		// The driver picks a topology within these and reports it back.
+		AccessibilityRequirements: opts.AllowedTopologies,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The controller adds its annotations and labels to the maps.
+	pv := &PV{ObjectMeta: ObjectMeta{
+		Name:        opts.PVName,
+		Annotations: map[string]string{},
+		Labels:      map[string]string{},
+	}}
+	pv.Spec.Capacity = volume.CapacityBytes
+	if len(volume.AccessibleTopology) > 0 {
+		pv.Spec.NodeAffinity = nodeAffinityFromTopologies(volume.AccessibleTopology)
+	}
+	pv.Spec.CSI = &CSIVolumeSource{
+		Driver:       p.driver,
+		VolumeHandle: volume.VolumeID,
+		// The class may be gone by the time the PV is deleted; remember
+		// the secret here.
+		DeleteSecretRef: secretRef,
+	}
+	return pv, nil
+}
+
+func (p *csiPlugin) Delete(pv *PV) error {
+	secrets, err := csiGetSecrets(pv.Spec.CSI.DeleteSecretRef)
+	if err != nil {
+		return err
+	}
+	return p.client.DeleteVolume(DeleteVolumeRequest{
+		VolumeID: pv.Spec.CSI.VolumeHandle,
+		Secrets:  secrets,
+	})
+}
+
+// csiSecretRef returns the secret named by the class parameters, or nil.
+func csiSecretRef(parameters map[string]string) *SecretReference {
+	name := parameters[csiProvisionerSecretName]
+	namespace := parameters[csiProvisionerSecretNamespace]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	// Templates in the values were expanded by newProvisionOptions.
+	return &SecretReference{Name: name, Namespace: namespace}
+}
+
+func csiGetSecrets(ref *SecretReference) (map[string]string, error) {
+	if ref == nil {
+		return nil, nil
+	}
+	secret := api.GetSecret(ref.Namespace, ref.Name)
+	if secret == nil {
+		return nil, fmt.Errorf("secret %s/%s not found", ref.Namespace, ref.Name)
+	}
+	return secret.Data, nil
+}
+
+// findCSIPluginForPV returns the plugin of the CSI driver that owns pv, or
+// nil if pv is not a CSI volume or its driver is not registered.
+func findCSIPluginForPV(pv *PV) *csiPlugin {
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+	return csiPlugins[pv.Spec.CSI.Driver]
+}
@@ -0,0 +1,538 @@
+package persistentvolume
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStore is the API server of a test, with informer caches that are
+// always up to date: newFakeStore installs it as api, pvLister and
+// pvcLister, and as the event recorder.
+//
+// Writes check the resourceVersion like the API server does: a write of an
+// object older than the stored one fails with a Conflict.  Reactors inject
+// any other failure.  Patches and applies are not supported; tests run
+// with commitMode "update".
+type fakeStore struct {
+	lock            sync.Mutex
+	pvs             map[string]*PV
+	pvcs            map[string]*PVClaim
+	classes         map[string]*StorageClass
+	defaultClass    string
+	resourceVersion int
+	reactors        []fakeReactor
+	// writes is the log of successful writes, "<verb> <key>".
+	writes []string
+	// events is the log of recorded events, "<reason> <key>".
+	events []string
+}
+
+// A fakeReactor is called with every call to the store, e.g. ("update",
+// "pv/a") or ("update-status", "pvc/ns/a").  If handled, the call fails
+// with err and the other reactors are not called.
+type fakeReactor func(verb, key string) (handled bool, err error)
+
+func newFakeStore(t testing.TB) *fakeStore {
+	s := &fakeStore{
+		pvs:     map[string]*PV{},
+		pvcs:    map[string]*PVClaim{},
+		classes: map[string]*StorageClass{},
+	}
+	oldAPI, oldPVLister, oldPVCLister, oldRecorder, oldCommitMode := api, pvLister, pvcLister, recorder, commitMode
+	api, pvLister, pvcLister, recorder, commitMode = s, fakePVLister{s}, fakePVCLister{s}, s, "update"
+	t.Cleanup(func() {
+		api, pvLister, pvcLister, recorder, commitMode = oldAPI, oldPVLister, oldPVCLister, oldRecorder, oldCommitMode
+	})
+	return s
+}
+
+func pvKey(name string) string             { return "pv/" + name }
+func pvcKey(namespace, name string) string { return "pvc/" + namespace + "/" + name }
+
+func objectKey(obj Object) string {
+	meta := obj.GetObjectMeta()
+	if meta.Namespace == "" {
+		return pvKey(meta.Name)
+	}
+	return pvcKey(meta.Namespace, meta.Name)
+}
+
+// AddPV and AddPVC store copies of the objects, as if created by somebody
+// else.
+func (s *fakeStore) AddPV(pvs ...*PV) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, pv := range pvs {
+		pv = pv.DeepCopy()
+		pv.ResourceVersion = s.nextResourceVersion()
+		s.pvs[pv.Name] = pv
+	}
+}
+
+func (s *fakeStore) AddPVC(pvcs ...*PVClaim) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, pvc := range pvcs {
+		pvc = pvc.DeepCopy()
+		pvc.ResourceVersion = s.nextResourceVersion()
+		s.pvcs[pvc.Namespace+"/"+pvc.Name] = pvc
+	}
+}
+
+func (s *fakeStore) AddClass(classes ...*StorageClass) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, class := range classes {
+		s.classes[class.Name] = class
+	}
+}
+
+// PV and PVC return a copy of what is stored, or nil.
+func (s *fakeStore) PV(name string) *PV {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pv := s.pvs[name]; pv != nil {
+		return pv.DeepCopy()
+	}
+	return nil
+}
+
+func (s *fakeStore) PVC(namespace, name string) *PVClaim {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pvc := s.pvcs[namespace+"/"+name]; pvc != nil {
+		return pvc.DeepCopy()
+	}
+	return nil
+}
+
+// React adds a reactor; Fail adds one that fails the next times calls
+// (any number if times < 0) of verb on key with err.
+func (s *fakeStore) React(reactor fakeReactor) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reactors = append(s.reactors, reactor)
+}
+
+func (s *fakeStore) Fail(verb, key string, times int, err error) {
+	s.React(func(v, k string) (bool, error) {
+		if v != verb || k != key || times == 0 {
+			return false, nil
+		}
+		times--
+		return true, err
+	})
+}
+
+// Writes returns the writes so far and forgets them.
+func (s *fakeStore) Writes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writes := s.writes
+	s.writes = nil
+	return writes
+}
+
+// Events returns the events so far and forgets them.
+func (s *fakeStore) Events() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+func (s *fakeStore) nextResourceVersion() string {
+	s.resourceVersion++
+	return strconv.Itoa(s.resourceVersion)
+}
+
+// react is called with s.lock held.
+func (s *fakeStore) react(verb, key string) error {
+	for _, reactor := range s.reactors {
+		if handled, err := reactor(verb, key); handled {
+			return err
+		}
+	}
+	return nil
+}
+
+// write is called with s.lock held, with the stored version of the object
+// (nil if there is none) and the version being written.
+func (s *fakeStore) write(verb, key string, stored, written *ObjectMeta) error {
+	if err := s.react(verb, key); err != nil {
+		return err
+	}
+	if stored == nil {
+		return NewNotFound(strings.Split(key, "/")[0], written.Name)
+	}
+	if written.ResourceVersion != stored.ResourceVersion {
+		return NewConflict(strings.Split(key, "/")[0], written.Name)
+	}
+	written.ResourceVersion = s.nextResourceVersion()
+	s.writes = append(s.writes, verb+" "+key)
+	return nil
+}
+
+func (s *fakeStore) GetPV(name string) (*PV, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.react("get", pvKey(name)); err != nil {
+		return nil, err
+	}
+	if pv := s.pvs[name]; pv != nil {
+		return pv.DeepCopy(), nil
+	}
+	return nil, NewNotFound("pv", name)
+}
+
+func (s *fakeStore) GetPVFromServer(name string) *PV {
+	pv, _ := s.GetPV(name)
+	return pv
+}
+
+func (s *fakeStore) GetPVCFromServer(namespace, name string) *PVClaim {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.react("get", pvcKey(namespace, name)); err != nil {
+		return nil
+	}
+	if pvc := s.pvcs[namespace+"/"+name]; pvc != nil {
+		return pvc.DeepCopy()
+	}
+	return nil
+}
+
+func (s *fakeStore) CreatePV(pv *PV) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.react("create", pvKey(pv.Name)); err != nil {
+		return err
+	}
+	if s.pvs[pv.Name] != nil {
+		return NewAlreadyExists("pv", pv.Name)
+	}
+	pv.ResourceVersion = s.nextResourceVersion()
+	s.pvs[pv.Name] = pv.DeepCopy()
+	s.writes = append(s.writes, "create "+pvKey(pv.Name))
+	return nil
+}
+
+// DeletePV removes the PV, or marks it deleted while it has finalizers.
+func (s *fakeStore) DeletePV(pv *PV) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.react("delete", pvKey(pv.Name)); err != nil {
+		return err
+	}
+	stored := s.pvs[pv.Name]
+	if stored == nil {
+		return NewNotFound("pv", pv.Name)
+	}
+	s.writes = append(s.writes, "delete "+pvKey(pv.Name))
+	if len(stored.Finalizers) == 0 {
+		delete(s.pvs, pv.Name)
+	} else if stored.DeletionTimestamp == nil {
+		now := clock.Now()
+		stored.DeletionTimestamp = &now
+		stored.ResourceVersion = s.nextResourceVersion()
+	}
+	return nil
+}
+
+// UpdatePV and UpdatePVC write everything but the status; the status
+// writes only the status.  A PV or claim marked deleted goes away with its
+// last finalizer.
+func (s *fakeStore) UpdatePV(pv *PV) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.pvs[pv.Name]
+	var storedMeta *ObjectMeta
+	if stored != nil {
+		storedMeta = &stored.ObjectMeta
+	}
+	if err := s.write("update", pvKey(pv.Name), storedMeta, &pv.ObjectMeta); err != nil {
+		return err
+	}
+	updated := pv.DeepCopy()
+	updated.Status = stored.Status.DeepCopy()
+	updated.DeletionTimestamp = stored.DeletionTimestamp
+	if updated.DeletionTimestamp != nil && len(updated.Finalizers) == 0 {
+		delete(s.pvs, pv.Name)
+		return nil
+	}
+	s.pvs[pv.Name] = updated
+	return nil
+}
+
+func (s *fakeStore) UpdatePVStatus(pv *PV, opts UpdateOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.pvs[pv.Name]
+	var storedMeta *ObjectMeta
+	if stored != nil {
+		storedMeta = &stored.ObjectMeta
+	}
+	if err := s.write("update-status", pvKey(pv.Name), storedMeta, &pv.ObjectMeta); err != nil {
+		return err
+	}
+	stored.Status = pv.Status.DeepCopy()
+	stored.ResourceVersion = pv.ResourceVersion
+	return nil
+}
+
+func (s *fakeStore) UpdatePVC(pvc *PVClaim) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := pvc.Namespace + "/" + pvc.Name
+	stored := s.pvcs[key]
+	var storedMeta *ObjectMeta
+	if stored != nil {
+		storedMeta = &stored.ObjectMeta
+	}
+	if err := s.write("update", pvcKey(pvc.Namespace, pvc.Name), storedMeta, &pvc.ObjectMeta); err != nil {
+		return err
+	}
+	updated := pvc.DeepCopy()
+	updated.Status = stored.Status.DeepCopy()
+	updated.DeletionTimestamp = stored.DeletionTimestamp
+	if updated.DeletionTimestamp != nil && len(updated.Finalizers) == 0 {
+		delete(s.pvcs, key)
+		return nil
+	}
+	s.pvcs[key] = updated
+	return nil
+}
+
+func (s *fakeStore) UpdatePVCStatus(pvc *PVClaim, opts UpdateOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.pvcs[pvc.Namespace+"/"+pvc.Name]
+	var storedMeta *ObjectMeta
+	if stored != nil {
+		storedMeta = &stored.ObjectMeta
+	}
+	if err := s.write("update-status", pvcKey(pvc.Namespace, pvc.Name), storedMeta, &pvc.ObjectMeta); err != nil {
+		return err
+	}
+	stored.Status = pvc.Status.DeepCopy()
+	stored.ResourceVersion = pvc.ResourceVersion
+	return nil
+}
+
+var errFakeUnsupported = errors.New("not supported by fakeStore")
+
+func (s *fakeStore) PatchPV(name string, patchType PatchType, patch []byte) error {
+	return errFakeUnsupported
+}
+
+func (s *fakeStore) PatchPVC(namespace, name string, patchType PatchType, patch []byte) error {
+	return errFakeUnsupported
+}
+
+func (s *fakeStore) ApplyPV(config *PVApplyConfiguration, opts ApplyOptions) error {
+	return errFakeUnsupported
+}
+
+func (s *fakeStore) ApplyPVC(config *PVCApplyConfiguration, opts ApplyOptions) error {
+	return errFakeUnsupported
+}
+
+func (s *fakeStore) ListPVCs(namespace string, filter func(pvc *PVClaim) bool) []*PVClaim {
+	list := []*PVClaim{}
+	for _, pvc := range (fakePVCLister{s}).List() {
+		if pvc.Namespace == namespace && filter(pvc) {
+			list = append(list, pvc)
+		}
+	}
+	return list
+}
+
+func (s *fakeStore) FindPVBoundTo(pvc *PVClaim) *PV {
+	for _, pv := range (fakePVLister{s}).List() {
+		if pv.Spec.ClaimPtr != nil && refersTo(pv.Spec.ClaimPtr, &pvc.ObjectMeta) {
+			return pv
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) GetClass(name string) *StorageClass {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.classes[name]
+}
+
+func (s *fakeStore) GetDefaultClass() *StorageClass {
+	if s.defaultClass == "" {
+		return nil
+	}
+	return s.GetClass(s.defaultClass)
+}
+
+func (s *fakeStore) GetProvisioningQuota(namespace string) *ProvisioningQuota { return nil }
+func (s *fakeStore) GetSecret(namespace, name string) *Secret                 { return nil }
+func (s *fakeStore) ListSecrets(namespace, selector string) []*Secret         { return nil }
+func (s *fakeStore) FindLatestSnapshot(pv *PV) *Snapshot                      { return nil }
+
+// Event is the EventRecorder of the store.
+func (s *fakeStore) Event(obj Object, eventType, reason, message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, reason+" "+objectKey(obj))
+}
+
+type fakePVLister struct{ s *fakeStore }
+
+func (l fakePVLister) Get(name string) *PV { return l.s.PV(name) }
+
+func (l fakePVLister) GetByKey(key string) *PV {
+	name, ok := strings.CutPrefix(key, "pv/")
+	if !ok {
+		return nil
+	}
+	return l.s.PV(name)
+}
+
+// List returns the PVs sorted by name.
+func (l fakePVLister) List() []*PV {
+	l.s.lock.Lock()
+	defer l.s.lock.Unlock()
+	list := make([]*PV, 0, len(l.s.pvs))
+	for _, pv := range l.s.pvs {
+		list = append(list, pv.DeepCopy())
+	}
+	slices.SortFunc(list, func(a, b *PV) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+type fakePVCLister struct{ s *fakeStore }
+
+func (l fakePVCLister) Get(namespace, name string) *PVClaim { return l.s.PVC(namespace, name) }
+
+func (l fakePVCLister) GetByKey(key string) *PVClaim {
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(key, "pvc/"), "/")
+	if !ok || !strings.HasPrefix(key, "pvc/") {
+		return nil
+	}
+	return l.s.PVC(namespace, name)
+}
+
+// List returns the claims sorted by namespace and name.
+func (l fakePVCLister) List() []*PVClaim {
+	l.s.lock.Lock()
+	defer l.s.lock.Unlock()
+	list := make([]*PVClaim, 0, len(l.s.pvcs))
+	for _, pvc := range l.s.pvcs {
+		list = append(list, pvc.DeepCopy())
+	}
+	slices.SortFunc(list, func(a, b *PVClaim) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+	return list
+}
+
+// errFakeAPI is an API error other than a Conflict.
+var errFakeAPI = errors.New("fake API error")
+
+// fakeClock is a Clock that only moves when the test steps it, so that
+// backoffs and timeouts expire without sleeping.  newFakeClock installs
+// it as clock.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at   time.Time
+	fire func(time.Time)
+}
+
+func newFakeClock(t testing.TB) *fakeClock {
+	c := &fakeClock{now: time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)}
+	old := clock
+	clock = c
+	t.Cleanup(func() { clock = old })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+func (c *fakeClock) Until(t time.Time) time.Duration { return t.Sub(c.Now()) }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.wait(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *fakeClock) WithDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	inner, cancel := context.WithCancel(ctx)
+	dctx := &fakeDeadlineContext{Context: inner, deadline: deadline}
+	c.wait(c.Until(deadline), func(time.Time) {
+		dctx.expired.Store(true)
+		cancel()
+	})
+	return dctx, cancel
+}
+
+// fakeDeadlineContext is the context of fakeClock.WithDeadline: its Err is
+// DeadlineExceeded once the fake clock passes the deadline.
+type fakeDeadlineContext struct {
+	context.Context
+	deadline time.Time
+	expired  atomic.Bool
+}
+
+func (ctx *fakeDeadlineContext) Deadline() (time.Time, bool) { return ctx.deadline, true }
+
+func (ctx *fakeDeadlineContext) Err() error {
+	if ctx.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return ctx.Context.Err()
+}
+
+func (c *fakeClock) wait(d time.Duration, fire func(time.Time)) {
+	c.lock.Lock()
+	at := c.now.Add(d)
+	if d > 0 {
+		c.waiters = append(c.waiters, fakeClockWaiter{at, fire})
+	}
+	c.lock.Unlock()
+	if d <= 0 {
+		fire(at)
+	}
+}
+
+// Step moves the clock forward by d and fires the timers that expire.
+func (c *fakeClock) Step(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var expired []fakeClockWaiter
+	c.waiters = slices.DeleteFunc(c.waiters, func(w fakeClockWaiter) bool {
+		if w.at.After(now) {
+			return false
+		}
+		expired = append(expired, w)
+		return true
+	})
+	c.lock.Unlock()
+	for _, w := range expired {
+		w.fire(now)
+	}
+}
@@ -0,0 +1,208 @@
+// This file holds the catalog of all user-facing messages of the storage
+// controller (events and conditions).  Messages are keyed by a stable reason
+// code and rendered from parameterized templates, so that they can be
+// translated or reworded by embedders (OverrideMessages) without touching
+// the controller, and compared against golden files.
+//
+// Never pass a literal string to recordEvent or SetCondition; add a reason
+// here.
+
+package persistentvolume
+
+import "fmt"
+
+// Reason codes.  These are part of the API: don't rename them.
+const (
+	reasonClaimSizeOutOfRange           = "ClaimSizeOutOfRange"
+	reasonExternalProvisioning          = "ExternalProvisioning"
+	reasonInvalidMountOptions           = "InvalidMountOptions"
+	reasonPreBindRefused                = "PreBindRefused"
+	reasonNamespaceNotAllowed           = "NamespaceNotAllowed"
+	reasonFixingBinding                 = "FixingBinding"
+	reasonReplacingFailedVolume         = "ReplacingFailedVolume"
+	reasonLeakedVolume                  = "LeakedVolume"
+	reasonLeakedVolumeDeleteFailed      = "LeakedVolumeDeleteFailed"
+	reasonProvisioningFailed            = "ProvisioningFailed"
+	reasonProvisioningBackoff           = "ProvisioningBackoff"
+	reasonCreatePVFailed                = "CreatePVFailed"
+	reasonClaimGroupProvisioningFailed  = "ClaimGroupProvisioningFailed"
+	reasonClaimGroupCreatePVFailed      = "ClaimGroupCreatePVFailed"
+	reasonNoProvisionerForReplacement   = "NoProvisionerForReplacement"
+	reasonNoSnapshotForReplacement      = "NoSnapshotForReplacement"
+	reasonReplacementProvisioningFailed = "ReplacementProvisioningFailed"
+	reasonReplacementCreatePVFailed     = "ReplacementCreatePVFailed"
+	reasonReplacementRebindFailed       = "ReplacementRebindFailed"
+	reasonReplacedFailedVolume          = "ReplacedFailedVolume"
+	reasonAwaitingApproval              = "AwaitingApproval"
+	reasonWaitingForApproval            = "WaitingForApproval"
+	reasonApprovalTimeoutDelete         = "ApprovalTimeoutDelete"
+	reasonApprovalTimeoutRetain         = "ApprovalTimeoutRetain"
+	reasonClockSkew                     = "ClockSkew"
+	reasonProvisioningDisabled          = "ProvisioningDisabled"
+	reasonProvisioningQuotaExceeded     = "ProvisioningQuotaExceeded"
+	reasonDeleteRefused                 = "DeleteRefused"
+	reasonSyncPanicked                  = "SyncPanicked"
+	reasonBindMutatorFailed             = "BindMutatorFailed"
+	reasonRecyclingUnsupported          = "RecyclingUnsupported"
+	reasonDeleteFailed                  = "DeleteFailed"
+	reasonNoDeleter                     = "NoDeleter"
+	reasonExternalDeletion              = "ExternalDeletion"
+	reasonDeleteBackoff                 = "DeleteBackoff"
+	reasonDeleteFailedPermanently       = "DeleteFailedPermanently"
+	reasonArchiveUnsupported            = "ArchiveUnsupported"
+	reasonArchiveFailed                 = "ArchiveFailed"
+	reasonArchived                      = "Archived"
+	reasonOrphanedAsset                 = "OrphanedAsset"
+	reasonOrphanedAssetDeleteFailed     = "OrphanedAssetDeleteFailed"
+	reasonDeleteDryRun                  = "DeleteDryRun"
+	reasonVolumeRetained                = "VolumeRetained"
+	reasonDeleteStarted                 = "DeleteStarted"
+	reasonDeleteSucceeded               = "DeleteSucceeded"
+	reasonNoRecycler                    = "NoRecycler"
+	reasonRecycleStarted                = "RecycleStarted"
+	reasonRecycleSucceeded              = "RecycleSucceeded"
+	reasonRecycleFailed                 = "RecycleFailed"
+	reasonRecycleTimedOut               = "RecycleTimedOut"
+	reasonRecycleFailedWithLogs         = "RecycleFailedWithLogs"
+	reasonRecycleBackoff                = "RecycleBackoff"
+	reasonRecycleFailedPermanently      = "RecycleFailedPermanently"
+	reasonExternalRecycling             = "ExternalRecycling"
+	reasonRecycleAsDelete               = "RecycleAsDelete"
+	reasonProvisioningQuotaAvailable    = "ProvisioningQuotaAvailable"
+	reasonClockSkewResolved             = "ClockSkewResolved"
+)
+
+// defaultMessages maps each reason to its English template (fmt verbs).
+var defaultMessages = map[string]string{
+	reasonClaimSizeOutOfRange:           "PVClaim cannot be provisioned: %v",
+	reasonExternalProvisioning:          "Waiting for a volume to be created by external provisioner %v",
+	reasonInvalidMountOptions:           "PV has invalid mount options: %v",
+	reasonPreBindRefused:                "PVClaim is pre-bound by the user, but strict binding is enabled: refusing to bind it",
+	reasonNamespaceNotAllowed:           "PVClaim requested a PV that does not allow claims from namespace %v",
+	reasonFixingBinding:                 "PVClaim is bound to PV, but not vice-versa: attempting to fix it",
+	reasonReplacingFailedVolume:         "PVClaim is bound to a failed PV: provisioning a replacement",
+	reasonLeakedVolume:                  "No deleter configured for provisioned volume, it must be deleted manually",
+	reasonLeakedVolumeDeleteFailed:      "Failed to delete provisioned volume, it must be deleted manually: %v",
+	reasonProvisioningFailed:            "Failed to provision volume: %v",
+	reasonProvisioningBackoff:           "Failed to provision volume (attempt %d): %v; next attempt at %s",
+	reasonCreatePVFailed:                "Failed to create PV for provisioned volume: %v",
+	reasonClaimGroupProvisioningFailed:  "Failed to provision volume for claim group %v: %v: rolling back",
+	reasonClaimGroupCreatePVFailed:      "Failed to create PV for claim group %v: %v",
+	reasonNoProvisionerForReplacement:   "Cannot replace failed PV: no provisioner configured",
+	reasonNoSnapshotForReplacement:      "No snapshot of failed PV found: replacement will be empty",
+	reasonReplacementProvisioningFailed: "Failed to provision replacement volume: %v",
+	reasonReplacementCreatePVFailed:     "Failed to create PV for replacement volume: %v",
+	reasonReplacementRebindFailed:       "Failed to rebind claim to replacement volume: %v",
+	reasonReplacedFailedVolume:          "PVClaim was rebound from failed PV %v to %v",
+	reasonAwaitingApproval:              "Deleting this volume needs approval: add the %v annotation",
+	reasonWaitingForApproval:            "Released PV is waiting for approval to be deleted",
+	reasonApprovalTimeoutDelete:         "Nobody approved deletion of Released PV in time: deleting it anyway",
+	reasonApprovalTimeoutRetain:         "Nobody approved deletion of Released PV in time: retaining it",
+	reasonClockSkew:                     "Local clock differs from the API server clock by %v",
+	reasonProvisioningDisabled:          "Dynamic provisioning is disabled for class %v",
+	reasonProvisioningQuotaExceeded:     "Provisioning quota of namespace %v exceeded: %v",
+	reasonDeleteRefused:                 "Refusing to delete the storage asset of PV %v: it was not provisioned by %v",
+	reasonSyncPanicked:                  "Syncing %v panicked: %v; quarantined until %v",
+	reasonBindMutatorFailed:             "Bind mutator failed: %v",
+	reasonRecyclingUnsupported:          "Recycle reclaim policy is not supported by this controller; use Delete or Retain",
+	reasonDeleteFailed:                  "Failed to delete volume: %v",
+	reasonNoDeleter:                     "No deleter configured for volume plugin of PV %v",
+	reasonExternalDeletion:              "Waiting for the volume to be deleted by external provisioner %v",
+	reasonDeleteBackoff:                 "Failed to delete volume (attempt %d): %v; next attempt at %s",
+	reasonDeleteFailedPermanently:       "Failed to delete volume %d times, giving up: %v",
+	reasonArchiveUnsupported:            "Reclaim policy is Archive, but deleter %v cannot archive volumes",
+	reasonArchiveFailed:                 "Failed to archive volume (attempt %d): %v; next attempt at %s",
+	reasonArchived:                      "Volume archived as %v, deleting it",
+	reasonOrphanedAsset:                 "Storage asset %v of plugin %v was provisioned for PV %v, which does not exist",
+	reasonOrphanedAssetDeleteFailed:     "Failed to delete orphaned storage asset %v of plugin %v: %v",
+	reasonDeleteDryRun:                  "Dry run: would delete storage asset %v with deleter %v",
+	reasonVolumeRetained:                "Volume released; reclaim policy is Retain, it must be cleaned up manually",
+	reasonDeleteStarted:                 "Deleting storage asset %v with deleter %v",
+	reasonDeleteSucceeded:               "Deleted storage asset %v",
+	reasonNoRecycler:                    "No recycler configured for volume plugin of PV %v",
+	reasonRecycleStarted:                "Recycling volume with scrubber %v",
+	reasonRecycleSucceeded:              "Volume recycled",
+	reasonRecycleFailed:                 "Failed to recycle volume: %v",
+	reasonRecycleTimedOut:               "Scrubber %v did not finish within %v: deleted it",
+	reasonRecycleFailedWithLogs:         "Failed to recycle volume: %v; last lines of the scrubber pod log:\n%v",
+	reasonRecycleBackoff:                "Failed to recycle volume (attempt %d): %v; next attempt at %s",
+	reasonRecycleFailedPermanently:      "Failed to recycle volume %d times, giving up: %v",
+	reasonExternalRecycling:             "Waiting for the volume to be recycled by %v",
+	reasonRecycleAsDelete:               "Reclaim policy Recycle is treated as Delete by this controller; change the policy of this PV to Delete",
+	reasonProvisioningQuotaAvailable:    "Provisioning quota of namespace %v is no longer exceeded",
+	reasonClockSkewResolved:             "Local clock agrees with the API server clock again, within %v",
+}
+
+// messages is defaultMessages with the embedder's overrides applied.
+var messages = defaultMessages
+
+// OverrideMessages replaces the templates of the given reasons, e.g. with
+// translations.  It must be called before initController.  Templates must
+// take the same arguments, in the same order, as the defaults.
+func OverrideMessages(overrides map[string]string) {
+	merged := map[string]string{}
+	for reason, template := range defaultMessages {
+		merged[reason] = template
+	}
+	for reason, template := range overrides {
+		merged[reason] = template
+	}
+	messages = merged
+}
+
+// message renders the message for a reason.
+func message(reason string, args ...interface{}) string {
+	template, found := messages[reason]
+	if !found {
+		// A reason without a template is a bug; still say something.
+		return reason + fmt.Sprint(args...)
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// normalReasons are the reasons of events of type Normal: progress that
+// needs no action.  All others are Warnings, which is what alerting on
+// events usually selects.
+var normalReasons = map[string]bool{
+	reasonExternalProvisioning:  true,
+	reasonReplacingFailedVolume: true,
+	reasonReplacedFailedVolume:  true,
+	reasonWaitingForApproval:    true,
+	reasonAwaitingApproval:      true,
+	reasonExternalDeletion:      true,
+	reasonDeleteDryRun:          true,
+	reasonVolumeRetained:        true,
+	reasonDeleteStarted:         true,
+	reasonDeleteSucceeded:       true,
+	reasonArchived:              true,
+	reasonRecycleStarted:        true,
+	reasonRecycleSucceeded:      true,
+	reasonExternalRecycling:     true,
+	reasonClockSkewResolved:     true,
+}
+
+// recorder sends the events of the controller to the API server, with the
+// reason as a separate, machine-readable field.  ControllerOptions may
+// replace it.
+var recorder EventRecorder = NewEventRecorder("persistentvolume-controller")
+
+// recordEvent records an event with the given reason on obj, the PV or
+// claim it is about, with the message of the reason rendered from args.
+// An event about no API object in particular (an orphaned asset, clock
+// skew) has a nil obj and is only logged.
+func recordEvent(obj Object, reason string, args ...interface{}) {
+	eventType := EventTypeWarning
+	if normalReasons[reason] {
+		eventType = EventTypeNormal
+	}
+	if observeOnly {
+		// The recorder may not go through our (dry-run) client.
+		log.Info("observe-only: would record event", "type", eventType, "reason", reason, "message", message(reason, args...))
+		return
+	}
+	if obj == nil {
+		log.Info("event", "type", eventType, "reason", reason, "message", message(reason, args...))
+		return
+	}
+	recorder.Event(obj, eventType, reason, message(reason, args...))
+}
@@ -0,0 +1,96 @@
+package persistentvolume
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The catalog is part of the API: a reworded message shows up in
+// testdata/messages.golden, to be reviewed like any other API change.
+// Run the tests with -update to rewrite it.
+func TestMessagesGolden(t *testing.T) {
+	reasons := []string{}
+	for reason := range defaultMessages {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+	var b strings.Builder
+	for _, reason := range reasons {
+		eventType := EventTypeWarning
+		if normalReasons[reason] {
+			eventType = EventTypeNormal
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", reason, eventType, defaultMessages[reason])
+	}
+	const golden = "testdata/messages.golden"
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != string(expected) {
+		t.Errorf("the catalog differs from %s; run with -update if that is intended:\n%s", golden, got)
+	}
+}
+
+// Every reason code has a template, and every template a reason code.
+func TestMessagesComplete(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "messages.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := map[string]bool{}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			for i, name := range spec.(*ast.ValueSpec).Names {
+				if !strings.HasPrefix(name.Name, "reason") {
+					continue
+				}
+				value := strings.Trim(spec.(*ast.ValueSpec).Values[i].(*ast.BasicLit).Value, `"`)
+				declared[value] = true
+				if _, found := defaultMessages[value]; !found {
+					t.Errorf("%s has no template", name.Name)
+				}
+			}
+		}
+	}
+	for reason := range defaultMessages {
+		if !declared[reason] {
+			t.Errorf("template for undeclared reason %s", reason)
+		}
+	}
+	for reason := range normalReasons {
+		if !declared[reason] {
+			t.Errorf("normal event for undeclared reason %s", reason)
+		}
+	}
+}
+
+func TestOverrideMessages(t *testing.T) {
+	old := messages
+	t.Cleanup(func() { messages = old })
+	OverrideMessages(map[string]string{reasonVolumeRetained: "Volume behalten"})
+	if got := message(reasonVolumeRetained); got != "Volume behalten" {
+		t.Errorf("expected the override, got %q", got)
+	}
+	if got, expected := message(reasonInvalidMountOptions, "hard"), "PV has invalid mount options: hard"; got != expected {
+		t.Errorf("expected the default %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,107 @@
+// This file defines how the storage controller reports metrics.  The
+// controller only talks to the Metrics interface; Prometheus is the
+// default, and embedders using something else (OpenTelemetry, statsd, ...)
+// pass their own implementation in ControllerOptions.Metrics.
+
+package persistentvolume
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics creates the metrics the controller reports.  Implementations must
+// be safe for concurrent use and must return the same metric for the same
+// name and labels.
+type Metrics interface {
+	Counter(name string, labels ...string) Counter
+	Gauge(name string, labels ...string) Gauge
+	Histogram(name string, labels ...string) Histogram
+}
+
+// Counter only goes up.
+type Counter interface {
+	Inc()
+	Add(delta float64)
+}
+
+// Gauge goes up and down.
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram records observations, e.g. durations in seconds.
+type Histogram interface {
+	Observe(value float64)
+}
+
+// metrics is set by initController.
+var metrics Metrics = newPrometheusMetrics()
+
+// prometheusMetrics registers every metric with the default Prometheus
+// registry the first time it is asked for.  Labels are given as alternating
+// names and values: Counter("x_total", "mode", "Default").
+type prometheusMetrics struct {
+	lock       sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		counters:   map[string]*prometheus.CounterVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+	}
+}
+
+func (m *prometheusMetrics) Counter(name string, labels ...string) Counter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names, values := splitLabels(labels)
+	vec, found := m.counters[name]
+	if !found {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, names)
+		prometheus.MustRegister(vec)
+		m.counters[name] = vec
+	}
+	return vec.WithLabelValues(values...)
+}
+
+func (m *prometheusMetrics) Gauge(name string, labels ...string) Gauge {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names, values := splitLabels(labels)
+	vec, found := m.gauges[name]
+	if !found {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, names)
+		prometheus.MustRegister(vec)
+		m.gauges[name] = vec
+	}
+	return vec.WithLabelValues(values...)
+}
+
+func (m *prometheusMetrics) Histogram(name string, labels ...string) Histogram {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names, values := splitLabels(labels)
+	vec, found := m.histograms[name]
+	if !found {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name}, names)
+		prometheus.MustRegister(vec)
+		m.histograms[name] = vec
+	}
+	return vec.WithLabelValues(values...)
+}
+
+// splitLabels splits alternating label names and values.
+func splitLabels(labels []string) (names, values []string) {
+	for i := 0; i+1 < len(labels); i += 2 {
+		names = append(names, labels[i])
+		values = append(values, labels[i+1])
+	}
+	return names, values
+}
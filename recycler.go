@@ -0,0 +1,559 @@
+//go:build !norecycler
+
+// This file holds the recycler: the code that scrubs Released volumes with
+// the Recycle reclaim policy by running a scrubber pod on them.  Recycling
+// is deprecated; build with the "norecycler" tag to leave this out, see
+// recycler_disabled.go.
+
+package persistentvolume
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const recyclerCompiledIn = true
+
+// RecyclerPlugin is implemented by volume plugins whose volumes can be
+// scrubbed by a pod (typically "rm -rf" of the volume's contents).
+type RecyclerPlugin interface {
+	Name() string
+	// NewScrubberPod returns a pod that mounts pv, scrubs it and exits
+	// with status 0 on success.  The controller sets its name and
+	// namespace.
+	NewScrubberPod(pv *PV) *Pod
+}
+
+// recyclerPlugins is filled by RegisterRecyclerPlugin at controller start
+// and read-only afterwards.  Keyed by volume source type, like
+// deleterPlugins.
+var recyclerPlugins = map[string]RecyclerPlugin{}
+
+// RegisterRecyclerPlugin must be called before initController.  Only one
+// plugin may handle a volume source type.
+func RegisterRecyclerPlugin(sourceType string, plugin RecyclerPlugin) {
+	if existing, found := recyclerPlugins[sourceType]; found {
+		panic(fmt.Sprintf("recycler plugins %s and %s both registered for volume source %s", existing.Name(), plugin.Name(), sourceType))
+	}
+	recyclerPlugins[sourceType] = plugin
+}
+
+func findRecyclerPluginForPV(pv *PV) RecyclerPlugin {
+	return recyclerPlugins[volumeSourceType(pv)]
+}
+
+// Scrubber pods run in this namespace, unless their template says
+// otherwise.  Many clusters do not allow privileged pods in kube-system.
+// Set from a command line flag.
+var recyclerNamespace = "kube-system"
+
+// scrubberPodTemplates holds the templates per recycler plugin name, from
+// the controller configuration file.  A class may override it with its
+// RecyclerPodTemplate.  defaultScrubberPodTemplate applies to all scrubber
+// pods that have neither, e.g. resource requests required by a namespace
+// quota.
+var scrubberPodTemplates = map[string]*ScrubberPodTemplate{}
+var defaultScrubberPodTemplate *ScrubberPodTemplate
+
+// scrubberPodTemplateFor returns the template for the scrubber pod of pv:
+// the one of its class, or else the one of the plugin, or else the default.
+func scrubberPodTemplateFor(pv *PV, plugin RecyclerPlugin) *ScrubberPodTemplate {
+	if class := api.GetClass(pv.Spec.StorageClassName); class != nil && class.RecyclerPodTemplate != nil {
+		return class.RecyclerPodTemplate
+	}
+	if tmpl, found := scrubberPodTemplates[plugin.Name()]; found {
+		return tmpl
+	}
+	return defaultScrubberPodTemplate
+}
+
+func applyScrubberPodTemplate(pod *Pod, tmpl *ScrubberPodTemplate) {
+	if tmpl == nil {
+		return
+	}
+	// Scrubber pods have one container; the plugin decides how it
+	// mounts the volume, and that is not overridable.
+	container := &pod.Spec.Containers[0]
+	if tmpl.Namespace != "" {
+		pod.Namespace = tmpl.Namespace
+	}
+	if tmpl.SecurityContext != nil {
+		pod.Spec.SecurityContext = tmpl.SecurityContext
+	}
+	if tmpl.Image != "" {
+		container.Image = tmpl.Image
+	}
+	if len(tmpl.Command) > 0 {
+		container.Command = tmpl.Command
+	}
+	if !tmpl.Resources.IsEmpty() {
+		container.Resources = tmpl.Resources
+	}
+	if len(tmpl.NodeSelector) > 0 {
+		pod.Spec.NodeSelector = tmpl.NodeSelector
+	}
+	if tmpl.ServiceAccountName != "" {
+		pod.Spec.ServiceAccountName = tmpl.ServiceAccountName
+	}
+}
+
+// A scrubber pod that has not finished this long after it was created is
+// deleted and the PV is marked Failed.  Set from a command line flag.
+var recycleTimeout = 30 * time.Minute
+
+// How much of the log of a failed scrubber pod goes into the event.  Events
+// are limited in size; the tail is where the error is.
+const (
+	scrubberLogTailLines = 20
+	scrubberLogTailBytes = 1024
+)
+
+// scrubberPodLogTail returns the end of the log of a scrubber pod, or "" if
+// it cannot be read (e.g. the container never started).
+func scrubberPodLogTail(pod *Pod) string {
+	logs, err := pods.GetPodLogs(pod.Namespace, pod.Name, scrubberLogTailLines)
+	if err != nil {
+		return ""
+	}
+	if len(logs) > scrubberLogTailBytes {
+		logs = "..." + logs[len(logs)-scrubberLogTailBytes:]
+	}
+	return logs
+}
+
+// setScrubberNodeAffinity makes the scrubber pod of a local or zonal PV run
+// on a node that can mount the PV, by requiring the node affinity of the PV.
+// It comes on top of any node selector or affinity from the plugin or the
+// template, which can only narrow it down further.
+func setScrubberNodeAffinity(pod *Pod, pv *PV) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &PodNodeAffinity{}
+	}
+	affinity := pod.Spec.Affinity.NodeAffinity
+	if affinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		affinity.RequiredDuringSchedulingIgnoredDuringExecution = pv.Spec.NodeAffinity.Required
+		return
+	}
+	affinity.RequiredDuringSchedulingIgnoredDuringExecution = intersectNodeSelectors(affinity.RequiredDuringSchedulingIgnoredDuringExecution, pv.Spec.NodeAffinity.Required)
+}
+
+// intersectNodeSelectors returns a node selector that selects the nodes
+// selected by both a and b.  Terms are ORed and the expressions of a term
+// ANDed, so each term of the result is a term of a with the expressions of
+// a term of b added, for every pair of terms.
+func intersectNodeSelectors(a, b *NodeSelector) *NodeSelector {
+	result := &NodeSelector{}
+	for _, termA := range a.Terms {
+		for _, termB := range b.Terms {
+			result.Terms = append(result.Terms, NodeSelectorTerm{
+				MatchExpressions: slices.Concat(termA.MatchExpressions, termB.MatchExpressions),
+			})
+		}
+	}
+	return result
+}
+
+// This label applies to scrubber pods.  Its value is the UID of the PV the
+// pod scrubs; a pod with the right name but without it is not ours.
+const labelRecyclerFor = "pv.kubernetes.io/recycler-for"
+
+// scrubberPodName returns the name of the scrubber pod of pv.  It depends
+// only on the PV UID, so that a controller that restarts (or a new leader)
+// finds the pod its predecessor created instead of starting another one.
+func scrubberPodName(pv *PV) string {
+	return "pv-recycler-" + string(pv.UID)
+}
+
+// recycleVolume scrubs a Released PV whose reclaim policy is Recycle and
+// makes it Available again.
+func recycleVolume(pv *PV) syncResult {
+	plugin := findRecyclerPluginForPV(pv)
+	if plugin == nil && externalRecycler != "" {
+		return recycleVolumeExternally(pv)
+	} else if plugin == nil {
+		recordEvent(pv, reasonNoRecycler, pv.Name)
+		pv.Status.Phase = Failed
+		if err := CommitPVStatus(pv); err != nil {
+			return requeueAfter(retryAfterAPIError)
+		}
+		return done
+	}
+	if !recyclingBackoff.IsAllowed(pv.UID) {
+		// The last attempt failed; wait.
+		_, next := recyclingBackoff.Get(pv.UID)
+		return requeueAfter(clock.Until(next))
+	}
+	if !acquireRecyclerSlot() {
+		// Too many scrubber pods running; the PV stays Released.
+		return requeueAfter(retryWhileProvisioning)
+	}
+	// runningRecyclers keeps one monitoring goroutine per PV; the resync
+	// loop gets here every 15s while a scrub may take much longer.
+	started := runningRecyclers.Run(string(pv.UID), "pv/"+pv.Name, func(ctx context.Context) {
+		defer releaseRecyclerSlot()
+		// The PV may have changed since the sync that launched us (e.g.
+		// the admin set the policy to Retain, or another instance
+		// already recycled it).
+		current := api.GetPVFromServer(pv.Name)
+		if current == nil || current.UID != pv.UID || current.Status.Phase != Released || current.Spec.ReclaimPolicy != "Recycle" {
+			return
+		}
+		pv = current
+
+		pod := plugin.NewScrubberPod(pv)
+		pod.Namespace = recyclerNamespace
+		applyScrubberPodTemplate(pod, scrubberPodTemplateFor(pv, plugin))
+		setScrubberNodeAffinity(pod, pv)
+		pod.Name = scrubberPodName(pv)
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[labelRecyclerFor] = string(pv.UID)
+		scrubber := newScrubber(pod)
+		start := clock.Now()
+		if err := scrubber.Create(); IsAlreadyExists(err) {
+			// We (or the previous leader) started it before a restart.
+			// Adopt it: wait for it like for our own.  The scrub may have
+			// finished already, then the wait returns at once.
+			labels, created, found := scrubber.Get()
+			if !found {
+				// Deleted in between; the next syncPV creates it again.
+				return
+			}
+			if labels[labelRecyclerFor] != string(pv.UID) {
+				// Not a scrubber of ours; do not touch it.
+				recordEvent(pv, reasonRecycleFailed, fmt.Errorf("%s exists and is not a scrubber of this PV", scrubber))
+				return
+			}
+			start = created
+		} else if err != nil {
+			recycleFailed(pv, nil, err)
+			return
+		} else {
+			recordEvent(pv, reasonRecycleStarted, scrubber)
+		}
+
+		// start is the creation time of an adopted scrubber, so a restart
+		// does not give a stuck one another full timeout.
+		waitCtx, cancel := clock.WithDeadline(ctx, start.Add(recycleTimeout))
+		defer cancel()
+		err := scrubber.Wait(waitCtx)
+		if err != nil && shuttingDown(ctx) {
+			// Leave the scrubber running; the next leader adopts it.
+			return
+		}
+		var logs string
+		if err != nil {
+			// Get them while the pod is still there; the admin should not
+			// have to hunt for them.
+			logs = scrubber.LogTail()
+		}
+		if err != nil && waitCtx.Err() == context.DeadlineExceeded {
+			// Stuck (image pull, unschedulable, hung mount, ...).  Do not
+			// watch it forever; this counts as a failed attempt below.
+			scrubber.Delete()
+			recordEvent(pv, reasonRecycleTimedOut, scrubber, recycleTimeout)
+		}
+		if err != nil {
+			observeReclaim(pv, plugin.Name(), "failed", start)
+			if logs != "" {
+				recordEvent(pv, reasonRecycleFailedWithLogs, err, logs)
+			}
+			recycleFailed(pv, scrubber, err)
+			return
+		}
+		observeReclaim(pv, plugin.Name(), "succeeded", start)
+		recyclingBackoff.Forget(pv.UID)
+
+		if err := makeRecycledPVAvailable(pv); err != nil {
+			// syncPV finishes the job; see makeRecycledPVAvailable.
+			recordEvent(pv, reasonRecycleFailed, err)
+			enqueue("pv/"+pv.Name, retryAfterAPIError)
+			return
+		}
+		recordEvent(pv, reasonRecycleSucceeded)
+		scrubber.Delete()
+	})
+	if !started {
+		releaseRecyclerSlot()
+	}
+	return done
+}
+
+// PodAPI runs scrubber pods and Jobs on the API server.
+type PodAPI interface {
+	CreatePod(pod *Pod) error
+	// GetPod and GetJob return nil if there is no such object.
+	GetPod(namespace, name string) *Pod
+	DeletePod(namespace, name string) error
+	// WaitForPodCompletion returns the phase the pod ended in.
+	WaitForPodCompletion(ctx context.Context, namespace, name string) (PodPhase, error)
+	GetPodLogs(namespace, name string, lines int) (string, error)
+	CreateJob(job *Job) error
+	GetJob(namespace, name string) *Job
+	DeleteJob(namespace, name string, propagation DeletionPropagation) error
+	// WaitForJobCompletion returns false if the Job failed.
+	WaitForJobCompletion(ctx context.Context, namespace, name string) (bool, error)
+	GetLatestJobPod(namespace, name string) *Pod
+}
+
+// pods is the PodAPI of the recycler; tests replace it with a fake.
+var pods PodAPI = libraryPods{}
+
+// libraryPods is the client library's PodAPI.
+type libraryPods struct{}
+
+func (libraryPods) CreatePod(pod *Pod) error               { return CreatePod(pod) }
+func (libraryPods) GetPod(namespace, name string) *Pod     { return GetPod(namespace, name) }
+func (libraryPods) DeletePod(namespace, name string) error { return DeletePod(namespace, name) }
+func (libraryPods) CreateJob(job *Job) error               { return CreateJob(job) }
+func (libraryPods) GetJob(namespace, name string) *Job     { return GetJob(namespace, name) }
+
+func (libraryPods) WaitForPodCompletion(ctx context.Context, namespace, name string) (PodPhase, error) {
+	return WaitForPodCompletion(ctx, namespace, name)
+}
+
+func (libraryPods) GetPodLogs(namespace, name string, lines int) (string, error) {
+	return GetPodLogs(namespace, name, lines)
+}
+
+func (libraryPods) DeleteJob(namespace, name string, propagation DeletionPropagation) error {
+	return DeleteJob(namespace, name, propagation)
+}
+
+func (libraryPods) WaitForJobCompletion(ctx context.Context, namespace, name string) (bool, error) {
+	return WaitForJobCompletion(ctx, namespace, name)
+}
+
+func (libraryPods) GetLatestJobPod(namespace, name string) *Pod {
+	return GetLatestJobPod(namespace, name)
+}
+
+// If set, scrubber pods are run by Jobs, which retry a failed pod
+// recyclerJobBackoffLimit times before the attempt counts as failed here.
+// The Job gets the name and label the pod would have had, so adoption works
+// the same way.  Set from a command line flag.
+var recycleWithJobs = false
+var recyclerJobBackoffLimit = 3
+
+// scrubber runs a scrubber pod, either bare or in a Job.
+type scrubber interface {
+	// Create returns an AlreadyExists error if it was created before.
+	Create() error
+	// Get returns the labels and creation time of the existing object.
+	Get() (labels map[string]string, created time.Time, found bool)
+	// Wait returns nil when the scrub succeeded.
+	Wait(ctx context.Context) error
+	// LogTail returns the end of the log of the (last) pod.
+	LogTail() string
+	Delete()
+	// String is for events.
+	String() string
+}
+
+func newScrubber(pod *Pod) scrubber {
+	if recycleWithJobs {
+		return &jobScrubber{pod: pod}
+	}
+	return &podScrubber{pod: pod}
+}
+
+type podScrubber struct {
+	pod *Pod
+}
+
+func (s *podScrubber) Create() error {
+	return pods.CreatePod(s.pod)
+}
+
+func (s *podScrubber) Get() (map[string]string, time.Time, bool) {
+	existing := pods.GetPod(s.pod.Namespace, s.pod.Name)
+	if existing == nil {
+		return nil, time.Time{}, false
+	}
+	return existing.Labels, existing.CreationTimestamp, true
+}
+
+func (s *podScrubber) Wait(ctx context.Context) error {
+	phase, err := pods.WaitForPodCompletion(ctx, s.pod.Namespace, s.pod.Name)
+	if err == nil && phase != Succeeded {
+		err = fmt.Errorf("scrubber pod %s/%s ended in phase %s", s.pod.Namespace, s.pod.Name, phase)
+	}
+	return err
+}
+
+func (s *podScrubber) LogTail() string {
+	return scrubberPodLogTail(s.pod)
+}
+
+func (s *podScrubber) Delete() {
+	pods.DeletePod(s.pod.Namespace, s.pod.Name)
+}
+
+func (s *podScrubber) String() string {
+	return "pod " + s.pod.Namespace + "/" + s.pod.Name
+}
+
+type jobScrubber struct {
+	pod *Pod
+}
+
+func (s *jobScrubber) Create() error {
+	job := &Job{}
+	job.Name = s.pod.Name
+	job.Namespace = s.pod.Namespace
+	job.Labels = s.pod.Labels
+	job.Spec.BackoffLimit = recyclerJobBackoffLimit
+	job.Spec.Template = s.pod
+	return pods.CreateJob(job)
+}
+
+func (s *jobScrubber) Get() (map[string]string, time.Time, bool) {
+	existing := pods.GetJob(s.pod.Namespace, s.pod.Name)
+	if existing == nil {
+		return nil, time.Time{}, false
+	}
+	return existing.Labels, existing.CreationTimestamp, true
+}
+
+func (s *jobScrubber) Wait(ctx context.Context) error {
+	// The Job controller retries failed pods; we only see the outcome.
+	complete, err := pods.WaitForJobCompletion(ctx, s.pod.Namespace, s.pod.Name)
+	if err == nil && !complete {
+		err = fmt.Errorf("scrubber job %s/%s failed after %d retries", s.pod.Namespace, s.pod.Name, recyclerJobBackoffLimit)
+	}
+	return err
+}
+
+func (s *jobScrubber) LogTail() string {
+	pod := pods.GetLatestJobPod(s.pod.Namespace, s.pod.Name)
+	if pod == nil {
+		return ""
+	}
+	return scrubberPodLogTail(pod)
+}
+
+func (s *jobScrubber) Delete() {
+	// With its pods, or the logs of the failed ones pile up.
+	pods.DeleteJob(s.pod.Namespace, s.pod.Name, PropagationBackground)
+}
+
+func (s *jobScrubber) String() string {
+	return "job " + s.pod.Namespace + "/" + s.pod.Name
+}
+
+// If set, Released PVs with the Recycle policy that no in-tree recycler
+// handles are handed to an out-of-process recycler of this name.  Set from
+// a command line flag.
+var externalRecycler = ""
+
+// recycleVolumeExternally drives the annotation handoff to externalRecycler.
+// Each step is one API write; the PV MODIFY events bring us back.
+func recycleVolumeExternally(pv *PV) syncResult {
+	if pv.Annotations[annRecycleCompleted] == string(pv.UID) {
+		delete(pv.Annotations, annRecycleRequested)
+		delete(pv.Annotations, annRecycleCompleted)
+		if err := makeRecycledPVAvailable(pv); err != nil {
+			return requeueAfter(retryAfterAPIError)
+		}
+		recordEvent(pv, reasonRecycleSucceeded)
+		return done
+	}
+	if !hasAnnotation(pv, annRecycleRequested) {
+		setAnnotationValue(pv, annRecycleRequested, externalRecycler)
+		if err := CommitPV(pv); err != nil {
+			return requeueAfter(retryAfterAPIError)
+		}
+		recordEvent(pv, reasonExternalRecycling, externalRecycler)
+	}
+	// Still waiting; an agent that died is the admin's problem.
+	return done
+}
+
+// After this many consecutive failed attempts to recycle a PV, give up and
+// mark it Failed.  Zero means retry forever.  Set from a command line flag.
+var maxRecycleAttempts = 3
+
+// recycleFailed records a failed recycle attempt.  The PV stays Released and
+// is retried after a backoff, until maxRecycleAttempts is reached.  scrubber
+// is the failed scrubber, if it was created.
+func recycleFailed(pv *PV, scrubber scrubber, err error) {
+	attempts, next := recyclingBackoff.Failed(pv.UID, err)
+	if maxRecycleAttempts == 0 || attempts < maxRecycleAttempts {
+		recordEvent(pv, reasonRecycleBackoff, attempts, err, next)
+		if scrubber != nil {
+			// The next attempt creates one with the same name.
+			scrubber.Delete()
+		}
+		return
+	}
+	// The last scrubber is left for the admin to look at.
+	recordEvent(pv, reasonRecycleFailedPermanently, attempts, err)
+	pv.Status.Phase = Failed
+	pv.Status.Message = message(reasonRecycleFailedPermanently, attempts, err)
+	if err := CommitPVStatus(pv); err != nil {
+		// The next syncPV recycles once more, fails and gets here again.
+		return
+	}
+	recyclingBackoff.Forget(pv.UID)
+}
+
+// makeRecycledPVAvailable unbinds a scrubbed PV and marks it Available.
+//
+// The spec goes first.  If the status update fails, the PV is Released
+// with ClaimPtr cleared (or reserved by name with no UID), and syncPV
+// makes it Available without recycling it again.  The other way around, a
+// failed spec update would leave an Available PV pointing to the deleted
+// claim, and syncPV would release and scrub it once more.
+func makeRecycledPVAvailable(pv *PV) error {
+	// A PV pre-bound by the user stays reserved for a claim of that name;
+	// one bound by us goes back into the pool.
+	pv.Spec.ClaimPtr.UID = ""
+	if hasAnnotation(pv, annBoundByController) {
+		pv.Spec.ClaimPtr = nil
+		delete(pv.Annotations, annBoundByController)
+	}
+	// Not bound any more; see finalizerPVProtection.
+	removeFinalizer(pv, finalizerPVProtection)
+	if err := CommitPV(pv); err != nil {
+		return err
+	}
+	pv.Status.Phase = Available
+	return CommitPVStatus(pv)
+}
+
+// Limit on the number of scrubber pods (adopted ones included) at the same
+// time, so that deleting a namespace full of claims does not flood the
+// cluster with "rm -rf" pods.  Zero means no limit.  Set from a command
+// line flag.
+var maxRecyclers = 10
+
+var recyclerSlots = struct {
+	lock    sync.Mutex
+	running int
+}{}
+
+func acquireRecyclerSlot() bool {
+	recyclerSlots.lock.Lock()
+	defer recyclerSlots.lock.Unlock()
+	if maxRecyclers > 0 && recyclerSlots.running >= maxRecyclers {
+		return false
+	}
+	recyclerSlots.running++
+	return true
+}
+
+func releaseRecyclerSlot() {
+	recyclerSlots.lock.Lock()
+	defer recyclerSlots.lock.Unlock()
+	recyclerSlots.running--
+}
@@ -0,0 +1,14 @@
+//go:build norecycler
+
+// This file replaces recycler.go in builds with the "norecycler" tag, which
+// guarantees that no scrubber pod is ever launched.  Released volumes with
+// the Recycle reclaim policy are marked Failed.
+
+package persistentvolume
+
+const recyclerCompiledIn = false
+
+func recycleVolume(pv *PV) syncResult {
+	// Not reached: syncPV checks recyclerCompiledIn first.
+	return done
+}
@@ -0,0 +1,336 @@
+//go:build !norecycler
+
+package persistentvolume
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIntersectNodeSelectors(t *testing.T) {
+	in := func(key string, values ...string) NodeSelectorRequirement {
+		return NodeSelectorRequirement{Key: key, Operator: "In", Values: values}
+	}
+	term := func(requirements ...NodeSelectorRequirement) NodeSelectorTerm {
+		return NodeSelectorTerm{MatchExpressions: requirements}
+	}
+	a := &NodeSelector{Terms: []NodeSelectorTerm{term(in("pool", "scrub")), term(in("pool", "any"))}}
+	b := &NodeSelector{Terms: []NodeSelectorTerm{term(in("zone", "a")), term(in("zone", "b"))}}
+	expected := &NodeSelector{Terms: []NodeSelectorTerm{
+		term(in("pool", "scrub"), in("zone", "a")),
+		term(in("pool", "scrub"), in("zone", "b")),
+		term(in("pool", "any"), in("zone", "a")),
+		term(in("pool", "any"), in("zone", "b")),
+	}}
+	if got := intersectNodeSelectors(a, b); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+// fakePods is the PodAPI of a test; newFakePods installs it.  Once release
+// is closed, a pod ends in its phase in results; a pod without one runs
+// until the wait is cancelled.  Jobs are not supported.
+type fakePods struct {
+	lock    sync.Mutex
+	pods    map[string]*Pod
+	results map[string]PodPhase
+	logs    string
+	release chan struct{}
+	// The names of the pods created and deleted, in order.
+	created, deleted []string
+	// Gets the name of each pod waited for.
+	waiting chan string
+}
+
+func newFakePods(t *testing.T) *fakePods {
+	f := &fakePods{
+		pods:    map[string]*Pod{},
+		results: map[string]PodPhase{},
+		release: make(chan struct{}),
+		waiting: make(chan string, 10),
+	}
+	close(f.release)
+	old := pods
+	pods = f
+	t.Cleanup(func() { pods = old })
+	return f
+}
+
+func (f *fakePods) CreatePod(pod *Pod) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := pod.Namespace + "/" + pod.Name
+	if f.pods[key] != nil {
+		return NewAlreadyExists("pod", pod.Name)
+	}
+	pod.CreationTimestamp = clock.Now()
+	f.pods[key] = pod
+	f.created = append(f.created, pod.Name)
+	return nil
+}
+
+func (f *fakePods) GetPod(namespace, name string) *Pod {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.pods[namespace+"/"+name]
+}
+
+func (f *fakePods) DeletePod(namespace, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.pods[namespace+"/"+name] == nil {
+		return NewNotFound("pod", name)
+	}
+	delete(f.pods, namespace+"/"+name)
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func (f *fakePods) WaitForPodCompletion(ctx context.Context, namespace, name string) (PodPhase, error) {
+	f.waiting <- name
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	f.lock.Lock()
+	phase, found := f.results[name]
+	f.lock.Unlock()
+	if !found {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return phase, nil
+}
+
+func (f *fakePods) GetPodLogs(namespace, name string, lines int) (string, error) {
+	return f.logs, nil
+}
+
+func (f *fakePods) CreateJob(job *Job) error                    { return errFakeUnsupported }
+func (f *fakePods) GetJob(namespace, name string) *Job          { return nil }
+func (f *fakePods) GetLatestJobPod(namespace, name string) *Pod { return nil }
+
+func (f *fakePods) DeleteJob(namespace, name string, propagation DeletionPropagation) error {
+	return errFakeUnsupported
+}
+
+func (f *fakePods) WaitForJobCompletion(ctx context.Context, namespace, name string) (bool, error) {
+	return false, errFakeUnsupported
+}
+
+// testRecycler scrubs NFS volumes.
+type testRecycler struct{}
+
+func (testRecycler) Name() string { return "test-recycler" }
+
+func (testRecycler) NewScrubberPod(pv *PV) *Pod {
+	pod := &Pod{}
+	pod.Spec.Containers = []Container{{Name: "scrubber", Image: "busybox", Command: []string{"rm", "-rf", "/scrub/*"}}}
+	return pod
+}
+
+// newRecyclerTest returns a store with a Released NFS volume to recycle,
+// bound by the controller to a claim that is gone, and the fake pods.
+func newRecyclerTest(t *testing.T) (*fakeStore, *fakePods) {
+	store := newFakeStore(t)
+	newOperations(t)
+	old := recyclerPlugins
+	recyclerPlugins = map[string]RecyclerPlugin{"nfs": testRecycler{}}
+	t.Cleanup(func() { recyclerPlugins = old })
+	pv := releasedVolume("volume")
+	pv.Spec.ReclaimPolicy = "Recycle"
+	delete(pv.Annotations, annDynamicallyProvisioned)
+	setAnnotation(pv, annBoundByController)
+	store.AddPV(pv)
+	return store, newFakePods(t)
+}
+
+const testScrubberPod = "pv-recycler-volume-uid"
+
+func TestRecycleVolume(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	fake.results[testScrubberPod] = Succeeded
+
+	if result := syncVolumeFromCache(t, "volume")(); result != done {
+		t.Errorf("expected done, got %+v", result)
+	}
+	runningRecyclers.wg.Wait()
+	if !slices.Equal(fake.created, []string{testScrubberPod}) || !slices.Equal(fake.deleted, []string{testScrubberPod}) {
+		t.Errorf("expected the scrubber pod created and deleted, got %v and %v", fake.created, fake.deleted)
+	}
+	pv := store.PV("volume")
+	if pv.Status.Phase != Available || pv.Spec.ClaimPtr != nil || hasFinalizer(pv, finalizerPVProtection) {
+		t.Errorf("expected the PV Available and unbound, got %+v", pv)
+	}
+	expected := []string{"RecycleStarted pv/volume", "RecycleSucceeded pv/volume"}
+	if events := store.Events(); !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestRecycleVolumeScrubberPod(t *testing.T) {
+	_, fake := newRecyclerTest(t)
+	fake.results[testScrubberPod] = Succeeded
+	fake.release = make(chan struct{})
+
+	syncVolumeFromCache(t, "volume")()
+	<-fake.waiting
+	pod := fake.GetPod(recyclerNamespace, testScrubberPod)
+	if pod == nil || pod.Labels[labelRecyclerFor] != "volume-uid" {
+		t.Errorf("expected the scrubber pod labelled with the PV UID, got %+v", pod)
+	}
+	close(fake.release)
+	runningRecyclers.wg.Wait()
+}
+
+// Syncs of a PV while its scrubber runs don't start another one.
+func TestRecycleVolumeDuplicates(t *testing.T) {
+	_, fake := newRecyclerTest(t)
+	fake.results[testScrubberPod] = Succeeded
+	fake.release = make(chan struct{})
+
+	syncVolumeFromCache(t, "volume")()
+	<-fake.waiting
+	for range 3 {
+		if result := syncVolumeFromCache(t, "volume")(); result != done {
+			t.Errorf("expected done, got %+v", result)
+		}
+	}
+	if got := runningRecyclers.Snapshot(); !reflect.DeepEqual(got, map[string]string{"volume-uid": "pv/volume"}) {
+		t.Errorf("expected one recycler for the volume, got %v", got)
+	}
+	close(fake.release)
+	runningRecyclers.wg.Wait()
+	if len(fake.created) != 1 {
+		t.Errorf("expected one scrubber pod, got %v", fake.created)
+	}
+}
+
+// A failed scrub leaves the PV Released, in backoff, with the log of the
+// scrubber in an event.
+func TestRecycleVolumeFailure(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	fake.results[testScrubberPod] = PodFailed
+	fake.logs = "rm: permission denied"
+
+	syncVolumeFromCache(t, "volume")()
+	runningRecyclers.wg.Wait()
+	if pv := store.PV("volume"); pv.Status.Phase != Released || pv.Spec.ClaimPtr == nil {
+		t.Errorf("expected the PV Released, got %+v", pv)
+	}
+	if attempts, _ := recyclingBackoff.Get("volume-uid"); attempts != 1 {
+		t.Errorf("expected 1 failed attempt, got %d", attempts)
+	}
+	if !slices.Equal(fake.deleted, []string{testScrubberPod}) {
+		t.Errorf("expected the scrubber pod deleted for the next attempt, got %v", fake.deleted)
+	}
+	expected := []string{"RecycleStarted pv/volume", "RecycleFailedWithLogs pv/volume", "RecycleBackoff pv/volume"}
+	if events := store.Events(); !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+	if result := syncVolumeFromCache(t, "volume")(); result.requeueAfter <= 0 {
+		t.Errorf("expected a wait for the backoff, got %+v", result)
+	}
+}
+
+// addScrubberPod adds the scrubber pod of the test volume, as a previous
+// leader would have created it, created ago, labelled for the PV with
+// uid.
+func addScrubberPod(fake *fakePods, uid string, ago time.Duration) {
+	pod := testRecycler{}.NewScrubberPod(nil)
+	pod.Namespace = recyclerNamespace
+	pod.Name = testScrubberPod
+	pod.Labels = map[string]string{labelRecyclerFor: uid}
+	pod.CreationTimestamp = clock.Now().Add(-ago)
+	fake.pods[pod.Namespace+"/"+pod.Name] = pod
+}
+
+// After a restart, the scrubber the previous leader started is adopted:
+// waited for, not created again.
+func TestRecycleVolumeAdoption(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	addScrubberPod(fake, "volume-uid", time.Minute)
+	fake.results[testScrubberPod] = Succeeded
+
+	syncVolumeFromCache(t, "volume")()
+	runningRecyclers.wg.Wait()
+	if len(fake.created) != 0 {
+		t.Errorf("expected no new scrubber pod, got %v", fake.created)
+	}
+	if !slices.Equal(fake.deleted, []string{testScrubberPod}) {
+		t.Errorf("expected the adopted pod deleted when done, got %v", fake.deleted)
+	}
+	if pv := store.PV("volume"); pv.Status.Phase != Available {
+		t.Errorf("expected the PV Available, got %+v", pv)
+	}
+	if events := store.Events(); !slices.Equal(events, []string{"RecycleSucceeded pv/volume"}) {
+		t.Errorf("expected only RecycleSucceeded, got %v", events)
+	}
+}
+
+// A pod with the name of the scrubber that is not ours is left alone.
+func TestRecycleVolumeAdoptionForeignPod(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	addScrubberPod(fake, "other-uid", time.Minute)
+	fake.results[testScrubberPod] = Succeeded
+
+	syncVolumeFromCache(t, "volume")()
+	runningRecyclers.wg.Wait()
+	if len(fake.created) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected the pod left alone, got created %v, deleted %v", fake.created, fake.deleted)
+	}
+	if pv := store.PV("volume"); pv.Status.Phase != Released {
+		t.Errorf("expected the PV Released, got %+v", pv)
+	}
+	if events := store.Events(); !slices.Equal(events, []string{"RecycleFailed pv/volume"}) {
+		t.Errorf("expected RecycleFailed, got %v", events)
+	}
+}
+
+// The timeout of an adopted scrubber runs from its creation, not from the
+// restart: one stuck for longer than recycleTimeout is given up on at once.
+func TestRecycleVolumeAdoptionTimeout(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	// No result: it never ends.
+	addScrubberPod(fake, "volume-uid", 2*recycleTimeout)
+
+	syncVolumeFromCache(t, "volume")()
+	runningRecyclers.wg.Wait()
+	if !slices.Equal(fake.deleted, []string{testScrubberPod}) {
+		t.Errorf("expected the stuck pod deleted, got %v", fake.deleted)
+	}
+	if attempts, _ := recyclingBackoff.Get("volume-uid"); attempts != 1 {
+		t.Errorf("expected 1 failed attempt, got %d", attempts)
+	}
+	expected := []string{"RecycleTimedOut pv/volume", "RecycleBackoff pv/volume"}
+	if events := store.Events(); !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+// A scrubber that does not finish within recycleTimeout is deleted.
+func TestRecycleVolumeTimeout(t *testing.T) {
+	store, fake := newRecyclerTest(t)
+	fakeClock := newFakeClock(t)
+
+	syncVolumeFromCache(t, "volume")()
+	<-fake.waiting
+	fakeClock.Step(recycleTimeout - time.Second)
+	if len(fake.deleted) != 0 {
+		t.Fatalf("expected the scrubber left running, got %v deleted", fake.deleted)
+	}
+	fakeClock.Step(time.Second)
+	runningRecyclers.wg.Wait()
+	if !slices.Equal(fake.deleted, []string{testScrubberPod}) {
+		t.Errorf("expected the stuck pod deleted, got %v", fake.deleted)
+	}
+	expected := []string{"RecycleStarted pv/volume", "RecycleTimedOut pv/volume", "RecycleBackoff pv/volume"}
+	if events := store.Events(); !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
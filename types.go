@@ -0,0 +1,533 @@
+// This file defines the API types the storage controller reads and writes,
+// as far as it is concerned: PersistentVolumes (PV) and
+// PersistentVolumeClaims (PVClaim), and the storage classes, pods and jobs
+// it looks at.  Fields the controller never looks at are left out.
+//
+// The two ends of a binding refer to each other by ObjectReference (name,
+// and UID), never by Go pointer: the controller only ever sees copies of
+// the objects, read from its cache or the API server at different times.
+// claimReference and volumeReference make them.
+
+package persistentvolume
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// UID is the unique ID the API server assigns to each object.  Unlike the
+// name, it is never reused: a claim deleted and re-created with the same
+// name has a new UID.
+type UID string
+
+// ObjectMeta is the metadata common to all API objects.
+type ObjectMeta struct {
+	Name      string
+	Namespace string // empty for PVs
+	UID       UID
+	// Opaque; sent back with each write as the precondition of the
+	// optimistic concurrency check, see commitFailed.
+	ResourceVersion   string
+	CreationTimestamp time.Time
+	// Set when the object is being deleted and waits for its finalizers.
+	DeletionTimestamp *time.Time
+	Finalizers        []string
+	Labels            map[string]string
+	Annotations       map[string]string
+}
+
+// GetObjectMeta makes every API object an Object.
+func (m *ObjectMeta) GetObjectMeta() *ObjectMeta {
+	return m
+}
+
+// Object is any API object, for the helpers that only look at its
+// metadata (hasAnnotation and such).
+type Object interface {
+	GetObjectMeta() *ObjectMeta
+}
+
+// deepCopy returns a copy of m that shares nothing with it.
+func (m ObjectMeta) deepCopy() ObjectMeta {
+	m.Finalizers = slices.Clone(m.Finalizers)
+	m.Labels = maps.Clone(m.Labels)
+	m.Annotations = maps.Clone(m.Annotations)
+	if m.DeletionTimestamp != nil {
+		t := *m.DeletionTimestamp
+		m.DeletionTimestamp = &t
+	}
+	return m
+}
+
+// ObjectReference points to the other end of a binding.  An empty UID
+// means "any object of this name": a binding requested by name by the
+// user, not completed yet.
+type ObjectReference struct {
+	Namespace string
+	Name      string
+	UID       UID
+}
+
+// claimReference returns a reference to pvc, with its UID.
+func claimReference(pvc *PVClaim) *ObjectReference {
+	return &ObjectReference{Namespace: pvc.Namespace, Name: pvc.Name, UID: pvc.UID}
+}
+
+// volumeReference returns a reference to pv, with its UID.
+func volumeReference(pv *PV) *ObjectReference {
+	return &ObjectReference{Name: pv.Name, UID: pv.UID}
+}
+
+// refersTo tells whether ref points to the object with the given metadata.
+// A reference without UID points to any object of that name; one with a
+// UID does not point to a re-created object of the same name.
+func refersTo(ref *ObjectReference, meta *ObjectMeta) bool {
+	return ref != nil && ref.Namespace == meta.Namespace && ref.Name == meta.Name &&
+		(ref.UID == "" || ref.UID == meta.UID)
+}
+
+// Phase is the phase of a PV or a claim, as the controller observed it last.
+// The phases are written by the controller only; nothing is decided on
+// them alone.
+type Phase string
+
+const (
+	// Claims: not bound yet.
+	Pending Phase = "Pending"
+	// PVs: not bound, may be bound to a claim.
+	Available Phase = "Available"
+	// PVs and claims: bound to each other.
+	Bound Phase = "Bound"
+	// PVs: the claim is gone; waiting for the reclaim policy.
+	Released Phase = "Released"
+	// PVs: the reclaim policy failed; needs the admin.
+	Failed Phase = "Failed"
+	// Claims: the PV is gone.
+	Lost Phase = "Lost"
+)
+
+// PVPhaseTransitions lists, for each phase of a PV, the phases the
+// controller may move it to.  Staying in a phase is always allowed.  It is
+// the source of truth for CommitPVStatus, and for tests of the syncs.
+//
+//	"" -> Available, Bound, Released: a new PV gets its first phase.  A
+//	      provisioned PV whose claim got bound elsewhere is Released at
+//	      once.
+//	Available -> Bound: bound to a claim.
+//	Available -> Released: bound, but the claim went away before the
+//	      Bound status was written.
+//	Bound -> Released: the claim went away.
+//	Bound -> Available: the claim pointer was removed (by us, after losing
+//	      a bind race, or by the admin).
+//	Released -> Available: recycled, or the claim pointer was removed.
+//	Released -> Failed: the reclaim policy failed.
+//	Failed -> Available: the admin removed the claim pointer.  Nothing
+//	      else moves a PV out of Failed; see syncPV.
+var PVPhaseTransitions = map[Phase][]Phase{
+	"":        {Available, Bound, Released},
+	Available: {Bound, Released},
+	Bound:     {Released, Available},
+	Released:  {Available, Failed},
+	Failed:    {Available},
+}
+
+// ClaimPhaseTransitions is PVPhaseTransitions for claims.
+//
+//	"" -> Pending: a new claim, not bound yet.
+//	"", Pending -> Bound: bound to a PV.
+//	"", Pending, Bound -> Lost: the PV is gone or bound elsewhere.  (A
+//	      claim can be Lost before it was ever Bound if the Bound status
+//	      was never written.)
+//	Lost -> Bound: the PV showed up again, bound to this very claim (UID),
+//	      e.g. restored from a backup.
+var ClaimPhaseTransitions = map[Phase][]Phase{
+	"":      {Pending, Bound, Lost},
+	Pending: {Bound, Lost},
+	Bound:   {Lost},
+	Lost:    {Bound},
+}
+
+// ValidatePVPhaseTransition returns an error if PVPhaseTransitions does not
+// allow a PV to go from one phase to the other.
+func ValidatePVPhaseTransition(from, to Phase) error {
+	return validatePhaseTransition(PVPhaseTransitions, "volume", from, to)
+}
+
+// ValidateClaimPhaseTransition returns an error if ClaimPhaseTransitions
+// does not allow a claim to go from one phase to the other.
+func ValidateClaimPhaseTransition(from, to Phase) error {
+	return validatePhaseTransition(ClaimPhaseTransitions, "claim", from, to)
+}
+
+func validatePhaseTransition(transitions map[Phase][]Phase, kind string, from, to Phase) error {
+	if from == to || slices.Contains(transitions[from], to) {
+		return nil
+	}
+	return fmt.Errorf("invalid %s phase transition %q -> %q", kind, from, to)
+}
+
+// Condition is a named, timestamped status flag of a PV or a claim.
+type Condition struct {
+	Type               string
+	Status             string // "True", "False", "Unknown"
+	Message            string
+	LastTransitionTime time.Time
+}
+
+// getCondition returns the condition of the given type, or nil.
+func getCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition adds or updates the condition of the given type.  Its
+// LastTransitionTime changes only when status does.
+func setCondition(conditions []Condition, conditionType, status, message string) []Condition {
+	if c := getCondition(conditions, conditionType); c != nil {
+		if c.Status != status {
+			c.LastTransitionTime = clock.Now()
+		}
+		c.Status = status
+		c.Message = message
+		return conditions
+	}
+	return append(conditions, Condition{Type: conditionType, Status: status, Message: message, LastTransitionTime: clock.Now()})
+}
+
+type PV struct {
+	ObjectMeta
+	Spec   PVSpec
+	Status PVStatus
+}
+
+// DeepCopy returns a copy of pv that shares nothing with it, for the syncs
+// that must not change the cached object.
+func (pv *PV) DeepCopy() *PV {
+	c := *pv
+	c.ObjectMeta = pv.ObjectMeta.deepCopy()
+	c.Spec = pv.Spec.deepCopy()
+	c.Status = pv.Status.DeepCopy()
+	return &c
+}
+
+type PVSpec struct {
+	// Size in bytes.
+	Capacity int64
+	// The volume plugin specific source (NFS server and path, cloud disk
+	// ID, ...); see volumeSourceType.  CSI volumes have CSI set instead.
+	PersistentVolumeSource
+	CSI              *CSIVolumeSource
+	StorageClassName string
+	// "Retain", "Delete", "Recycle" or "Archive".
+	ReclaimPolicy string
+	MountOptions  []string
+	NodeAffinity  *VolumeNodeAffinity
+	// Namespaces whose claims may be bound to this PV; empty for any.
+	AllowedClaimNamespaces []string
+	// The claim this PV is bound to, or pre-bound to (empty UID); nil if
+	// it is not bound.
+	ClaimPtr *ObjectReference
+}
+
+// deepCopy copies the pointers of spec; what they point to is not changed
+// by the controller, except the claim pointer.
+func (spec PVSpec) deepCopy() PVSpec {
+	spec.MountOptions = slices.Clone(spec.MountOptions)
+	spec.AllowedClaimNamespaces = slices.Clone(spec.AllowedClaimNamespaces)
+	if spec.ClaimPtr != nil {
+		ref := *spec.ClaimPtr
+		spec.ClaimPtr = &ref
+	}
+	return spec
+}
+
+// PersistentVolumeSource says where the data of a PV is, for the volume
+// plugins that are not CSI drivers.  Exactly one field is set.
+type PersistentVolumeSource struct {
+	NFS      *NFSVolumeSource
+	HostPath *HostPathVolumeSource
+}
+
+type NFSVolumeSource struct {
+	Server string
+	Path   string
+}
+
+type HostPathVolumeSource struct {
+	Path string
+}
+
+type CSIVolumeSource struct {
+	Driver          string
+	VolumeHandle    string
+	DeleteSecretRef *SecretReference
+}
+
+// SecretReference names a secret, e.g. with the credentials of a
+// provisioner.
+type SecretReference struct {
+	Namespace string
+	Name      string
+}
+
+type VolumeNodeAffinity struct {
+	Required *NodeSelector
+}
+
+// NodeSelector selects the nodes that match any of its terms.
+type NodeSelector struct {
+	Terms []NodeSelectorTerm
+}
+
+// NodeSelectorTerm matches the nodes that match all of its requirements.
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement
+}
+
+// NodeSelectorRequirement matches the nodes whose label Key has one of
+// Values ("In"), or none of them ("NotIn").
+type NodeSelectorRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// TopologySelectorTerm is a topology a class allows its volumes in, e.g.
+// {"topology.kubernetes.io/zone": ["us-east-1a"]}: each label must have
+// one of the values.
+type TopologySelectorTerm struct {
+	MatchLabelExpressions map[string][]string
+}
+
+type PVStatus struct {
+	Phase Phase
+	// Why the PV is Failed, for the admin.
+	Message    string
+	Conditions []Condition
+}
+
+func (s PVStatus) DeepCopy() PVStatus {
+	s.Conditions = slices.Clone(s.Conditions)
+	return s
+}
+
+func (s *PVStatus) GetCondition(conditionType string) *Condition {
+	return getCondition(s.Conditions, conditionType)
+}
+
+func (s *PVStatus) SetCondition(conditionType, status, message string) {
+	s.Conditions = setCondition(s.Conditions, conditionType, status, message)
+}
+
+type PVClaim struct {
+	ObjectMeta
+	Spec   PVClaimSpec
+	Status PVClaimStatus
+}
+
+// PVC is another name of PVClaim, used in a few places.
+type PVC = PVClaim
+
+// DeepCopy is PV.DeepCopy for claims.
+func (pvc *PVClaim) DeepCopy() *PVClaim {
+	c := *pvc
+	c.ObjectMeta = pvc.ObjectMeta.deepCopy()
+	c.Spec.Resources.Requests = maps.Clone(pvc.Spec.Resources.Requests)
+	if pvc.Spec.VolumePtr != nil {
+		ref := *pvc.Spec.VolumePtr
+		c.Spec.VolumePtr = &ref
+	}
+	c.Status = pvc.Status.DeepCopy()
+	return &c
+}
+
+type PVClaimSpec struct {
+	// Requests[Storage] is the requested size in bytes.
+	Resources        ResourceRequirements
+	StorageClassName string
+	// The PV this claim is bound to, or asked for by name by the user;
+	// nil if neither.
+	VolumePtr *ObjectReference
+}
+
+type ResourceName string
+
+// Storage is the resource name of the size of a claim.
+const Storage ResourceName = "storage"
+
+type ResourceRequirements struct {
+	Requests map[ResourceName]int64
+	// Only used in pods, see ScrubberPodTemplate.
+	Limits map[ResourceName]int64
+}
+
+func (r ResourceRequirements) IsEmpty() bool {
+	return len(r.Requests) == 0 && len(r.Limits) == 0
+}
+
+type PVClaimStatus struct {
+	Phase Phase
+	// The storage class that applied to the claim and how it was resolved;
+	// see recordResolvedClass.
+	ResolvedClass     string
+	ResolvedClassMode string
+	Conditions        []Condition
+}
+
+func (s PVClaimStatus) DeepCopy() PVClaimStatus {
+	s.Conditions = slices.Clone(s.Conditions)
+	return s
+}
+
+func (s *PVClaimStatus) GetCondition(conditionType string) *Condition {
+	return getCondition(s.Conditions, conditionType)
+}
+
+func (s *PVClaimStatus) SetCondition(conditionType, status, message string) {
+	s.Conditions = setCondition(s.Conditions, conditionType, status, message)
+}
+
+// StorageClass is a class of storage the admin offers, with the settings
+// the controller uses for its claims and volumes.
+type StorageClass struct {
+	ObjectMeta
+	// The name of the ProvisionerPlugin (or CSI driver) that provisions
+	// volumes of this class; empty if they are made by the admin.
+	Provisioner string
+	// Passed to the provisioner, see expandClaimParameters.
+	Parameters map[string]string
+	// The reclaim policy of provisioned PVs, see classReclaimPolicy.
+	ReclaimPolicy     string
+	AllowedTopologies []TopologySelectorTerm
+	// The provisioner's credentials, see resolveProvisionerCredentials.
+	CredentialsSecretRef *SecretReference
+	// Limits of the requested size of claims, in bytes; nil if none.
+	MinClaimSize *int64
+	MaxClaimSize *int64
+	// Opt-ins and opt-outs; see the functions that read them.
+	ProvisioningDisabled  bool
+	StrictBinding         bool
+	RequireDeleteApproval bool
+	ReplaceFailedVolumes  bool
+	RestoreFromSnapshot   bool
+	RecyclerPodTemplate   *ScrubberPodTemplate
+}
+
+// ScrubberPodTemplate overrides parts of the scrubber pod a RecyclerPlugin
+// makes, e.g. to use a mirrored image in an air-gapped cluster.  Empty
+// fields leave the plugin's choice alone.
+type ScrubberPodTemplate struct {
+	// Namespace replaces recyclerNamespace.
+	Namespace string
+	// SecurityContext replaces the pod security context the plugin asked
+	// for, e.g. to run as a non-root user that owns the volume's files
+	// where privileged pods are forbidden.
+	SecurityContext    *PodSecurityContext
+	Image              string
+	Command            []string
+	Resources          ResourceRequirements
+	NodeSelector       map[string]string
+	ServiceAccountName string
+}
+
+// Snapshot is a snapshot of a volume, a source to provision from (see
+// replaceFailedVolume).
+type Snapshot struct {
+	ObjectMeta
+	// The PV the snapshot was taken of.
+	VolumeName string
+	// The ID of the snapshot in the storage backend.
+	SnapshotHandle string
+	CreationTime   time.Time
+}
+
+// ProvisioningQuota limits what may be provisioned for the claims of a
+// namespace (see checkProvisioningQuota); zero means no limit.
+type ProvisioningQuota struct {
+	MaxVolumes  int
+	MaxCapacity int64
+}
+
+// Secret holds credentials, e.g. of a provisioner.
+type Secret struct {
+	ObjectMeta
+	Data map[string]string
+}
+
+// Pod is a pod, as far as the controller cares: the pods that use a claim
+// (claimPodIndex) and the scrubber pods of the recycler.
+type Pod struct {
+	ObjectMeta
+	Spec   PodSpec
+	Status PodStatus
+}
+
+type PodSpec struct {
+	Containers         []Container
+	Volumes            []Volume
+	SecurityContext    *PodSecurityContext
+	NodeSelector       map[string]string
+	Affinity           *Affinity
+	ServiceAccountName string
+}
+
+type Container struct {
+	Name      string
+	Image     string
+	Command   []string
+	Resources ResourceRequirements
+}
+
+// Volume is a volume of a pod; only the claim volumes are listed.
+type Volume struct {
+	Name                  string
+	PersistentVolumeClaim *PVClaimVolumeSource
+}
+
+type PVClaimVolumeSource struct {
+	ClaimName string
+}
+
+type PodSecurityContext struct {
+	RunAsUser  *int64
+	RunAsGroup *int64
+	FSGroup    *int64
+}
+
+type Affinity struct {
+	NodeAffinity *PodNodeAffinity
+}
+
+type PodNodeAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution *NodeSelector
+}
+
+type PodPhase string
+
+// The phases of a pod that has ended.
+const (
+	Succeeded PodPhase = "Succeeded"
+	PodFailed PodPhase = "Failed"
+)
+
+type PodStatus struct {
+	Phase PodPhase
+}
+
+// Job runs a pod until it succeeds, see scrubberJob.
+type Job struct {
+	ObjectMeta
+	Spec JobSpec
+}
+
+type JobSpec struct {
+	// How many times a failed pod is retried.
+	BackoffLimit int
+	Template     *Pod
+}